@@ -0,0 +1,77 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Assemble assembles one line of source, an instruction or a db/dw, as if it
+// were at pc and returns its bytes.  Symbols are resolved against debug, which
+// may be nil, with the global label containing pc in scope so its local labels,
+// params and locals can be used without a prefix, as in the source.
+func Assemble(line string, pc uint16, debug *DebugFile) ([]byte, error) {
+	parser := NewParserFromReader("line", strings.NewReader(line+"\n"))
+	parser.SetProcessInclude(false)
+	symbols := NewSymbolTable()
+	var fn *FunctionInfo
+	if debug != nil {
+		symbols = debug.SymbolTable()
+		if label := debug.GlobalLabelAt(pc); label != nil {
+			parser.global = label.Name
+		}
+		fn = debug.FunctionAt(pc)
+	}
+	parser.Parse()
+	if err := firstError(parser.Messages()); err != nil {
+		return nil, err
+	}
+	stmt := parser.Statements()
+	if stmt == nil {
+		return nil, errors.New("nothing to assemble")
+	}
+	if stmt.Next() != nil {
+		return nil, errors.New("expected one statement")
+	}
+	switch stmt.(type) {
+	case *InstructionStatement, *DefineByteStatement, *DefineWordStatement:
+	default:
+		return nil, errors.New("only an instruction, db or dw can be assembled")
+	}
+	linker := NewLinker(stmt)
+	linker.symbols = symbols
+	linker.pc = int(pc)
+	if fn != nil {
+		// so ret becomes rst, as it would in the function's source
+		linker.function = &FunctionStatement{name: fn.Name}
+	}
+	linker.Link()
+	if err := firstError(linker.Messages()); err != nil {
+		return nil, err
+	}
+	return linker.BytesFor(stmt), nil
+}
+
+// firstError returns the first error in messages without its location, or nil.
+func firstError(messages *Messages) error {
+	for _, msg := range messages.messages {
+		if msg.messageType == MessageError {
+			return fmt.Errorf("%s", msg.message)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleMatchesLinker(t *testing.T) {
+	linker := linkSource(t, debugSource)
+	debug := linker.DebugFile()
+	code := linker.Code()
+
+	// "add total, a" at sum.loop, with the function's params and locals in scope
+	bytes, err := Assemble("add total, a", 0x16, debug)
+	assert.Nil(t, err)
+	assert.Equal(t, code[0x16:0x19], bytes)
+
+	// ret within a function is rst, as in the source
+	bytes, err = Assemble("ret", 0x19, debug)
+	assert.Nil(t, err)
+	assert.Equal(t, code[0x19:0x1a], bytes)
+
+	bytes, err = Assemble("jsr sum", 0x10, debug)
+	assert.Nil(t, err)
+	assert.Equal(t, code[0x10:0x13], bytes)
+
+	// local labels resolve against the enclosing global label
+	bytes, err = Assemble("jmp loop", 0x19, debug)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x16, 0x00}, bytes[1:])
+}
+
+func TestAssembleData(t *testing.T) {
+	bytes, err := Assemble(`db "hi", 0`, 0x200, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'h', 'i', 0}, bytes)
+
+	bytes, err = Assemble("dw 0x1234, STDOUT", 0x200, linkSource(t, debugSource).DebugFile())
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x34, 0x12, 0x10, 0x00}, bytes)
+}
+
+func TestAssembleErrors(t *testing.T) {
+	debug := linkSource(t, debugSource).DebugFile()
+	for _, line := range []string{"", "jmp nowhere", "loop2: hlt", "org 0x100", "add #1", "bogus"} {
+		_, err := Assemble(line, 0x100, debug)
+		assert.NotNil(t, err, line)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// maxFrames limits how far Backtrace walks, in case the stack is corrupt.
+const maxFrames = 64
+
+// Frame is one call in a backtrace.
+type Frame struct {
+	PC       uint16 // current pc for the innermost frame, else the return address
+	FP       uint16 // frame pointer, 0 if the function has no frame
+	Function string // function name, or label+offset if it isn't a declared function
+	File     string
+	Line     int
+	Args     []FrameValue
+	Locals   []FrameValue
+}
+
+// FrameValue is the value of a param or local in a frame.
+type FrameValue struct {
+	FrameSlot
+	Value int
+}
+
+func (v FrameValue) String() string {
+	return fmt.Sprintf("%s=%d", v.Name, v.Value)
+}
+
+// String formats the frame as "name(arg=1, ...) at file:line (pc=0x0000)".
+func (f Frame) String() string {
+	var b strings.Builder
+	name := f.Function
+	if name == "" {
+		name = "??"
+	}
+	b.WriteString(name)
+	if f.FP != 0 {
+		b.WriteString("(")
+		for i, arg := range f.Args {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(arg.String())
+		}
+		b.WriteString(")")
+	}
+	if f.File != "" {
+		fmt.Fprintf(&b, " at %s:%d", f.File, f.Line)
+	}
+	fmt.Fprintf(&b, " (pc=0x%04x)", f.PC)
+	return b.String()
+}
+
+// Backtrace walks the frame pointer chain of the machine's current state.
+func Backtrace(m *machine.Machine, debug *DebugFile) []Frame {
+	flags := m.Flags()
+	return BacktraceFrom(m.Memory(), flags.PC, flags.SP, flags.FP, debug)
+}
+
+/*
+BacktraceFrom walks the frame pointer chain starting from the given registers.
+Functions declared with params or locals start with sav, which leaves the
+stack as:
+
+	fp+4	args
+	fp+2	return address
+	fp -->	caller's fp
+	fp-2	locals
+
+so each frame links to its caller until fp is 0, its value at power on.  A
+plain label called with jsr has no frame, so if pc is in one the return
+address is taken from the top of the stack when it follows a jsr, and the
+outermost frame's return address is included if it follows a jsr.
+*/
+func BacktraceFrom(mem machine.Memory, pc, sp, fp uint16, debug *DebugFile) []Frame {
+	var frames []Frame
+	fn := debug.FunctionAt(pc)
+	switch {
+	case fn != nil && pc == fn.Addr:
+		// sav hasn't run yet, so the return address is on top of the stack
+		frames = append(frames, debug.frame(mem, pc, 0, nil, false))
+		pc = mem.GetWord(sp)
+		frames[0].Function = fn.Name
+	case fn == nil:
+		frames = append(frames, debug.frame(mem, pc, 0, nil, false))
+		ret := mem.GetWord(sp)
+		if fp == 0 || !FollowsCall(mem, ret) {
+			return frames
+		}
+		pc = ret
+	}
+	for len(frames) < maxFrames && fp != 0 {
+		fn = debug.FunctionAt(pc)
+		frames = append(frames, debug.frame(mem, pc, fp, fn, len(frames) > 0))
+		callerFP := mem.GetWord(fp)
+		pc = mem.GetWord(fp + 2)
+		if callerFP != 0 && callerFP <= fp {
+			break // fp must move up the stack, else it's corrupt
+		}
+		fp = callerFP
+		if fp == 0 && FollowsCall(mem, pc) {
+			// called from code without a frame, ie a test
+			frames = append(frames, debug.frame(mem, pc, 0, nil, true))
+		}
+	}
+	return frames
+}
+
+// frame decodes one frame.  If pc is a return address, the source line is
+// that of the jsr before it.
+func (d *DebugFile) frame(mem machine.Memory, pc, fp uint16, fn *FunctionInfo, ret bool) Frame {
+	f := Frame{PC: pc, Function: d.Symbolize(pc)}
+	if ret {
+		f.File, f.Line = d.SourceLine(pc-1, bankOf(mem, pc-1))
+	} else {
+		f.File, f.Line = d.SourceLine(pc, bankOf(mem, pc))
+	}
+	if fn == nil {
+		return f
+	}
+	f.Function = fn.Name
+	f.FP = fp
+	f.Args = frameValues(mem, fp, fn.Args)
+	f.Locals = frameValues(mem, fp, fn.Locals)
+	return f
+}
+
+// bankOf returns the bank the code at addr runs from, the selected bank if
+// it's in the bank window.  jsr doesn't save the bank, so callers in the
+// window are assumed to run from the same bank.
+func bankOf(mem machine.Memory, addr uint16) int {
+	if addr < machine.BankWindowStart || addr > machine.BankWindowEnd {
+		return 0
+	}
+	return int(mem.GetWord(machine.BankAddr))
+}
+
+func frameValues(mem machine.Memory, fp uint16, slots []FrameSlot) []FrameValue {
+	var values []FrameValue
+	for _, slot := range slots {
+		addr := fp + uint16(slot.Offset)
+		value := int(mem.GetByte(addr))
+		if slot.Size == 2 {
+			value = int(mem.GetWord(addr))
+		}
+		values = append(values, FrameValue{FrameSlot: slot, Value: value})
+	}
+	return values
+}
+
+// followsCall returns true if addr is just past a jsr instruction.
+func FollowsCall(mem machine.Memory, addr uint16) bool {
+	for _, size := range []uint16{2, 3} {
+		op, m1, _ := machine.DecodeOp(mem.GetByte(addr - size))
+		if op == machine.Jsr && m1.Size()+1 == int(size) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const backtraceSource = `
+		dw main
+		org 0x100
+main():
+		var total word
+		psh #3
+		jsr sum
+		pop #2
+		hlt
+
+sum(n word):
+		var acc word
+		cpy acc, n
+		jsr leaf
+		rst
+
+leaf:	inc 0x200
+		ret
+`
+
+func runToLabel(t *testing.T, source string, label string) (*machine.Machine, *DebugFile) {
+	linker := linkSource(t, source)
+	debug := linker.DebugFile()
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.Nil(t, err)
+	m.SetBreakpoint(uint16(linker.Symbols().GetSymbol(label).Value()), nil, "")
+	m.Run()
+	assert.NotNil(t, m.Stopped())
+	return m, debug
+}
+
+func TestBacktraceFromLeaf(t *testing.T) {
+	m, debug := runToLabel(t, backtraceSource, "leaf")
+	frames := Backtrace(m, debug)
+	assert.Len(t, frames, 3)
+
+	assert.Equal(t, "leaf", frames[0].Function)
+	assert.Equal(t, uint16(0), frames[0].FP)
+
+	assert.Equal(t, "sum", frames[1].Function)
+	assert.Equal(t, []FrameValue{{FrameSlot{Name: "n", Size: 2, Offset: 4}, 3}}, frames[1].Args)
+	assert.Equal(t, []FrameValue{{FrameSlot{Name: "acc", Size: 2, Offset: -2}, 3}}, frames[1].Locals)
+	assert.Equal(t, 14, frames[1].Line)
+	assert.Equal(t, "sum(n=3) at test.s:14 (pc=0x0113)", frames[1].String())
+
+	assert.Equal(t, "main", frames[2].Function)
+	assert.Equal(t, 7, frames[2].Line)
+}
+
+func TestBacktraceAtFunctionEntry(t *testing.T) {
+	m, debug := runToLabel(t, backtraceSource, "sum")
+	frames := Backtrace(m, debug)
+	assert.Len(t, frames, 2)
+	assert.Equal(t, "sum", frames[0].Function)
+	assert.Equal(t, "main", frames[1].Function)
+	assert.Equal(t, "main() at test.s:7 (pc=0x0108)", frames[1].String())
+}
+
+const bankedBacktraceSource = `
+		dw main
+		org 0x100
+main():
+		var total word
+		cpy 12, #2
+		jsr far
+		hlt
+		org 0x8000
+near:	inc 0x200
+		inc 0x200
+		inc 0x200
+		inc 0x200
+		bank 2
+far():
+		var x word
+		cpy x, #1
+		jsr inner
+		rst
+inner:	inc 0x202
+		ret
+		bank 0
+`
+
+func TestBacktraceInBank(t *testing.T) {
+	m, debug := runToLabel(t, bankedBacktraceSource, "inner")
+	frames := Backtrace(m, debug)
+	assert.Len(t, frames, 3)
+	assert.Equal(t, "inner", frames[0].Function)
+	assert.Equal(t, 20, frames[0].Line)
+	assert.Equal(t, "far", frames[1].Function)
+	assert.Equal(t, 18, frames[1].Line)
+	assert.Equal(t, "main", frames[2].Function)
+	assert.Equal(t, 7, frames[2].Line)
+}
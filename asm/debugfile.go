@@ -0,0 +1,222 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// DebugFileExt is the suffix of the debug file written next to a binary.
+const DebugFileExt = ".dbg"
+
+// maxInstructionSize is the length of an opcode with two 2 byte operands.
+const maxInstructionSize = 5
+
+// DebugFileVersion is the current version of the debug file format.
+const DebugFileVersion = 1
+
+// DebugFile holds the symbols, function frames and line table for a binary,
+// so tools can show source level information without the source being
+// assembled again.  It's stored as JSON.
+type DebugFile struct {
+	Version   int            `json:"version"`
+	Symbols   []DebugSymbol  `json:"symbols"`
+	Functions []FunctionInfo `json:"functions,omitempty"`
+	Lines     []DebugInfo    `json:"lines"`
+}
+
+// DebugSymbol is a defined symbol.  For frame pointer symbols (function
+// params and locals) the value is the offset from fp.
+type DebugSymbol struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+	File  string `json:"file,omitempty"`
+	Line  int    `json:"line,omitempty"`
+	Label bool   `json:"label,omitempty"` // address of code or data, not an equate
+	Local bool   `json:"local,omitempty"`
+	FP    bool   `json:"fp,omitempty"`
+}
+
+// DebugFileName returns the name of the debug file for a binary, ie
+// "hello.dbg" for "hello.bin".
+func DebugFileName(binary string) string {
+	return strings.TrimSuffix(binary, filepath.Ext(binary)) + DebugFileExt
+}
+
+// DebugFile returns the debug information for the linked program.
+func (l *Linker) DebugFile() *DebugFile {
+	d := &DebugFile{
+		Version:   DebugFileVersion,
+		Functions: l.functions,
+		Lines:     l.debugInfo,
+	}
+	for _, sym := range l.symbols.Symbols() {
+		if !sym.defined {
+			continue
+		}
+		d.Symbols = append(d.Symbols, DebugSymbol{
+			Name:  sym.text,
+			Value: sym.value,
+			File:  sym.file,
+			Line:  sym.line,
+			Label: sym.label,
+			Local: sym.IsLocal(),
+			FP:    sym.fp,
+		})
+	}
+	return d
+}
+
+// Write encodes the debug file as JSON.
+func (d *DebugFile) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// ReadDebugFile decodes a debug file written by Write.
+func ReadDebugFile(r io.Reader) (*DebugFile, error) {
+	d := &DebugFile{}
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return nil, fmt.Errorf("invalid debug file: %s", err)
+	}
+	if d.Version != DebugFileVersion {
+		return nil, fmt.Errorf("unsupported debug file version %d (expected %d)", d.Version, DebugFileVersion)
+	}
+	return d, nil
+}
+
+// SymbolTable rebuilds a symbol table from the debug file.
+func (d *DebugFile) SymbolTable() *SymbolTable {
+	table := NewSymbolTable()
+	for _, sym := range d.Symbols {
+		if sym.FP {
+			table.AddFpSymbol(sym.File, sym.Line, sym.Name, sym.Value)
+			continue
+		}
+		table.AddSymbol(sym.File, sym.Line, sym.Name)
+		table.Define(sym.Name, sym.Value)
+		table.GetSymbol(sym.Name).label = sym.Label
+	}
+	return table
+}
+
+// SourceLine returns the source location of the instruction containing pc,
+// or an empty file name if pc isn't in the line table.
+func (d *DebugFile) SourceLine(pc uint16, bank int) (file string, line int) {
+	var best *DebugInfo
+	for i := range d.Lines {
+		info := &d.Lines[i]
+		if info.Bank == bank && info.PC <= pc && (best == nil || info.PC >= best.PC) {
+			best = info
+		}
+	}
+	if best == nil {
+		return "", 0
+	}
+	// pc must be within the instruction, which ends at the next entry or
+	// after the longest possible instruction
+	end := int(best.PC) + maxInstructionSize
+	for _, info := range d.Lines {
+		if info.Bank == bank && info.PC > best.PC && int(info.PC) < end {
+			end = int(info.PC)
+		}
+	}
+	if int(pc) >= end {
+		return "", 0
+	}
+	return best.File, best.Line
+}
+
+// maxSymbolOffset is how far past a label an address is still shown relative
+// to it, ie "buffer+12".
+const maxSymbolOffset = 0x100
+
+// Label returns the name of the global label at addr, or "" if there isn't one.
+func (d *DebugFile) Label(addr uint16) string {
+	for _, sym := range d.Symbols {
+		if sym.Label && !sym.Local && sym.Value == int(addr) {
+			return sym.Name
+		}
+	}
+	return ""
+}
+
+// Symbolize returns addr as the nearest label at or before it, ie "main+4" or
+// "main.loop", or "" if there's no label within maxSymbolOffset bytes.
+// Global labels are preferred over local labels at the same address.
+func (d *DebugFile) Symbolize(addr uint16) string {
+	var best *DebugSymbol
+	for i := range d.Symbols {
+		sym := &d.Symbols[i]
+		if !sym.Label || sym.Value > int(addr) || int(addr)-sym.Value >= maxSymbolOffset {
+			continue
+		}
+		if best == nil || sym.Value > best.Value || (sym.Value == best.Value && best.Local && !sym.Local) {
+			best = sym
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	if best.Value == int(addr) {
+		return best.Name
+	}
+	return fmt.Sprintf("%s+%d", best.Name, int(addr)-best.Value)
+}
+
+// GlobalLabelAt returns the nearest global label at or before pc, which is
+// the function or test containing it, or nil if there isn't one.
+func (d *DebugFile) GlobalLabelAt(pc uint16) *DebugSymbol {
+	var best *DebugSymbol
+	for i := range d.Symbols {
+		sym := &d.Symbols[i]
+		if sym.Label && !sym.Local && sym.Value <= int(pc) && (best == nil || sym.Value > best.Value) {
+			best = sym
+		}
+	}
+	return best
+}
+
+// FunctionAt returns the function containing pc, or nil if pc isn't within
+// a function declared with a frame.  A function extends to the next global label.
+func (d *DebugFile) FunctionAt(pc uint16) *FunctionInfo {
+	label := d.GlobalLabelAt(pc)
+	if label == nil {
+		return nil
+	}
+	for i := range d.Functions {
+		if int(d.Functions[i].Addr) == label.Value {
+			return &d.Functions[i]
+		}
+	}
+	return nil
+}
+
+// Slot returns the param or local at the given offset from fp, or nil.
+func (f *FunctionInfo) Slot(offset int) *FrameSlot {
+	for _, slots := range [][]FrameSlot{f.Args, f.Locals} {
+		for i := range slots {
+			if slots[i].Offset == offset {
+				return &slots[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func linkSource(t *testing.T, source string) *Linker {
+	linker, err := BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return linker
+}
+
+const debugSource = `
+STDOUT = 0x10
+		dw main
+		org 0x10
+main:	jsr sum
+		hlt
+sum(a word, b byte):
+		var total word
+.loop:	add total, a
+		ret
+`
+
+func TestDebugFileRoundTrip(t *testing.T) {
+	linker := linkSource(t, debugSource)
+	var buf bytes.Buffer
+	assert.Nil(t, linker.DebugFile().Write(&buf))
+
+	debug, err := ReadDebugFile(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, linker.DebugFile(), debug)
+
+	assert.Equal(t, []FunctionInfo{{
+		Name:   "sum",
+		Addr:   0x14,
+		File:   "test.s",
+		Line:   7,
+		Args:   []FrameSlot{{Name: "a", Size: 2, Offset: 5}, {Name: "b", Size: 1, Offset: 4}},
+		Locals: []FrameSlot{{Name: "total", Size: 2, Offset: -2}},
+	}}, debug.Functions)
+
+	symbols := debug.SymbolTable()
+	assert.Equal(t, 0x16, symbols.GetSymbol("sum.loop").Value())
+	assert.True(t, symbols.GetSymbol("sum.loop").IsLocal())
+	assert.True(t, symbols.GetSymbol("sum.total").IsFramePointer())
+	assert.Equal(t, -2, symbols.GetSymbol("sum.total").Value())
+	assert.False(t, symbols.GetSymbol("STDOUT").IsLabel())
+}
+
+func TestDebugFileLookups(t *testing.T) {
+	debug := linkSource(t, debugSource).DebugFile()
+	assert.Equal(t, "main", debug.Label(0x10))
+	assert.Equal(t, "sum", debug.Label(0x14))
+	assert.Equal(t, "", debug.Label(0x16))
+
+	file, line := debug.SourceLine(0x11, 0)
+	assert.Equal(t, "test.s", file)
+	assert.Equal(t, 5, line)
+	_, line = debug.SourceLine(0x16, 0)
+	assert.Equal(t, 9, line)
+	// the sav emitted for a function maps to its declaration
+	_, line = debug.SourceLine(0x14, 0)
+	assert.Equal(t, 7, line)
+	file, _ = debug.SourceLine(0x100, 0)
+	assert.Equal(t, "", file)
+}
+
+func TestReadDebugFileErrors(t *testing.T) {
+	_, err := ReadDebugFile(strings.NewReader(`{"version": 9}`))
+	assert.NotNil(t, err)
+	_, err = ReadDebugFile(strings.NewReader(`not json`))
+	assert.NotNil(t, err)
+	assert.Equal(t, "prog.dbg", DebugFileName("prog.bin"))
+}
+
+func TestDebugFileSymbolize(t *testing.T) {
+	debug := linkSource(t, debugSource).DebugFile()
+	assert.Equal(t, "main", debug.Symbolize(0x10))
+	assert.Equal(t, "main+3", debug.Symbolize(0x13))
+	assert.Equal(t, "sum.loop", debug.Symbolize(0x16))
+	assert.Equal(t, "", debug.Symbolize(0x08))
+
+	// local labels, params and equates aren't global labels
+	assert.Equal(t, "sum", debug.GlobalLabelAt(0x16).Name)
+	assert.Equal(t, "main", debug.GlobalLabelAt(0x13).Name)
+	assert.Nil(t, debug.GlobalLabelAt(0x08))
+
+	assert.Nil(t, debug.FunctionAt(0x12))
+	fn := debug.FunctionAt(0x17)
+	assert.NotNil(t, fn)
+	assert.Equal(t, "sum", fn.Name)
+	assert.Equal(t, "total", fn.Slot(-2).Name)
+	assert.Equal(t, "b", fn.Slot(4).Name)
+	assert.Nil(t, fn.Slot(-4))
+}
@@ -0,0 +1,402 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// registerBytes is the size of the memory mapped registers at the start of
+// main memory, which are always data.
+const registerBytes = 16
+
+// disassembler separates an image's code from its data by following every
+// path from the entry point, so the source it writes assembles back to the
+// same image.
+type disassembler struct {
+	img    *machine.Image
+	debug  *DebugFile
+	mem    [65536]byte
+	loaded [65536]bool             // in a main memory segment
+	code   map[uint16]*instruction // by address
+	inCode [65536]bool             // part of an instruction
+	labels map[uint16]string
+}
+
+// instruction is a decoded instruction.
+type instruction struct {
+	op     machine.OpCode
+	modes  [2]machine.AddressMode
+	values [2]int // operand value, the target address for jumps
+	size   int
+}
+
+// Disassemble writes source for img that assembles back to the same image.
+// Code is found by following jumps and calls from the entry point, and from
+// each line in debug if it isn't nil, and everything else is written as
+// data.  Labels are named by debug's symbols, or generated as Lxxxx for
+// code and Dxxxx for data.  Banks other than 0 are always written as data,
+// since the bank they run in isn't known.
+func Disassemble(w io.Writer, img *machine.Image, debug *DebugFile) error {
+	d := &disassembler{img: img, debug: debug, code: make(map[uint16]*instruction), labels: make(map[uint16]string)}
+	for _, seg := range img.Segments {
+		if seg.Bank != 0 {
+			continue
+		}
+		for i, b := range seg.Data {
+			d.mem[int(seg.Addr)+i] = b
+			d.loaded[int(seg.Addr)+i] = true
+		}
+	}
+	d.findCode()
+	d.findLabels()
+	bw := bufio.NewWriter(w)
+	d.write(bw)
+	return bw.Flush()
+}
+
+// findCode decodes the instructions reachable from the entry points.
+func (d *disassembler) findCode() {
+	work := []uint16{d.img.Entry}
+	if d.debug != nil {
+		for _, line := range d.debug.Lines {
+			if line.Bank == 0 {
+				work = append(work, line.PC)
+			}
+		}
+	}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		for {
+			if d.code[pc] != nil {
+				break
+			}
+			ins, ok := d.decode(pc)
+			if !ok {
+				break
+			}
+			d.code[pc] = ins
+			for i := 0; i < ins.size; i++ {
+				d.inCode[pc+uint16(i)] = true
+			}
+			switch ins.op {
+			case machine.Jmp, machine.Jsr, machine.Jeq, machine.Jne, machine.Jge, machine.Jlt, machine.Jcc, machine.Jcs:
+				work = append(work, uint16(ins.values[0]))
+			}
+			switch ins.op {
+			case machine.Hlt, machine.Jmp, machine.Ret, machine.Rst:
+			default:
+				pc += uint16(ins.size)
+				continue
+			}
+			break
+		}
+	}
+}
+
+// decode returns the instruction at pc, if it's loaded, doesn't overlap
+// another instruction and assembles back to the same bytes.
+func (d *disassembler) decode(pc uint16) (*instruction, bool) {
+	if int(pc) < registerBytes || !d.loaded[pc] || d.inCode[pc] {
+		return nil, false
+	}
+	op, m1, m2 := machine.DecodeOp(d.mem[pc])
+	// undefined opcodes decode as hlt
+	if machine.EncodeOp(op, m1, m2) != d.mem[pc] {
+		return nil, false
+	}
+	ins := &instruction{op: op, modes: [2]machine.AddressMode{m1, m2}, size: 1 + m1.Size() + m2.Size()}
+	if int(pc)+ins.size > len(d.mem) {
+		return nil, false
+	}
+	for i := 1; i < ins.size; i++ {
+		if !d.loaded[pc+uint16(i)] || d.inCode[pc+uint16(i)] {
+			return nil, false
+		}
+	}
+	at := pc + 1
+	for i, mode := range ins.modes {
+		switch mode.Size() {
+		case 1:
+			ins.values[i] = int(int8(d.mem[at]))
+			if mode == machine.ImmediateByte {
+				ins.values[i] = int(d.mem[at])
+			}
+			if mode == machine.OffsetByte {
+				ins.values[i] = int(pc + uint16(int8(d.mem[at])))
+			}
+		case 2:
+			ins.values[i] = int(d.mem[at]) | int(d.mem[at+1])<<8
+		}
+		at += uint16(mode.Size())
+	}
+	bytes, err := Assemble(d.format(ins, false), pc, nil)
+	if err != nil || string(bytes) != string(d.mem[pc:int(pc)+ins.size]) {
+		return nil, false
+	}
+	return ins, true
+}
+
+// findLabels names the entry point, jump targets, the addresses operands
+// refer to and the debug symbols, where they start an instruction or data.
+func (d *disassembler) findLabels() {
+	if d.debug != nil {
+		for _, sym := range d.debug.Symbols {
+			if sym.Label && !sym.FP && sym.Value >= registerBytes && sym.Value < len(d.mem) && d.canLabel(uint16(sym.Value)) {
+				if _, ok := d.labels[uint16(sym.Value)]; !ok || !sym.Local {
+					d.labels[uint16(sym.Value)] = strings.ReplaceAll(sym.Name, ".", "_")
+				}
+			}
+		}
+	}
+	d.label(d.img.Entry)
+	for _, ins := range d.code {
+		for i, mode := range ins.modes {
+			switch mode {
+			case machine.Absolute, machine.Indirect, machine.OffsetByte:
+				d.label(uint16(ins.values[i]))
+			case machine.Immediate:
+				if ins.op == machine.Jmp || ins.op == machine.Jsr {
+					d.label(uint16(ins.values[i]))
+				}
+			}
+		}
+	}
+}
+
+// canLabel reports if addr starts an instruction or is data.
+func (d *disassembler) canLabel(addr uint16) bool {
+	return d.loaded[addr] && (d.code[addr] != nil || !d.inCode[addr])
+}
+
+// label generates a label for addr if it can have one and doesn't already.
+func (d *disassembler) label(addr uint16) {
+	if int(addr) < registerBytes || !d.canLabel(addr) {
+		return
+	}
+	if _, ok := d.labels[addr]; ok {
+		return
+	}
+	if d.code[addr] != nil {
+		d.labels[addr] = fmt.Sprintf("L%04x", addr)
+	} else {
+		d.labels[addr] = fmt.Sprintf("D%04x", addr)
+	}
+}
+
+// format returns the instruction as source, with addresses as labels if
+// labels is true.
+func (d *disassembler) format(ins *instruction, labels bool) string {
+	address := func(v int) string {
+		if labels {
+			if name, ok := d.labels[uint16(v)]; ok {
+				return name
+			}
+		}
+		return fmt.Sprintf("0x%04x", v)
+	}
+	var operands []string
+	for i, mode := range ins.modes {
+		v := ins.values[i]
+		switch mode {
+		case machine.Immediate:
+			if ins.op == machine.Jmp || ins.op == machine.Jsr {
+				operands = append(operands, address(v))
+			} else {
+				operands = append(operands, "#"+address(v))
+			}
+		case machine.ImmediateByte:
+			operands = append(operands, fmt.Sprintf("#%d", v))
+		case machine.OffsetByte, machine.Absolute:
+			operands = append(operands, address(v))
+		case machine.Indirect:
+			operands = append(operands, "*"+address(v))
+		case machine.Relative:
+			operands = append(operands, fmt.Sprintf("[fp%+d]", v))
+		case machine.RelativeIndirect:
+			operands = append(operands, fmt.Sprintf("*[fp%+d]", v))
+		}
+	}
+	if len(operands) == 0 {
+		return ins.op.String()
+	}
+	return ins.op.String() + " " + strings.Join(operands, ", ")
+}
+
+// frameComment names the params and locals an instruction's fp relative
+// operands refer to, if there's debug info for its function.
+func (d *disassembler) frameComment(pc uint16, ins *instruction) string {
+	if d.debug == nil {
+		return ""
+	}
+	fn := d.debug.FunctionAt(pc)
+	if fn == nil {
+		return ""
+	}
+	var names []string
+	for i, mode := range ins.modes {
+		if mode == machine.Relative || mode == machine.RelativeIndirect {
+			if slot := fn.Slot(ins.values[i]); slot != nil {
+				names = append(names, slot.Name)
+			}
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// write writes the source, with directives for the image header then each
+// segment.
+func (d *disassembler) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "// entry 0x%04x, sp 0x%04x, fp 0x%04x\n", d.img.Entry, d.img.SP, d.img.FP)
+	if len(d.img.Devices) > 0 {
+		var ids []string
+		for _, id := range d.img.Devices {
+			ids = append(ids, fmt.Sprintf("0x%04x", id))
+		}
+		fmt.Fprintf(w, "\tdevice %s\n", strings.Join(ids, ", "))
+	}
+	for _, r := range d.img.Protection {
+		for _, p := range []struct {
+			flag machine.Protection
+			name string
+		}{{machine.ProtectWrite, "rom"}, {machine.ProtectExec, "noexec"}, {machine.ProtectStack, "stack"}} {
+			if r.Protection&p.flag != 0 {
+				fmt.Fprintf(w, "\t%s 0x%04x, 0x%04x\n", p.name, r.Start, int(r.End)+1)
+			}
+		}
+	}
+	bank := 0
+	for _, seg := range d.img.Segments {
+		if seg.Bank != bank {
+			fmt.Fprintf(w, "\n\tbank %d\n", seg.Bank)
+			bank = seg.Bank
+		}
+		fmt.Fprintf(w, "\n\torg 0x%04x\n", seg.Addr)
+		if seg.Bank != 0 {
+			d.writeData(w, seg.Addr, seg.Data, nil)
+			continue
+		}
+		d.writeSegment(w, seg)
+	}
+	if bank != 0 {
+		fmt.Fprintf(w, "\n\tbank 0\n")
+	}
+}
+
+// writeSegment writes a main memory segment's instructions and data.
+func (d *disassembler) writeSegment(w *bufio.Writer, seg machine.Segment) {
+	end := int(seg.Addr) + len(seg.Data)
+	for addr := int(seg.Addr); addr < end; {
+		if name, ok := d.labels[uint16(addr)]; ok {
+			fmt.Fprintf(w, "%s:\n", name)
+		}
+		if ins := d.code[uint16(addr)]; ins != nil {
+			text := "\t" + d.format(ins, true)
+			if comment := d.frameComment(uint16(addr), ins); comment != "" {
+				text = fmt.Sprintf("%-32s// %s", text, comment)
+			}
+			fmt.Fprintln(w, text)
+			addr += ins.size
+			continue
+		}
+		// data runs to the next label or instruction
+		next := addr + 1
+		for next < end && d.code[uint16(next)] == nil {
+			if _, ok := d.labels[uint16(next)]; ok {
+				break
+			}
+			next++
+		}
+		d.writeData(w, uint16(addr), d.mem[addr:next], d.labels)
+		addr = next
+	}
+}
+
+// writeData writes bytes at addr as dw for registers and words that are
+// the address of a label, as db strings for runs of printable characters,
+// as ds for runs of zeros, and as db otherwise.
+func (d *disassembler) writeData(w *bufio.Writer, addr uint16, data []byte, labels map[uint16]string) {
+	var bytes []string
+	flush := func() {
+		if len(bytes) > 0 {
+			fmt.Fprintf(w, "\tdb %s\n", strings.Join(bytes, ", "))
+			bytes = bytes[:0]
+		}
+	}
+	for i := 0; i < len(data); {
+		at := int(addr) + i
+		if i+1 < len(data) {
+			word := uint16(data[i]) | uint16(data[i+1])<<8
+			name, isLabel := labels[word]
+			if at < registerBytes || (isLabel && d.code[word] != nil) {
+				flush()
+				if !isLabel {
+					name = fmt.Sprintf("0x%04x", word)
+				}
+				fmt.Fprintf(w, "\tdw %s\n", name)
+				i += 2
+				continue
+			}
+		}
+		if n := printableRun(data[i:]); n >= 4 {
+			flush()
+			fmt.Fprintf(w, "\tdb %s\n", strconv.Quote(string(data[i:i+n])))
+			i += n
+			continue
+		}
+		if n := zeroRun(data[i:]); n >= 16 {
+			flush()
+			fmt.Fprintf(w, "\tds %d\n", n)
+			i += n
+			continue
+		}
+		bytes = append(bytes, fmt.Sprintf("0x%02x", data[i]))
+		if len(bytes) == 8 {
+			flush()
+		}
+		i++
+	}
+	flush()
+}
+
+// maxString is the longest string written on one line.
+const maxString = 60
+
+// printableRun returns the number of printable ASCII characters data starts
+// with, up to maxString.  Quotes and backslashes are excluded, so the string
+// doesn't need escapes.
+func printableRun(data []byte) int {
+	n := 0
+	for n < len(data) && n < maxString && data[n] >= ' ' && data[n] <= '~' && data[n] != '"' && data[n] != '\\' {
+		n++
+	}
+	return n
+}
+
+// zeroRun returns the number of zeros data starts with.
+func zeroRun(data []byte) int {
+	n := 0
+	for n < len(data) && data[n] == 0 {
+		n++
+	}
+	return n
+}
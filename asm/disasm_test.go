@@ -0,0 +1,114 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const disasmSource = `
+		dw main, 0xfff0
+		device 0x0300
+		rom 0x0100, 0x0180
+		org 0x100
+main():
+		var count word
+		cpy count, #10
+.loop:	psh #message
+		jsr print
+		pop #2
+		dec count
+		jne loop
+		jsr far
+		hlt
+print(text word):
+		cpy 0x300, text
+		ret
+message:	db "Hello, world!", 10, 0
+table:	dw main, print, 0x1234
+buffer:	ds 32
+		bank 1
+far:	cpy 0x200, #table
+		ret
+`
+
+// disassemble links source, disassembles its image and links the result
+// again, returning the disassembly and both images.
+func disassemble(t *testing.T, source string, withDebug bool) (string, *machine.Image, *machine.Image) {
+	linker := linkSource(t, source)
+	img := linker.Image()
+	var debug *DebugFile
+	if withDebug {
+		debug = linker.DebugFile()
+	}
+	var out bytes.Buffer
+	assert.NoError(t, Disassemble(&out, img, debug))
+	rebuilt := linkSource(t, out.String()).Image()
+	return out.String(), img, rebuilt
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	for _, withDebug := range []bool{false, true} {
+		text, img, rebuilt := disassemble(t, disasmSource, withDebug)
+		assert.Equal(t, img.Entry, rebuilt.Entry)
+		assert.Equal(t, img.SP, rebuilt.SP)
+		assert.Equal(t, img.Devices, rebuilt.Devices)
+		assert.Equal(t, img.Protection, rebuilt.Protection)
+		assert.Equal(t, img.Segments, rebuilt.Segments, text)
+	}
+}
+
+func TestDisassembleGeneratedLabels(t *testing.T) {
+	text, _, _ := disassemble(t, disasmSource, false)
+	assert.Contains(t, text, "\tdevice 0x0300\n")
+	assert.Contains(t, text, "\trom 0x0100, 0x0180\n")
+	assert.Contains(t, text, "\tdw L0100\n\tdw 0xfff0\n")
+	assert.Contains(t, text, "L0106:\n\tpsh #0x011d\n\tjsr L0116\n")
+	assert.Contains(t, text, "\tjne L0106\n")
+	assert.Contains(t, text, "\tdb \"Hello, world!\"\n\tdb 0x0a, 0x00\n")
+	assert.Contains(t, text, "\tdw L0100\n\tdw L0116\n\tdb 0x34, 0x12\n")
+	assert.Contains(t, text, "\tds 32\n")
+	// banked code is only reachable through the bank register, so it stays data
+	assert.Contains(t, text, "\tbank 1\n\n\torg 0x8000\n\tdb 0x1f,")
+	assert.Contains(t, text, "\tjsr 0x8000\n")
+}
+
+func TestDisassembleDebugLabels(t *testing.T) {
+	text, _, _ := disassemble(t, disasmSource, true)
+	assert.Contains(t, text, "main:\n\tsav #2\n")
+	assert.Contains(t, text, "\tcpy [fp-2], #0x000a            // count\n")
+	assert.Contains(t, text, "main_loop:\n\tpsh #message\n\tjsr print\n")
+	assert.Contains(t, text, "\tjne main_loop\n")
+	assert.Contains(t, text, "\tcpy 0x0300, [fp+4]             // text\n")
+	assert.Contains(t, text, "table:\n\tdw main\n\tdw print\n")
+	assert.Contains(t, text, "buffer:\n\tds 32\n")
+}
+
+func TestDisassembleDataOnly(t *testing.T) {
+	img := &machine.Image{
+		Entry:    0x0010,
+		Segments: []machine.Segment{{Addr: 0x0010, Data: []byte{0xff, 0xff, 0x41}}},
+	}
+	var out bytes.Buffer
+	assert.NoError(t, Disassemble(&out, img, nil))
+	// 0xff is not a valid opcode so nothing at the entry point decodes
+	assert.Contains(t, out.String(), "\torg 0x0010\nD0010:\n\tdb 0xff, 0xff, 0x41\n")
+	rebuilt := linkSource(t, out.String()).Image()
+	assert.Equal(t, img.Segments, rebuilt.Segments)
+}
@@ -86,6 +86,11 @@ const (
 	TokInclude
 	TokVar
 	TokTest
+	TokRom
+	TokNoexec
+	TokBank
+	TokDevice
+	TokStack
 	TokComment
 	TokEOL
 )
@@ -105,6 +110,7 @@ var tokenImage = []string{
 	"clc", "sec", "clb", "seb", "jcc",
 	"jcs", "sav", "rst", "hlt", "sea",
 	"function()", "include", "var", "test",
+	"rom", "noexec", "bank", "device", "stack",
 	"<comment>", "<eol>",
 }
 
@@ -23,10 +23,30 @@ import (
 
 // DebugInfo maps PC addresses to source locations
 type DebugInfo struct {
-	PC     uint16
-	File   string
-	Line   int
-	Column int
+	PC     uint16 `json:"pc"`
+	Bank   int    `json:"bank,omitempty"` // bank of extended memory, 0 for main memory
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column,omitempty"`
+}
+
+// FunctionInfo describes the stack frame of a function declared with
+// parameters or locals, so a debugger can find them relative to fp.
+type FunctionInfo struct {
+	Name   string      `json:"name"`
+	Addr   uint16      `json:"addr"`
+	Bank   int         `json:"bank,omitempty"`
+	File   string      `json:"file"`
+	Line   int         `json:"line"`
+	Args   []FrameSlot `json:"args,omitempty"`   // in declaration order
+	Locals []FrameSlot `json:"locals,omitempty"` // in declaration order
+}
+
+// FrameSlot is a function parameter or local variable at fp+Offset.
+type FrameSlot struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Offset int    `json:"offset"`
 }
 
 type Linker struct {
@@ -35,9 +55,33 @@ type Linker struct {
 	messages   *Messages
 	function   *FunctionStatement // Pointer to statement if in function with automatic fp/sav/rst handling
 	pc         int
-	code       []byte
+	code       []byte // code for the current bank
+	used       []bool // bytes of code that have been written, for the current bank
+	bank       int    // bank being written, 0 for main memory
+	banks      map[int]*bankOutput
+	stmtBank   map[Statement]int
+	devices    []uint16
 	patches    []patch
 	debugInfo  []DebugInfo
+	functions  []FunctionInfo
+	protects   []*ProtectStatement
+	protection []machine.Region
+}
+
+// bankOutput holds the code for one bank.  The code covers the full 64k address
+// space so pc needs no translation, but banks other than 0 only use the window.
+type bankOutput struct {
+	code []byte
+	used []bool
+	pc   int // saved pc while writing to another bank
+}
+
+func newBankOutput(pc int) *bankOutput {
+	return &bankOutput{
+		code: make([]byte, 65536),
+		used: make([]bool, 65536),
+		pc:   pc,
+	}
 }
 
 // patch is a expression with a forward reference to be resoled on pass 2
@@ -45,19 +89,44 @@ type patch struct {
 	statement  Statement
 	expr       Expr
 	offsetByte bool
+	code       []byte // code of the bank being written when the patch was added
 	pc         int
 	size       int // 1 = byte, 2 = word
 }
 
 func NewLinker(stmt Statement) *Linker {
+	main := newBankOutput(0)
 	return &Linker{
 		statements: stmt,
 		symbols:    NewSymbolTable(),
 		messages:   &Messages{},
-		code:       make([]byte, 65536),
+		code:       main.code,
+		used:       main.used,
+		banks:      map[int]*bankOutput{0: main},
+		stmtBank:   make(map[Statement]int),
 	}
 }
 
+// Build parses and links the program read by parser.  If either step fails,
+// the error holds its messages, and the linker is nil if parsing failed.
+func Build(parser *Parser) (*Linker, error) {
+	parser.Parse()
+	if parser.HasErrors() {
+		return nil, parser.messages.asError()
+	}
+	linker := NewLinker(parser.Statements())
+	linker.Link()
+	if linker.HasErrors() {
+		return linker, linker.messages.asError()
+	}
+	return linker, nil
+}
+
+// BuildSource builds a program from source, which is named name in messages.
+func BuildSource(name string, source string) (*Linker, error) {
+	return Build(NewParserFromReader(name, strings.NewReader(source)))
+}
+
 // Link uses two passes to try to resolve all references and generate code into l.code.
 func (l *Linker) Link() {
 	for stmt := l.statements; stmt != nil; stmt = stmt.Next() {
@@ -75,6 +144,14 @@ func (l *Linker) Link() {
 			// nothing to do
 		case *OrgStatement:
 			l.doOrg(t)
+		case *DeviceStatement:
+			l.doDevice(t)
+		case *BankStatement:
+			l.doBank(t)
+			stmt.SetPcStart(l.pc)
+		case *ProtectStatement:
+			// resolved after pass 1 so that labels later in the source can be used
+			l.protects = append(l.protects, t)
 		case *LabelStatement:
 			l.defineLabel(t, t.name)
 		case *FunctionStatement:
@@ -103,6 +180,12 @@ func (l *Linker) Link() {
 			panic("unknown statement type")
 		}
 		stmt.SetPcEnd(l.pc)
+		if l.bank != 0 {
+			l.stmtBank[stmt] = l.bank
+			if stmt.PcStart() < machine.BankWindowStart || stmt.PcEnd() > machine.BankWindowEnd+1 {
+				l.errorf(stmt, "bank %d code must be within 0x%04x-0x%04x", l.bank, machine.BankWindowStart, machine.BankWindowEnd)
+			}
+		}
 	}
 	for _, patch := range l.patches {
 		ival, _, res := patch.expr.computeValue(l.symbols)
@@ -111,9 +194,9 @@ func (l *Linker) Link() {
 				if patch.offsetByte {
 					ival = ival - patch.pc + 1
 				}
-				l.writeByteAt(ival, patch.pc)
+				writeByteAt(patch.code, ival, patch.pc)
 			} else if patch.size == 2 {
-				l.writeWordAt(ival, patch.pc)
+				writeWordAt(patch.code, ival, patch.pc)
 			} else {
 				panic("invalid patch size")
 			}
@@ -121,6 +204,9 @@ func (l *Linker) Link() {
 			l.errorf(patch.statement, "expression still unresolved after second pass")
 		}
 	}
+	for _, protect := range l.protects {
+		l.doProtect(protect)
+	}
 	//fmt.Printf("ast dump:\n")
 	//for stmt := l.statements; stmt != nil; stmt = stmt.Next() {
 	//	fmt.Printf("%v\n", stmt)
@@ -131,6 +217,7 @@ func (l *Linker) addPatch(stmt Statement, expr Expr, size int, offsetByte bool)
 	p := patch{
 		statement:  stmt,
 		expr:       expr,
+		code:       l.code,
 		pc:         l.pc,
 		size:       size,
 		offsetByte: offsetByte,
@@ -149,6 +236,7 @@ func (l *Linker) defineLabel(s Statement, name string) {
 	}
 	l.symbols.AddSymbol(s.File(), s.Line(), name)
 	l.symbols.Define(name, l.pc)
+	l.symbols.GetSymbol(name).label = true
 	if !strings.ContainsAny(name, ".") {
 		global = true
 	}
@@ -165,11 +253,15 @@ func (l *Linker) errorf(stmt Statement, format string, args ...interface{}) {
 
 func (l *Linker) writeByte(val int) {
 	l.code[l.pc] = byte(val)
+	l.used[l.pc] = true
 	l.pc++
 }
 
 func (l *Linker) writeBytes(val []byte) {
 	n := copy(l.code[l.pc:], val)
+	for i := 0; i < n; i++ {
+		l.used[l.pc+i] = true
+	}
 	l.pc += n
 	if n != len(val) {
 		panic("need to validate and report this as error in caller")
@@ -181,24 +273,27 @@ func (l *Linker) writeWord(val int) {
 	hi := byte(val >> 8)
 	l.code[l.pc] = lo
 	l.code[l.pc+1] = hi
+	l.used[l.pc] = true
+	l.used[l.pc+1] = true
 	l.pc += 2
 }
 
-func (l *Linker) writeByteAt(val, pc int) {
-	l.code[pc] = byte(val)
+func writeByteAt(code []byte, val, pc int) {
+	code[pc] = byte(val)
 }
 
-func (l *Linker) writeWordAt(val int, pc int) {
+func writeWordAt(code []byte, val int, pc int) {
 	lo := byte(val & 0xff)
 	hi := byte(val >> 8)
-	l.code[pc] = lo
-	l.code[pc+1] = hi
+	code[pc] = lo
+	code[pc+1] = hi
 }
 
 // recordDebugInfo records the current PC and source location
 func (l *Linker) recordDebugInfo(stmt Statement) {
 	l.debugInfo = append(l.debugInfo, DebugInfo{
 		PC:     uint16(l.pc),
+		Bank:   l.bank,
 		File:   stmt.File(),
 		Line:   stmt.Line(),
 		Column: 0, // Column tracking would require lexer changes
@@ -231,6 +326,77 @@ func (l *Linker) doOrg(org *OrgStatement) {
 	}
 }
 
+func (l *Linker) doDevice(stmt *DeviceStatement) {
+	for _, expr := range stmt.devices {
+		id, _, res := expr.computeValue(l.symbols)
+		if !res {
+			l.errorf(stmt, "device must have constant value")
+			continue
+		}
+		if id <= 0 || id > 0xffff {
+			l.errorf(stmt, "invalid device id 0x%x", id)
+			continue
+		}
+		found := false
+		for _, d := range l.devices {
+			found = found || d == uint16(id)
+		}
+		if !found {
+			l.devices = append(l.devices, uint16(id))
+		}
+	}
+}
+
+// doBank switches output to another bank.  Each bank keeps its own pc, so
+// switching back and forth continues where that bank left off.  Banks other
+// than main memory start at the bottom of the bank window.
+func (l *Linker) doBank(stmt *BankStatement) {
+	n, _, res := stmt.bank.computeValue(l.symbols)
+	if !res {
+		l.errorf(stmt, "bank must have constant value")
+		return
+	}
+	if n < 0 || n >= machine.MaxBanks {
+		l.errorf(stmt, "bank must be from 0 to %d, got %d", machine.MaxBanks-1, n)
+		return
+	}
+	l.banks[l.bank].pc = l.pc
+	l.bank = n
+	out := l.banks[n]
+	if out == nil {
+		out = newBankOutput(machine.BankWindowStart)
+		l.banks[n] = out
+	}
+	l.code = out.code
+	l.used = out.used
+	l.pc = out.pc
+}
+
+func (l *Linker) doProtect(stmt *ProtectStatement) {
+	start, _, res1 := stmt.start.computeValue(l.symbols)
+	end, _, res2 := stmt.end.computeValue(l.symbols)
+	if !res1 || !res2 {
+		l.errorf(stmt, "%s range must have constant values", stmt.operation)
+		return
+	}
+	if start < 0 || end > 65536 || start >= end {
+		l.errorf(stmt, "invalid %s range 0x%04x-0x%04x", stmt.operation, start, end)
+		return
+	}
+	p := machine.ProtectWrite
+	switch stmt.operation {
+	case TokNoexec:
+		p = machine.ProtectExec
+	case TokStack:
+		p = machine.ProtectStack
+	}
+	l.protection = append(l.protection, machine.Region{
+		Start:      uint16(start),
+		End:        uint16(end - 1),
+		Protection: p,
+	})
+}
+
 func (l *Linker) doDefineWord(dw *DefineWordStatement) {
 	for _, expr := range dw.values {
 		ival, bval, res := expr.computeValue(l.symbols)
@@ -314,11 +480,35 @@ func (l *Linker) doFunction(fn *FunctionStatement) {
 		l.symbols.AddFpSymbol(fn.file, fn.line, arg.id, arg.offset)
 		offset += arg.size
 	}
+	l.functions = append(l.functions, FunctionInfo{
+		Name:   fn.name,
+		Addr:   uint16(l.pc),
+		Bank:   l.bank,
+		File:   fn.file,
+		Line:   fn.line,
+		Args:   frameSlots(fn.name, fn.fpArgs),
+		Locals: frameSlots(fn.name, fn.fpLocals),
+	})
+	l.recordDebugInfo(fn)
 	opCode := machine.EncodeOp(machine.Sav, machine.ImmediateByte, machine.Implied)
 	l.writeByte(int(opCode))
 	l.writeByte(localSize)
 }
 
+// frameSlots returns the assigned offsets of params, without the function
+// name prefix on each name.
+func frameSlots(fnName string, params []*FpParam) []FrameSlot {
+	var slots []FrameSlot
+	for _, p := range params {
+		slots = append(slots, FrameSlot{
+			Name:   strings.TrimPrefix(p.id, fnName+"."),
+			Size:   p.size,
+			Offset: p.offset,
+		})
+	}
+	return slots
+}
+
 func (l *Linker) doTest(test *TestStatement) {
 	// Test functions are just like regular functions but without parameters
 	// Define the test function label
@@ -372,7 +562,7 @@ func (l *Linker) doEmit1Operand(ins *InstructionStatement) {
 		l.errorf(ins, "within functions, asm generates automatic SAV")
 		return
 	}
-	if op == machine.Pop && op1.mode == machine.Immediate {
+	if (op == machine.Pop || op == machine.Sav) && op1.mode == machine.Immediate {
 		op1.mode = machine.ImmediateByte
 	}
 
@@ -467,7 +657,12 @@ func (l *Linker) resolveWordOperand(ins *InstructionStatement, op *Operand) {
 }
 
 func (l *Linker) BytesFor(stmt Statement) []byte {
-	return l.code[stmt.PcStart():stmt.PcEnd()]
+	return l.codeFor(stmt)[stmt.PcStart():stmt.PcEnd()]
+}
+
+// codeFor returns the code buffer for the bank the statement was linked into.
+func (l *Linker) codeFor(stmt Statement) []byte {
+	return l.banks[l.stmtBank[stmt]].code
 }
 
 func (l *Linker) PrintMessages() {
@@ -478,14 +673,93 @@ func (l *Linker) HasErrors() bool {
 	return l.messages.errors > 0
 }
 
+// Code returns the image for main memory, up to the last byte written.  If any
+// banks were used the image is padded to 64k and the bank window contents of
+// banks 1..n follow, in order.
 func (l *Linker) Code() []byte {
-	return l.code[0 : l.pc+1]
+	main := l.banks[0]
+	pc := l.pc
+	if l.bank != 0 {
+		pc = main.pc
+	}
+	banks := 0
+	for n := range l.banks {
+		if n > banks {
+			banks = n
+		}
+	}
+	if banks == 0 {
+		return main.code[0 : pc+1]
+	}
+	image := make([]byte, len(main.code)+banks*machine.BankWindowSize)
+	copy(image, main.code)
+	for n := 1; n <= banks; n++ {
+		if out := l.banks[n]; out != nil {
+			offset := len(main.code) + (n-1)*machine.BankWindowSize
+			copy(image[offset:], out.code[machine.BankWindowStart:machine.BankWindowEnd+1])
+		}
+	}
+	return image
+}
+
+// Segments returns each contiguous run of bytes that was written, by bank
+// and then address.  Gaps left by org are not included.
+func (l *Linker) Segments() []machine.Segment {
+	var segments []machine.Segment
+	for n := 0; n < machine.MaxBanks; n++ {
+		out := l.banks[n]
+		if out == nil {
+			continue
+		}
+		for addr := 0; addr < len(out.used); addr++ {
+			if !out.used[addr] {
+				continue
+			}
+			end := addr
+			for end+1 < len(out.used) && out.used[end+1] {
+				end++
+			}
+			segments = append(segments, machine.Segment{
+				Addr: uint16(addr),
+				Bank: n,
+				Data: out.code[addr : end+1],
+			})
+			addr = end
+		}
+	}
+	return segments
+}
+
+// Image returns the executable image, with only the segments that were written.
+// The initial registers are read from the start of memory the same as for a raw
+// image, so existing programs that begin with 'dw main' behave the same.
+func (l *Linker) Image() *machine.Image {
+	img := machine.RawImage(l.Code())
+	img.Devices = l.devices
+	img.Segments = l.Segments()
+	img.Protection = l.protection
+	return img
+}
+
+// Devices returns the device ids declared with the device directive.
+func (l *Linker) Devices() []uint16 {
+	return l.devices
 }
 
 func (l *Linker) DebugInfo() []DebugInfo {
 	return l.debugInfo
 }
 
+// Functions returns the frame layout of each function, in source order.
+func (l *Linker) Functions() []FunctionInfo {
+	return l.functions
+}
+
+// Protection returns the regions declared with rom/noexec directives, in source order.
+func (l *Linker) Protection() []machine.Region {
+	return l.protection
+}
+
 func (l *Linker) Symbols() *SymbolTable {
 	return l.symbols
 }
@@ -18,6 +18,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/jsando/mpu/machine"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -127,3 +128,193 @@ mytest:	sea
 		assert.Equal(t, "mytest.s", info.File)
 	}
 }
+
+func TestProtectDirectives(t *testing.T) {
+	source := `
+		org 0x100
+start:	hlt
+table:	db 1, 2, 3, 4
+end:
+		rom start, end
+		noexec table, end
+		rom 0xff00, 0x10000
+		stack 0xf000, 0xff00
+`
+	parser := NewParserFromReader("test.s", strings.NewReader(source))
+	parser.Parse()
+	assert.False(t, parser.HasErrors())
+
+	linker := NewLinker(parser.Statements())
+	linker.Link()
+	if linker.HasErrors() {
+		linker.messages.Print()
+	}
+	assert.False(t, linker.HasErrors())
+	assert.Equal(t, []machine.Region{
+		{Start: 0x100, End: 0x104, Protection: machine.ProtectWrite},
+		{Start: 0x101, End: 0x104, Protection: machine.ProtectExec},
+		{Start: 0xff00, End: 0xffff, Protection: machine.ProtectWrite},
+		{Start: 0xf000, End: 0xfeff, Protection: machine.ProtectStack},
+	}, linker.Protection())
+}
+
+func TestProtectDirectiveErrors(t *testing.T) {
+	source := `
+		org 0x100
+start:	hlt
+		rom start, start
+		rom undefined, start
+`
+	parser := NewParserFromReader("test.s", strings.NewReader(source))
+	parser.Parse()
+	assert.False(t, parser.HasErrors())
+
+	linker := NewLinker(parser.Statements())
+	linker.Link()
+	assert.Equal(t, 2, linker.messages.errors)
+}
+
+func TestBankDirective(t *testing.T) {
+	source := `
+		dw main
+		org 0x100
+main:	jsr far
+		hlt
+		bank 2
+far:	cpy 0x200, #table
+		ret
+table:	dw main
+		bank 0
+after:	hlt
+`
+	parser := NewParserFromReader("test.s", strings.NewReader(source))
+	parser.Parse()
+	assert.False(t, parser.HasErrors())
+
+	linker := NewLinker(parser.Statements())
+	linker.Link()
+	if linker.HasErrors() {
+		linker.messages.Print()
+	}
+	assert.False(t, linker.HasErrors())
+
+	assert.Equal(t, 0x8000, linker.Symbols().GetSymbol("far").Value())
+	assert.Equal(t, 0x8006, linker.Symbols().GetSymbol("table").Value())
+	assert.Equal(t, 0x104, linker.Symbols().GetSymbol("after").Value())
+
+	code := linker.Code()
+	assert.Len(t, code, 65536+2*machine.BankWindowSize)
+	bank2 := code[65536+machine.BankWindowSize:]
+	assert.Equal(t, machine.EncodeOp(machine.Cpy, machine.Absolute, machine.Immediate), bank2[0])
+	// forward reference to table patched into bank 2, not main memory
+	assert.Equal(t, []byte{0x06, 0x80}, bank2[3:5])
+	assert.Equal(t, []byte{0x00, 0x01}, bank2[6:8])
+	assert.Equal(t, byte(0), code[0x8003])
+
+	for _, info := range linker.DebugInfo() {
+		if info.PC >= 0x8000 {
+			assert.Equal(t, 2, info.Bank)
+		} else {
+			assert.Equal(t, 0, info.Bank)
+		}
+	}
+}
+
+func TestBankOutsideWindow(t *testing.T) {
+	source := `
+		bank 1
+		org 0xc000
+		hlt
+`
+	_, err := BuildSource("test.s", source)
+	assert.Error(t, err)
+}
+
+func TestImageSegments(t *testing.T) {
+	source := `
+		dw main, 0xfff0
+		device 0x0100, 0x0100
+		org 0x100
+main:	hlt
+		org 0x200
+data:	db 1, 2
+		bank 1
+far:	db 3
+`
+	img := linkSource(t, source).Image()
+	assert.Equal(t, uint16(0x100), img.Entry)
+	assert.Equal(t, uint16(0xfff0), img.SP)
+	assert.Equal(t, []uint16{0x0100}, img.Devices)
+	assert.Equal(t, []machine.Segment{
+		{Addr: 0, Bank: 0, Data: []byte{0x00, 0x01, 0xf0, 0xff}},
+		{Addr: 0x100, Bank: 0, Data: []byte{machine.EncodeOp(machine.Hlt, machine.Implied, machine.Implied)}},
+		{Addr: 0x200, Bank: 0, Data: []byte{1, 2}},
+		{Addr: 0x8000, Bank: 1, Data: []byte{3}},
+	}, img.Segments)
+}
+
+func TestSavOutsideFunction(t *testing.T) {
+	// sav only has a byte immediate form, like pop
+	source := `
+		org 0x100
+start:	sav #4
+		pop #4
+		hlt
+inside():
+		sav #2
+		ret
+`
+	parser := NewParserFromReader("test.s", strings.NewReader(source))
+	parser.Parse()
+	assert.False(t, parser.HasErrors())
+
+	linker := NewLinker(parser.Statements())
+	linker.Link()
+	// declared functions get an automatic sav, so a hand-written one is an error
+	assert.Equal(t, 1, linker.messages.errors)
+
+	code := linker.Code()
+	assert.Equal(t, []byte{
+		machine.EncodeOp(machine.Sav, machine.ImmediateByte, machine.Implied), 4,
+		machine.EncodeOp(machine.Pop, machine.ImmediateByte, machine.Implied), 4,
+	}, code[0x100:0x104])
+}
+
+func TestDirectiveNamesAsSymbols(t *testing.T) {
+	// a name that became a directive can still be declared as a symbol
+	for _, tt := range []struct {
+		source string
+		symbol string
+		value  int
+	}{
+		{"rom:\thlt\n\t\tjmp rom", "rom", 0x100},
+		{"rom(value word):\n\t\tret", "rom", 0x100},
+		{"noexec = 5\n\t\tcpy 0x200, #noexec", "noexec", 5},
+		{"noexec:\thlt\n\t\tnoexec 0x200, 0x2ff", "noexec", 0x100},
+		{"bank:\tdb 1\n\t\tbank 1\n\t\tcpy bank, #2", "bank", 0x100},
+		{"bank = 0x0c\n\t\tcpy bank, #1", "bank", 0x0c},
+		{"device:\tdw 0x0100\n\t\tdevice 0x0100", "device", 0x100},
+		{"device(id word):\n\t\tret", "device", 0x100},
+		{"stack:\tdw 0\n\t\tstack 0xf000, 0xffff\n\t\tcpy stack, #1", "stack", 0x100},
+		{"stack = 0x0200\n\t\tcpy stack, #1", "stack", 0x200},
+	} {
+		linker, err := BuildSource("test.s", "\t\torg 0x100\n"+tt.source+"\n")
+		if !assert.NoError(t, err, tt.source) {
+			continue
+		}
+		assert.Equal(t, tt.value, linker.Symbols().GetSymbol(tt.symbol).Value(), tt.source)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	linker, err := BuildSource("test.s", "\t\tbogus 1\n")
+	assert.Nil(t, linker)
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "test.s:1:"), err.Error())
+		assert.True(t, strings.HasSuffix(err.Error(), "1 errors."), err.Error())
+	}
+
+	linker, err = BuildSource("test.s", "\t\tjmp nowhere\n")
+	assert.NotNil(t, linker)
+	assert.Error(t, err)
+}
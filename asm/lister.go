@@ -101,6 +101,7 @@ func getBytes(fileLine int, s Statement, l *Linker) ([]byte, Statement) {
 		if fileLine < s.Line() {
 			return buf, s // stick with s, not ready to print it yet
 		}
+		code := l.codeFor(s)
 		pcStart := s.PcStart()
 		pcEnd := s.PcEnd()
 
@@ -111,7 +112,7 @@ func getBytes(fileLine int, s Statement, l *Linker) ([]byte, Statement) {
 			s = s.Next()
 		}
 		if pcStart < pcEnd {
-			buf = l.code[pcStart:pcEnd]
+			buf = code[pcStart:pcEnd]
 		}
 	}
 	return buf, s
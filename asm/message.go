@@ -14,7 +14,14 @@
 
 package asm
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
 
 const (
 	MessageError   = iota
@@ -72,13 +79,25 @@ func (m *Messages) Info(file string, line int, column int, message string) {
 }
 
 func (m *Messages) Print() {
+	m.Fprint(os.Stdout)
+}
+
+// Fprint writes the messages and the warning and error counts to w.
+func (m *Messages) Fprint(w io.Writer) {
 	for _, msg := range m.messages {
-		fmt.Println(msg)
+		fmt.Fprintln(w, msg)
 	}
 	if m.warnings > 0 {
-		fmt.Printf("%d warnings.\n", m.warnings)
+		fmt.Fprintf(w, "%d warnings.\n", m.warnings)
 	}
 	if m.errors > 0 {
-		fmt.Printf("%d errors.\n", m.errors)
+		fmt.Fprintf(w, "%d errors.\n", m.errors)
 	}
 }
+
+// asError returns the messages as an error, as Fprint writes them.
+func (m *Messages) asError() error {
+	var buf bytes.Buffer
+	m.Fprint(&buf)
+	return errors.New(strings.TrimSpace(buf.String()))
+}
@@ -0,0 +1,465 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// ImageSymbol is a global label and the bytes it covers in an image.
+type ImageSymbol struct {
+	Name     string
+	Addr     uint16
+	Bank     int
+	Size     int  // up to the next global label or the end of the segment
+	Function bool // declared with a frame
+}
+
+// ImageSymbols returns the global labels in debug that fall within img's
+// segments, sorted by bank and address.
+func ImageSymbols(img *machine.Image, debug *DebugFile) []ImageSymbol {
+	var syms []ImageSymbol
+	if debug == nil {
+		return nil
+	}
+	for _, sym := range debug.Symbols {
+		if !sym.Label || sym.Local || sym.FP {
+			continue
+		}
+		s := ImageSymbol{Name: sym.Name, Addr: uint16(sym.Value), Bank: debug.symbolBank(sym)}
+		if segmentAt(img, s.Bank, s.Addr) == nil {
+			continue
+		}
+		for _, fn := range debug.Functions {
+			if fn.Name == s.Name {
+				s.Function = true
+			}
+		}
+		syms = append(syms, s)
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		if syms[i].Bank != syms[j].Bank {
+			return syms[i].Bank < syms[j].Bank
+		}
+		return syms[i].Addr < syms[j].Addr
+	})
+	for i := range syms {
+		s := &syms[i]
+		seg := segmentAt(img, s.Bank, s.Addr)
+		end := int(seg.Addr) + len(seg.Data)
+		if i+1 < len(syms) && syms[i+1].Bank == s.Bank && int(syms[i+1].Addr) < end {
+			end = int(syms[i+1].Addr)
+		}
+		s.Size = end - int(s.Addr)
+	}
+	return syms
+}
+
+// symbolBank returns the bank a label was defined in, from the first line
+// at or after the label's line that's at its address.  Symbols don't record
+// their bank, and labels usually share a line with the statement they name.
+func (d *DebugFile) symbolBank(sym DebugSymbol) int {
+	var best *DebugInfo
+	for i := range d.Lines {
+		info := &d.Lines[i]
+		if info.File == sym.File && info.Line >= sym.Line && int(info.PC) == sym.Value &&
+			(best == nil || info.Line < best.Line) {
+			best = info
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.Bank
+}
+
+// segmentAt returns the segment containing addr in bank, or nil.
+func segmentAt(img *machine.Image, bank int, addr uint16) *machine.Segment {
+	for i := range img.Segments {
+		seg := &img.Segments[i]
+		if seg.Bank == bank && addr >= seg.Addr && int(addr) < int(seg.Addr)+len(seg.Data) {
+			return seg
+		}
+	}
+	return nil
+}
+
+// imageBytes returns the n bytes at addr in bank, or nil if they aren't all
+// in one segment.
+func imageBytes(img *machine.Image, bank int, addr uint16, n int) []byte {
+	seg := segmentAt(img, bank, addr)
+	if seg == nil {
+		return nil
+	}
+	start := int(addr - seg.Addr)
+	if start+n > len(seg.Data) {
+		return nil
+	}
+	return seg.Data[start : start+n]
+}
+
+// Dump writes a description of img: its registers, devices, protected
+// regions and segments, the symbols and functions in debug if it isn't nil,
+// and if hex is true a hex dump of every segment annotated with labels.
+func Dump(w io.Writer, img *machine.Image, debug *DebugFile, hex bool) error {
+	bw := bufio.NewWriter(w)
+	syms := ImageSymbols(img, debug)
+
+	fmt.Fprintln(bw, "Registers:")
+	for _, r := range []struct {
+		name  string
+		addr  uint16
+		value uint16
+		def   uint16
+	}{
+		{"pc", machine.PCAddr, img.Entry, 0x100},
+		{"sp", machine.SPAddr, img.SP, 0xffff},
+		{"fp", machine.FPAddr, img.FP, 0},
+	} {
+		// sp and fp hold data addresses, so a nearby label would only mislead
+		label := ""
+		if r.addr == machine.PCAddr {
+			label = symbolize(debug, r.value)
+		}
+		fmt.Fprintf(bw, "  %s  0x%04x  %-20s %s\n", r.name, r.value, label, registerSource(img, r.addr, r.value, r.def))
+	}
+
+	if len(img.Devices) > 0 {
+		fmt.Fprintf(bw, "\nDevices: %s\n", formatIds(img.Devices))
+	}
+	if len(img.Protection) > 0 {
+		fmt.Fprintln(bw, "\nProtection:")
+		for _, r := range img.Protection {
+			fmt.Fprintf(bw, "  %s\n", r)
+		}
+	}
+
+	fmt.Fprintln(bw, "\nSegments:")
+	fmt.Fprintln(bw, "  bank  start   end     size")
+	for _, seg := range img.Segments {
+		fmt.Fprintf(bw, "  %4d  0x%04x  0x%04x  %d\n", seg.Bank, seg.Addr, int(seg.Addr)+len(seg.Data)-1, len(seg.Data))
+	}
+
+	if debug != nil {
+		writeSymbolTable(bw, debug, syms)
+		writeFunctions(bw, debug, syms)
+	}
+
+	if hex {
+		labels := make(map[[2]int][]string)
+		for _, s := range syms {
+			key := [2]int{s.Bank, int(s.Addr)}
+			labels[key] = append(labels[key], s.Name)
+		}
+		for _, seg := range img.Segments {
+			fmt.Fprintf(bw, "\nSegment bank %d 0x%04x-0x%04x:\n", seg.Bank, seg.Addr, int(seg.Addr)+len(seg.Data)-1)
+			writeHex(bw, seg, labels)
+		}
+	}
+	return bw.Flush()
+}
+
+// registerSource describes where a register's initial value comes from.
+// Raw images load registers from the first bytes of memory, or use the
+// default if the image is too short, while images with a header store them
+// separately from the bytes loaded at the same address.
+func registerSource(img *machine.Image, addr uint16, value, def uint16) string {
+	b := imageBytes(img, 0, addr, 2)
+	switch {
+	case b == nil && value == def:
+		return fmt.Sprintf("default, 0x%04x not loaded", addr)
+	case b == nil:
+		return fmt.Sprintf("header, 0x%04x not loaded", addr)
+	}
+	word := uint16(b[0]) | uint16(b[1])<<8
+	if word != value {
+		return fmt.Sprintf("header, but 0x%04x is loaded with 0x%04x", addr, word)
+	}
+	return fmt.Sprintf("loaded at 0x%04x", addr)
+}
+
+// symbolize returns addr as a label if debug has one near it.
+func symbolize(debug *DebugFile, addr uint16) string {
+	if debug == nil {
+		return ""
+	}
+	return debug.Symbolize(addr)
+}
+
+// writeSymbolTable writes every symbol except function parameters and
+// locals, which are listed with their function.
+func writeSymbolTable(w *bufio.Writer, debug *DebugFile, syms []ImageSymbol) {
+	sizes := make(map[string]int)
+	for _, s := range syms {
+		sizes[s.Name] = s.Size
+	}
+	list := make([]DebugSymbol, 0, len(debug.Symbols))
+	for _, sym := range debug.Symbols {
+		if !sym.FP {
+			list = append(list, sym)
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Label != list[j].Label {
+			return list[i].Label
+		}
+		return list[i].Value < list[j].Value
+	})
+	fmt.Fprintln(w, "\nSymbols:")
+	fmt.Fprintln(w, "  value   kind    size  name                     source")
+	for _, sym := range list {
+		kind, size := "equate", ""
+		switch {
+		case sym.Label && sym.Local:
+			kind = "local"
+		case sym.Label:
+			kind = "label"
+			if n, ok := sizes[sym.Name]; ok {
+				size = fmt.Sprint(n)
+			}
+		}
+		source := ""
+		if sym.File != "" {
+			source = fmt.Sprintf("%s:%d", sym.File, sym.Line)
+		}
+		fmt.Fprintf(w, "  0x%04x  %-6s  %4s  %-24s %s\n", uint16(sym.Value), kind, size, sym.Name, source)
+	}
+}
+
+// writeFunctions writes each function's address, size and frame.
+func writeFunctions(w *bufio.Writer, debug *DebugFile, syms []ImageSymbol) {
+	if len(debug.Functions) == 0 {
+		return
+	}
+	sizes := make(map[string]int)
+	for _, s := range syms {
+		sizes[s.Name] = s.Size
+	}
+	fmt.Fprintln(w, "\nFunctions:")
+	for _, fn := range debug.Functions {
+		bank := ""
+		if fn.Bank != 0 {
+			bank = fmt.Sprintf(" bank %d", fn.Bank)
+		}
+		fmt.Fprintf(w, "  0x%04x%s  %s  %d bytes\n", fn.Addr, bank, fn.Name, sizes[fn.Name])
+		for _, slot := range fn.Args {
+			fmt.Fprintf(w, "    arg    fp%+d  %s (%d bytes)\n", slot.Offset, slot.Name, slot.Size)
+		}
+		for _, slot := range fn.Locals {
+			fmt.Fprintf(w, "    local  fp%+d  %s (%d bytes)\n", slot.Offset, slot.Name, slot.Size)
+		}
+	}
+}
+
+// writeHex writes a segment 16 bytes per line, followed by the labels that
+// start on the line.  Repeated lines are written once followed by "*".
+func writeHex(w *bufio.Writer, seg machine.Segment, labels map[[2]int][]string) {
+	var prev []byte
+	skipping := false
+	for i := 0; i < len(seg.Data); i += 16 {
+		row := seg.Data[i:min(i+16, len(seg.Data))]
+		addr := int(seg.Addr) + i
+		var notes []string
+		for j := range row {
+			for _, name := range labels[[2]int{seg.Bank, addr + j}] {
+				if j == 0 {
+					notes = append(notes, name)
+				} else {
+					notes = append(notes, fmt.Sprintf("%s@+%d", name, j))
+				}
+			}
+		}
+		if seg.Bank == 0 && addr == 0 {
+			notes = append([]string{"pc sp fp"}, notes...)
+		}
+		if len(notes) == 0 && prev != nil && bytes.Equal(row, prev) {
+			if !skipping {
+				fmt.Fprintln(w, "  *")
+				skipping = true
+			}
+			continue
+		}
+		prev, skipping = row, false
+		var hex, text strings.Builder
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			if j >= len(row) {
+				hex.WriteString("   ")
+				continue
+			}
+			fmt.Fprintf(&hex, " %02x", row[j])
+			if row[j] >= ' ' && row[j] <= '~' {
+				text.WriteByte(row[j])
+			} else {
+				text.WriteByte('.')
+			}
+		}
+		line := fmt.Sprintf("  %04x %s  |%-16s|", addr, hex.String(), text.String())
+		if len(notes) > 0 {
+			line += "  " + strings.Join(notes, ", ")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// DiffImages writes how newImg differs from oldImg: the registers, devices,
+// protected regions and segments, then each global label that was added,
+// removed, moved, resized or whose bytes changed.  Labels are only compared
+// if both debug files are present.  Returns true if the images differ.
+func DiffImages(w io.Writer, oldImg, newImg *machine.Image, oldDebug, newDebug *DebugFile) (bool, error) {
+	bw := bufio.NewWriter(w)
+	changed := false
+	report := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format+"\n", args...)
+		changed = true
+	}
+
+	for _, r := range []struct {
+		name     string
+		old, new uint16
+	}{{"pc", oldImg.Entry, newImg.Entry}, {"sp", oldImg.SP, newImg.SP}, {"fp", oldImg.FP, newImg.FP}} {
+		if r.old != r.new {
+			report("register %s: 0x%04x -> 0x%04x", r.name, r.old, r.new)
+		}
+	}
+	if fmt.Sprint(oldImg.Devices) != fmt.Sprint(newImg.Devices) {
+		report("devices: %s -> %s", formatIds(oldImg.Devices), formatIds(newImg.Devices))
+	}
+	if fmt.Sprint(oldImg.Protection) != fmt.Sprint(newImg.Protection) {
+		report("protection: %v -> %v", oldImg.Protection, newImg.Protection)
+	}
+
+	type segKey struct {
+		bank int
+		addr uint16
+	}
+	oldSegs := make(map[segKey]machine.Segment)
+	for _, seg := range oldImg.Segments {
+		oldSegs[segKey{seg.Bank, seg.Addr}] = seg
+	}
+	newSegs := make(map[segKey]bool)
+	for _, seg := range newImg.Segments {
+		key := segKey{seg.Bank, seg.Addr}
+		newSegs[key] = true
+		old, ok := oldSegs[key]
+		switch {
+		case !ok:
+			report("segment bank %d 0x%04x: added, %d bytes", seg.Bank, seg.Addr, len(seg.Data))
+		case len(old.Data) != len(seg.Data):
+			report("segment bank %d 0x%04x: %d -> %d bytes (%+d)", seg.Bank, seg.Addr, len(old.Data), len(seg.Data), len(seg.Data)-len(old.Data))
+		case !bytes.Equal(old.Data, seg.Data):
+			n := countDiffs(old.Data, seg.Data)
+			report("segment bank %d 0x%04x: %d %s changed", seg.Bank, seg.Addr, n, plural(n, "byte"))
+		}
+	}
+	for _, seg := range oldImg.Segments {
+		if !newSegs[segKey{seg.Bank, seg.Addr}] {
+			report("segment bank %d 0x%04x: removed, %d bytes", seg.Bank, seg.Addr, len(seg.Data))
+		}
+	}
+
+	if oldDebug == nil || newDebug == nil {
+		if changed {
+			fmt.Fprintln(bw, "symbols not compared, a debug file is missing")
+		}
+		return changed, bw.Flush()
+	}
+	oldSyms := make(map[string]ImageSymbol)
+	for _, s := range ImageSymbols(oldImg, oldDebug) {
+		oldSyms[s.Name] = s
+	}
+	newSyms := ImageSymbols(newImg, newDebug)
+	seen := make(map[string]bool)
+	for _, s := range newSyms {
+		seen[s.Name] = true
+		old, ok := oldSyms[s.Name]
+		if !ok {
+			report("%s: added at %s, %d bytes", symbolKind(s), formatAddr(s.Bank, s.Addr), s.Size)
+			continue
+		}
+		var notes []string
+		if old.Bank != s.Bank || old.Addr != s.Addr {
+			notes = append(notes, fmt.Sprintf("moved %s -> %s", formatAddr(old.Bank, old.Addr), formatAddr(s.Bank, s.Addr)))
+		}
+		if old.Size != s.Size {
+			notes = append(notes, fmt.Sprintf("size %d -> %d (%+d)", old.Size, s.Size, s.Size-old.Size))
+		} else if !bytes.Equal(imageBytes(oldImg, old.Bank, old.Addr, old.Size), imageBytes(newImg, s.Bank, s.Addr, s.Size)) {
+			notes = append(notes, "contents changed")
+		}
+		if len(notes) > 0 {
+			report("%s: %s", symbolKind(s), strings.Join(notes, ", "))
+		}
+	}
+	for _, s := range ImageSymbols(oldImg, oldDebug) {
+		if !seen[s.Name] {
+			report("%s: removed from %s, %d bytes", symbolKind(s), formatAddr(s.Bank, s.Addr), s.Size)
+		}
+	}
+	return changed, bw.Flush()
+}
+
+// symbolKind returns the symbol's name, with "()" for functions.
+func symbolKind(s ImageSymbol) string {
+	if s.Function {
+		return s.Name + "()"
+	}
+	return s.Name
+}
+
+// formatAddr returns addr, with its bank if it isn't main memory.
+func formatAddr(bank int, addr uint16) string {
+	if bank != 0 {
+		return fmt.Sprintf("0x%04x (bank %d)", addr, bank)
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
+
+// formatIds returns device ids as a list of hex numbers.
+func formatIds(ids []uint16) string {
+	var list []string
+	for _, id := range ids {
+		list = append(list, fmt.Sprintf("0x%04x", id))
+	}
+	return "[" + strings.Join(list, ", ") + "]"
+}
+
+// countDiffs returns the number of positions where a and b, which are the
+// same length, differ.
+func countDiffs(a, b []byte) int {
+	n := 0
+	for i := range a {
+		if a[i] != b[i] {
+			n++
+		}
+	}
+	return n
+}
+
+// plural returns word with an "s" unless n is 1.
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
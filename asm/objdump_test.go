@@ -0,0 +1,124 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageSymbols(t *testing.T) {
+	linker := linkSource(t, disasmSource)
+	syms := ImageSymbols(linker.Image(), linker.DebugFile())
+	assert.Equal(t, []ImageSymbol{
+		{Name: "main", Addr: 0x100, Size: 22, Function: true},
+		{Name: "print", Addr: 0x116, Size: 7, Function: true},
+		{Name: "message", Addr: 0x11d, Size: 15},
+		{Name: "table", Addr: 0x12c, Size: 6},
+		{Name: "buffer", Addr: 0x132, Size: 32},
+		{Name: "far", Addr: 0x8000, Bank: 1, Size: 6},
+	}, syms)
+}
+
+func TestDump(t *testing.T) {
+	linker := linkSource(t, disasmSource)
+	var out bytes.Buffer
+	assert.NoError(t, Dump(&out, linker.Image(), linker.DebugFile(), true))
+	text := out.String()
+	assert.Contains(t, text, "  pc  0x0100  main                 loaded at 0x0000\n")
+	assert.Contains(t, text, "  sp  0xfff0                       loaded at 0x0002\n")
+	assert.Contains(t, text, "  fp  0x0000                       default, 0x0004 not loaded\n")
+	assert.Contains(t, text, "Devices: [0x0300]\n")
+	assert.Contains(t, text, "  0x0100-0x017f r-x\n")
+	assert.Contains(t, text, "     1  0x8000  0x8005  6\n")
+	assert.Contains(t, text, "  0x0106  local         main.loop ")
+	assert.Contains(t, text, "  0x0116  print  7 bytes\n    arg    fp+4  text (2 bytes)\n")
+	assert.Contains(t, text, "  0100  ba 02 67 fe 0a 00 f0 1d  01 eb 16 01 f1 02 d3 fe  |..g.............|  main\n")
+	assert.Contains(t, text, "|lo, world!......|  table@+12\n")
+
+	out.Reset()
+	assert.NoError(t, Dump(&out, linker.Image(), nil, false))
+	assert.NotContains(t, out.String(), "Symbols:")
+	assert.NotContains(t, out.String(), "Segment bank")
+}
+
+func TestDumpRegisterSources(t *testing.T) {
+	img := &machine.Image{
+		Entry:    0x200,
+		SP:       0xffff,
+		FP:       0x1234,
+		Segments: []machine.Segment{{Addr: 0, Data: []byte{0x00, 0x01}}},
+	}
+	var out bytes.Buffer
+	assert.NoError(t, Dump(&out, img, nil, false))
+	assert.Contains(t, out.String(), "header, but 0x0000 is loaded with 0x0100")
+	assert.Contains(t, out.String(), "default, 0x0002 not loaded")
+	assert.Contains(t, out.String(), "header, 0x0004 not loaded")
+}
+
+func TestDumpRepeatedRows(t *testing.T) {
+	img := &machine.Image{Segments: []machine.Segment{{Addr: 0x100, Data: make([]byte, 64)}}}
+	var out bytes.Buffer
+	assert.NoError(t, Dump(&out, img, nil, true))
+	assert.Contains(t, out.String(), "  0100  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|\n  *\n")
+	assert.NotContains(t, out.String(), "  0110 ")
+}
+
+func TestDiffImages(t *testing.T) {
+	oldLinker := linkSource(t, disasmSource)
+	source := strings.Replace(disasmSource, "cpy 0x300, text", "cpy 0x300, text\n\t\tcpy 0x300, text", 1)
+	source = strings.Replace(source, "ds 32", "ds 16", 1)
+	newLinker := linkSource(t, source)
+
+	var out bytes.Buffer
+	changed, err := DiffImages(&out, oldLinker.Image(), newLinker.Image(), oldLinker.DebugFile(), newLinker.DebugFile())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, `segment bank 0 0x0100: 82 -> 70 bytes (-12)
+segment bank 1 0x8000: 1 byte changed
+main(): contents changed
+print(): size 7 -> 11 (+4)
+message: moved 0x011d -> 0x0121
+table: moved 0x012c -> 0x0130
+buffer: moved 0x0132 -> 0x0136, size 32 -> 16 (-16)
+far: contents changed
+`, out.String())
+
+	out.Reset()
+	changed, err = DiffImages(&out, oldLinker.Image(), oldLinker.Image(), oldLinker.DebugFile(), oldLinker.DebugFile())
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Empty(t, out.String())
+
+	out.Reset()
+	changed, _ = DiffImages(&out, oldLinker.Image(), newLinker.Image(), oldLinker.DebugFile(), nil)
+	assert.True(t, changed)
+	assert.Contains(t, out.String(), "symbols not compared, a debug file is missing\n")
+}
+
+func TestDiffImagesAddedAndRemoved(t *testing.T) {
+	oldLinker := linkSource(t, disasmSource)
+	source := strings.Replace(disasmSource, "buffer:\tds 32", "scratch:\tds 32", 1)
+	newLinker := linkSource(t, source)
+	var out bytes.Buffer
+	changed, err := DiffImages(&out, oldLinker.Image(), newLinker.Image(), oldLinker.DebugFile(), newLinker.DebugFile())
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "scratch: added at 0x0132, 32 bytes\nbuffer: removed from 0x0132, 32 bytes\n", out.String())
+}
@@ -214,6 +214,18 @@ loop:
 				p.parseOrg()
 			case TokVar:
 				p.parseVar()
+			case TokRom, TokNoexec, TokStack:
+				if !p.parseKeywordSymbol() {
+					p.parseProtect(tok)
+				}
+			case TokBank:
+				if !p.parseKeywordSymbol() {
+					p.parseBank()
+				}
+			case TokDevice:
+				if !p.parseKeywordSymbol() {
+					p.parseDevice()
+				}
 			case TokSea:
 				p.parseInstruction(tok)
 			default:
@@ -259,11 +271,31 @@ func (p *Parser) parseIncludes() {
 }
 
 func (p *Parser) parseGlobalSymbol() {
-	p.function = nil
 	text := p.lexer.TokenText()
 	// Save line number before advancing lexer
 	line := p.lexer.Line()
+	p.parseGlobalSymbolNamed(text, line, p.lexer.Next())
+}
+
+// parseKeywordSymbol looks past a directive keyword for the ':', '(' or '='
+// of a label, function or equate with the same name, which was valid before
+// the directive existed, and parses it if there is one.  Otherwise it
+// returns false with the lexer on the directive's first argument.
+func (p *Parser) parseKeywordSymbol() bool {
+	text := p.lexer.TokenText()
+	line := p.lexer.Line()
 	tok := p.lexer.Next()
+	if tok != TokColon && tok != TokLeftParen && tok != TokEquals {
+		return false
+	}
+	p.parseGlobalSymbolNamed(text, line, tok)
+	return true
+}
+
+// parseGlobalSymbolNamed parses the rest of a global symbol after its name,
+// with tok the token following it.
+func (p *Parser) parseGlobalSymbolNamed(text string, line int, tok TokenType) {
+	p.function = nil
 	if tok == TokEquals {
 		p.global = ""
 		stmt := &EquateStatement{
@@ -445,6 +477,43 @@ func (p *Parser) parseOrg() {
 	stmt.origin = p.parseExpr()
 }
 
+func (p *Parser) parseDevice() {
+	stmt := &DeviceStatement{}
+	p.addStatement(stmt)
+	stmt.devices = p.parseExpressionList()
+	if len(stmt.devices) == 0 {
+		p.errorf("device requires one or more device ids")
+		p.skipToEOL()
+	}
+}
+
+func (p *Parser) parseBank() {
+	stmt := &BankStatement{}
+	p.addStatement(stmt)
+	stmt.bank = p.parseExpr()
+	if stmt.bank == nil {
+		p.errorf("bank requires a bank number")
+		p.skipToEOL()
+	}
+}
+
+func (p *Parser) parseProtect(tok TokenType) {
+	stmt := &ProtectStatement{operation: tok}
+	p.addStatement(stmt)
+	stmt.start = p.parseExpr()
+	if p.lexer.Token() != TokComma {
+		p.errorf("%s requires start and end address, ie '%s start, end'", tok, tok)
+		p.skipToEOL()
+		return
+	}
+	p.lexer.Next()
+	stmt.end = p.parseExpr()
+	if stmt.start == nil || stmt.end == nil {
+		p.errorf("%s requires start and end address, ie '%s start, end'", tok, tok)
+		p.skipToEOL()
+	}
+}
+
 func (p *Parser) parseVar() {
 	if p.function == nil {
 		p.errorf("var is only valid within function but none is in scope")
@@ -88,6 +88,20 @@ func (p *Printer) Print(stmt Statement) {
 			p.tab(OpColumn)
 			p.print("org ")
 			p.expr(t.origin)
+		case *DeviceStatement:
+			p.tab(OpColumn)
+			p.print("device ")
+			p.exprList(t.devices)
+		case *BankStatement:
+			p.tab(OpColumn)
+			p.print("bank ")
+			p.expr(t.bank)
+		case *ProtectStatement:
+			p.tab(OpColumn)
+			p.printf("%s ", t.operation)
+			p.expr(t.start)
+			p.print(", ")
+			p.expr(t.end)
 		case *LabelStatement:
 			next := stmt.Next()
 			_, ok := next.(*InstructionStatement)
@@ -112,6 +112,29 @@ type (
 		name string
 		size int
 	}
+
+	// ProtectStatement marks the address range [start, end) as read-only (rom),
+	// no-execute (noexec) or the stack bounds (stack) when the program is loaded.
+	ProtectStatement struct {
+		Node
+		operation TokenType // TokRom, TokNoexec or TokStack
+		start     Expr
+		end       Expr
+	}
+
+	// BankStatement directs the following code and data into a bank of
+	// extended memory, or back to main memory for bank 0.
+	BankStatement struct {
+		Node
+		bank Expr
+	}
+
+	// DeviceStatement declares the devices a program requires, which are
+	// recorded in the image header and checked when it's loaded.
+	DeviceStatement struct {
+		Node
+		devices []Expr
+	}
 )
 
 func (n *Node) String() string {
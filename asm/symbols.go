@@ -14,6 +14,11 @@
 
 package asm
 
+import (
+	"sort"
+	"strings"
+)
+
 type SymbolTable struct {
 	symbols map[string]*Symbol
 }
@@ -29,16 +34,63 @@ type Symbol struct {
 	value   int
 	defined bool
 	fp      bool
+	label   bool
 }
 
 func (s *Symbol) Value() int {
 	return s.value
 }
 
+// Name returns the symbol name.  Local labels and function params/locals
+// are qualified with their global label, ie "main.loop".
+func (s *Symbol) Name() string {
+	return s.text
+}
+
+func (s *Symbol) File() string {
+	return s.file
+}
+
+func (s *Symbol) Line() int {
+	return s.line
+}
+
+func (s *Symbol) Defined() bool {
+	return s.defined
+}
+
+// IsFramePointer returns true for function params and locals, whose value is
+// an offset from fp rather than an address.
+func (s *Symbol) IsFramePointer() bool {
+	return s.fp
+}
+
+// IsLabel returns true for labels, as opposed to equates.
+func (s *Symbol) IsLabel() bool {
+	return s.label
+}
+
+// IsLocal returns true for symbols scoped to a global label.
+func (s *Symbol) IsLocal() bool {
+	return strings.Contains(s.text, ".")
+}
+
 func (s *SymbolTable) GetSymbol(text string) *Symbol {
 	return s.symbols[text]
 }
 
+// Symbols returns all symbols sorted by name.
+func (s *SymbolTable) Symbols() []*Symbol {
+	symbols := make([]*Symbol, 0, len(s.symbols))
+	for _, sym := range s.symbols {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool {
+		return symbols[i].text < symbols[j].text
+	})
+	return symbols
+}
+
 func (s *SymbolTable) AddSymbol(file string, line int, text string) {
 	symbol := &Symbol{
 		text:  text,
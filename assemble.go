@@ -0,0 +1,79 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+)
+
+// assemble handles "a [address [instruction]]".  With an instruction it's
+// written at address, otherwise the lines that follow are assembled one after
+// another until an empty line.  The address defaults to the implied address.
+func (m *Monitor) assemble(cmd []string, line string) {
+	addr := m.next
+	if len(cmd) > 1 {
+		var err error
+		if addr, err = m.address(cmd[1]); err != nil {
+			m.errorf("invalid addr (%s)\n", err)
+			return
+		}
+	}
+	m.asmAddr = addr
+	if len(cmd) > 2 {
+		// the instruction as typed, since splitting on spaces would lose
+		// the spacing in char and string literals
+		rest := strings.TrimSpace(strings.TrimPrefix(line, cmd[0]))
+		m.assembleLine(strings.TrimSpace(strings.TrimPrefix(rest, cmd[1])))
+		return
+	}
+	m.assembling = true
+}
+
+// assembleLine assembles one line at m.asmAddr and advances past it, or
+// stops assembling if the line is empty.
+func (m *Monitor) assembleLine(line string) {
+	if line == "" {
+		m.assembling = false
+		return
+	}
+	code, err := asm.Assemble(line, uint16(m.asmAddr), m.debug)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	addr := m.asmAddr
+	for i, b := range code {
+		m.memory.PutByte(uint16(addr+i), b)
+	}
+	if op := strings.ToLower(strings.Fields(line)[0]); op == "db" || op == "dw" {
+		fmt.Fprintf(m.out, "0x%04x  wrote %d bytes\n", addr, len(code))
+	} else {
+		text, _ := m.instructionLine(addr)
+		fmt.Fprintf(m.out, "%s\n", text)
+	}
+	m.asmAddr += len(code)
+	m.next = m.asmAddr
+}
+
+// prompt returns the prompt for the next line, the address when assembling.
+func (m *Monitor) prompt() string {
+	if m.assembling {
+		return fmt.Sprintf("0x%04x: ", m.asmAddr)
+	}
+	return "> "
+}
@@ -0,0 +1,192 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// breakpoint handles "break [addr [if condition]]", listing the breakpoints
+// if no address is given.
+func (m *Monitor) breakpoint(cmd []string) {
+	if len(cmd) < 2 {
+		m.ListBreakpoints(m.out)
+		return
+	}
+	addr, err := m.address(cmd[1])
+	if err != nil {
+		m.errorf("invalid addr (%s)\n", err)
+		return
+	}
+	var cond machine.Condition
+	var text string
+	if len(cmd) > 2 {
+		if cmd[2] != "if" || len(cmd) < 4 {
+			m.errorf("expected: break addr [if condition]\n")
+			return
+		}
+		text = strings.Join(cmd[3:], " ")
+		cond, err = m.parseCondition(text)
+		if err != nil {
+			m.errorf("invalid condition (%s)\n", err)
+			return
+		}
+	}
+	id := m.machine.SetBreakpoint(uint16(addr), cond, text)
+	fmt.Fprintf(m.out, "breakpoint %d at %s\n", id, m.formatAddr(addr))
+}
+
+// watch handles "watch addr [r|w|rw]", listing the watchpoints if no
+// address is given.
+func (m *Monitor) watch(cmd []string) {
+	if len(cmd) < 2 {
+		m.ListBreakpoints(m.out)
+		return
+	}
+	addr, err := m.address(cmd[1])
+	if err != nil {
+		m.errorf("invalid addr (%s)\n", err)
+		return
+	}
+	mode := machine.WatchWrite
+	if len(cmd) > 2 {
+		switch cmd[2] {
+		case "r":
+			mode = machine.WatchRead
+		case "w":
+			mode = machine.WatchWrite
+		case "rw":
+			mode = machine.WatchReadWrite
+		default:
+			m.errorf("invalid watch mode (%s), expected r, w or rw\n", cmd[2])
+			return
+		}
+	}
+	id := m.machine.SetWatchpoint(uint16(addr), mode)
+	fmt.Fprintf(m.out, "watchpoint %d on %s [%s]\n", id, m.formatAddr(addr), mode)
+}
+
+// deleteBreakpoint handles "delete [id]", deleting all breakpoints and
+// watchpoints if no id is given.
+func (m *Monitor) deleteBreakpoint(cmd []string) {
+	if len(cmd) < 2 {
+		m.machine.ClearBreakpoints()
+		fmt.Fprintf(m.out, "deleted all breakpoints\n")
+		return
+	}
+	id, err := m.address(cmd[1])
+	if err != nil {
+		m.errorf("invalid id (%s)\n", err)
+		return
+	}
+	if !m.machine.DeleteBreakpoint(id) {
+		m.errorf("no breakpoint %d\n", id)
+	}
+}
+
+// ListBreakpoints prints the breakpoints and watchpoints.
+func (m *Monitor) ListBreakpoints(w io.Writer) {
+	breakpoints := m.machine.Breakpoints()
+	watchpoints := m.machine.Watchpoints()
+	if len(breakpoints) == 0 && len(watchpoints) == 0 {
+		fmt.Fprintf(w, "no breakpoints\n")
+		return
+	}
+	for _, bp := range breakpoints {
+		fmt.Fprintf(w, "%d  break %s", bp.ID, m.formatAddr(int(bp.Addr)))
+		if bp.Text != "" {
+			fmt.Fprintf(w, " if %s", bp.Text)
+		}
+		fmt.Fprintf(w, "  (hits %d)\n", bp.Hits)
+	}
+	for _, wp := range watchpoints {
+		fmt.Fprintf(w, "%d  watch %s %s  (hits %d)\n", wp.ID, m.formatAddr(int(wp.Addr)), wp.Mode, wp.Hits)
+	}
+}
+
+// printStop shows why the last run stopped, if a breakpoint or watchpoint
+// stopped it, followed by the next instruction.
+func (m *Monitor) printStop() {
+	stop := m.machine.Stopped()
+	if stop == nil {
+		return
+	}
+	fmt.Fprintf(m.out, "stopped: %s\n", stop)
+	m.List(m.out, int(m.machine.Flags().PC), 1)
+}
+
+// address evaluates an expression, see parseExpr, as a 16 bit address.
+func (m *Monitor) address(s string) (int, error) {
+	v, err := m.parseExpr(s)
+	if err != nil {
+		return 0, err
+	}
+	return v(m.machine) & 0xffff, nil
+}
+
+// addressRange parses "start-end", splitting at the first '-' so only end
+// can be an expression with subtraction.
+func (m *Monitor) addressRange(s string) (start, end int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("range must be start-end, not '%s'", s)
+	}
+	if start, err = m.address(parts[0]); err != nil {
+		return 0, 0, err
+	}
+	if end, err = m.address(parts[1]); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// symbol returns the value of a symbol from the debug info.  A local label
+// can be given without its global prefix if it's unambiguous.
+func (m *Monitor) symbol(s string) (int, error) {
+	if m.debug == nil {
+		return 0, fmt.Errorf("'%s' is not a number and no symbols are loaded", s)
+	}
+	found := -1
+	for _, sym := range m.debug.Symbols {
+		if sym.FP {
+			continue
+		}
+		if sym.Name == s {
+			return sym.Value, nil
+		}
+		if strings.HasSuffix(sym.Name, "."+s) {
+			if found >= 0 {
+				return 0, fmt.Errorf("'%s' is ambiguous", s)
+			}
+			found = sym.Value
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("unknown symbol '%s'", s)
+	}
+	return found, nil
+}
+
+// formatAddr formats addr in hex, followed by its label if it has one.
+func (m *Monitor) formatAddr(addr int) string {
+	if label := m.label(addr); label != "" {
+		return fmt.Sprintf("0x%04x (%s)", addr, label)
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const breakSource = `
+		dw main
+		org 0x100
+main:	cpy count, #1
+		cpy count, #2
+		hlt
+count:	dw 0
+`
+
+// sourceMonitor returns a monitor for the program assembled from source,
+// with its debug info loaded.
+func sourceMonitor(t *testing.T, source string) (*Monitor, *bytes.Buffer) {
+	linker, err := asm.BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mach, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.NoError(t, err)
+	var out bytes.Buffer
+	m := newMonitor(mach, linker.DebugFile())
+	m.out = &out
+	return m, &out
+}
+
+func TestBreakThenRun(t *testing.T) {
+	m, out := sourceMonitor(t, breakSource)
+	ok := m.Run(strings.NewReader("break main\nrun main\nassert w[count] == 0\ncont\nassert w[count] == 2\n"), false)
+	assert.True(t, ok, out.String())
+	assert.Contains(t, out.String(), "stopped: breakpoint 1 at 0x0100\n")
+}
+
+func TestBreakThenContinueFromEntry(t *testing.T) {
+	m, out := sourceMonitor(t, breakSource)
+	ok := m.Run(strings.NewReader("break main\ncont\nassert pc == main\nassert w[count] == 0\ncont\nassert w[count] == 2\n"), false)
+	assert.True(t, ok, out.String())
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/jsando/mpu/test"
+)
+
+// writeCoverProfile writes the coverage from mpu test for mpu cover.
+func writeCoverProfile(name string, coverage *test.Coverage) {
+	f, err := os.Create(name)
+	if err == nil {
+		err = coverage.WriteProfile(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write coverage profile '%s': %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// showCoverage writes the source annotated with a coverage profile to
+// stdout, or as HTML to htmlName.
+func showCoverage(name string, htmlName string) {
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	coverage, err := test.ReadCoverProfile(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s: %s\n", name, err)
+		os.Exit(1)
+	}
+	sources := test.NewSourceReader()
+	if htmlName == "" {
+		w := bufio.NewWriter(os.Stdout)
+		err = coverage.WriteAnnotated(w, sources)
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	} else {
+		var out *os.File
+		if out, err = os.Create(htmlName); err == nil {
+			err = coverage.WriteHTML(out, sources)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
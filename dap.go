@@ -0,0 +1,69 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/dap"
+	"github.com/jsando/mpu/machine"
+)
+
+// debugAdapter serves the debug adapter protocol on stdin/stdout.
+func debugAdapter() {
+	if err := dap.NewServer(loadProgram).Serve(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// loadProgram loads a .s file, or a binary and its debug file, for the debug
+// adapter.  Unlike run it returns errors rather than exiting, and assembler
+// messages are part of the error since stdout belongs to the client.
+func loadProgram(name string, stdout io.Writer) (*machine.Machine, *asm.DebugFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	setBaseDirFromInputFile(name)
+	var img *machine.Image
+	var debug *asm.DebugFile
+	if filepath.Ext(name) == ".s" {
+		linker, err := asm.Build(asm.NewParser(newTokenReader([]*os.File{f})))
+		if err != nil {
+			return nil, nil, err
+		}
+		img = linker.Image()
+		debug = linker.DebugFile()
+	} else {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		img, err = machine.LoadImageFile(name, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		debug = loadDebugFile(asm.DebugFileName(name))
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcherWithStdout(stdout), img)
+	return m, debug, err
+}
@@ -0,0 +1,730 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dap implements a Debug Adapter Protocol server, so MPU programs can
+// be debugged at the source level from editors such as VS Code.
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// pollInterval is how many instructions run between checks for requests,
+// such as pause, while the program is running.
+const pollInterval = 1000
+
+// threadID is the id of the one thread reported to the client.
+const threadID = 1
+
+// Variable scopes, see variablesReference.
+const (
+	scopeRegisters = iota
+	scopeFlags
+	scopeArgs
+	scopeLocals
+	scopeCount
+)
+
+// Loader loads the program named by a launch request, with the program's
+// stdout device writing to stdout.  The debug file may be nil, in which case
+// breakpoints can't be set and stack traces have no source locations.
+type Loader func(program string, stdout io.Writer) (*machine.Machine, *asm.DebugFile, error)
+
+// Execution modes for run.
+type runMode int
+
+const (
+	runContinue    runMode = iota
+	runNext                // to the next line, stepping over calls
+	runStepIn              // to the next line, stepping into calls
+	runStepOut             // until the current function returns
+	runInstruction         // one instruction
+)
+
+// Server is a debug adapter for one debug session.
+type Server struct {
+	load        Loader
+	out         io.Writer
+	seq         int
+	requests    chan *request
+	errs        chan error       // error that ended the reader
+	machine     *machine.Machine // nil until launched
+	debug       *asm.DebugFile
+	stopOnEntry bool
+	running     bool
+	paused      bool // a pause request arrived while running
+	done        bool // disconnect arrived while running
+	exited      bool
+	exitCode    int
+	lastID      int
+	breakpoints map[uint16]int      // breakpoint ids, by address
+	sources     map[string][]uint16 // breakpoint addresses, by source path
+	frames      []asm.Frame         // stack at the last stop
+}
+
+// NewServer creates a debug adapter that uses load for launch requests.
+func NewServer(load Loader) *Server {
+	return &Server{
+		load:        load,
+		breakpoints: make(map[uint16]int),
+		sources:     make(map[string][]uint16),
+	}
+}
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// Body types, for the parts of the protocol that are used.
+
+type source struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type breakpoint struct {
+	ID       int     `json:"id,omitempty"`
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line,omitempty"`
+	Source   *source `json:"source,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+type stackFrame struct {
+	ID                          int     `json:"id"`
+	Name                        string  `json:"name"`
+	Source                      *source `json:"source,omitempty"`
+	Line                        int     `json:"line"`
+	Column                      int     `json:"column"`
+	InstructionPointerReference string  `json:"instructionPointerReference"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+// Serve handles requests from in, writing responses and events to out, until
+// the client disconnects or in is closed.
+func (s *Server) Serve(in io.Reader, out io.Writer) error {
+	s.out = out
+	s.requests = make(chan *request)
+	s.errs = make(chan error, 1)
+	go s.readRequests(bufio.NewReader(in))
+	for !s.done {
+		select {
+		case req := <-s.requests:
+			if err := s.handle(req); err != nil {
+				return err
+			}
+		case err := <-s.errs:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readRequests decodes requests framed with a Content-Length header and
+// sends them to s.requests.
+func (s *Server) readRequests(r *bufio.Reader) {
+	tp := textproto.NewReader(r)
+	for {
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			s.errs <- err
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			s.errs <- fmt.Errorf("invalid Content-Length: %s", header.Get("Content-Length"))
+			return
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			s.errs <- err
+			return
+		}
+		req := &request{}
+		if err := json.Unmarshal(data, req); err != nil {
+			s.errs <- fmt.Errorf("invalid request: %s", err)
+			return
+		}
+		s.requests <- req
+	}
+}
+
+func (s *Server) write(msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *Server) nextSeq() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *Server) respond(req *request, body interface{}) error {
+	return s.write(&response{Seq: s.nextSeq(), Type: "response", RequestSeq: req.Seq,
+		Success: true, Command: req.Command, Body: body})
+}
+
+func (s *Server) fail(req *request, format string, a ...interface{}) error {
+	return s.write(&response{Seq: s.nextSeq(), Type: "response", RequestSeq: req.Seq,
+		Command: req.Command, Message: fmt.Sprintf(format, a...)})
+}
+
+func (s *Server) send(name string, body interface{}) error {
+	return s.write(&event{Seq: s.nextSeq(), Type: "event", Event: name, Body: body})
+}
+
+// outputWriter sends program output as output events.
+type outputWriter struct {
+	s        *Server
+	category string
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	err := w.s.send("output", map[string]string{"category": w.category, "output": string(p)})
+	return len(p), err
+}
+
+// handle dispatches a request.  Errors are only returned if the client
+// can't be written to; failed requests get an error response.
+func (s *Server) handle(req *request) error {
+	if req.Command != "initialize" && req.Command != "launch" && req.Command != "disconnect" &&
+		req.Command != "terminate" && s.machine == nil {
+		return s.fail(req, "no program launched")
+	}
+	switch req.Command {
+	case "initialize":
+		return s.respond(req, map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsReadMemoryRequest":        true,
+			"supportsSteppingGranularity":      true,
+			"supportsTerminateRequest":         true,
+		})
+	case "launch":
+		return s.launch(req)
+	case "setBreakpoints":
+		return s.setBreakpoints(req)
+	case "setExceptionBreakpoints":
+		return s.respond(req, map[string]interface{}{"breakpoints": []breakpoint{}})
+	case "configurationDone":
+		if err := s.respond(req, nil); err != nil {
+			return err
+		}
+		if s.stopOnEntry {
+			return s.stopped("entry", "")
+		}
+		return s.run(runContinue)
+	case "threads":
+		return s.respond(req, map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": threadID, "name": "main"}},
+		})
+	case "stackTrace":
+		return s.stackTrace(req)
+	case "scopes":
+		return s.scopes(req)
+	case "variables":
+		return s.variables(req)
+	case "readMemory":
+		return s.readMemory(req)
+	case "continue", "next", "stepIn", "stepOut":
+		return s.resume(req)
+	case "pause":
+		s.paused = s.running
+		return s.respond(req, nil)
+	case "disconnect", "terminate":
+		s.done = true
+		if err := s.respond(req, nil); err != nil {
+			return err
+		}
+		if req.Command == "terminate" {
+			return s.send("terminated", nil)
+		}
+		return nil
+	}
+	return s.fail(req, "unsupported request '%s'", req.Command)
+}
+
+func (s *Server) launch(req *request) error {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.fail(req, "invalid arguments: %s", err)
+	}
+	if args.Program == "" {
+		return s.fail(req, "no program given")
+	}
+	m, debug, err := s.load(args.Program, &outputWriter{s: s, category: "stdout"})
+	if err != nil {
+		return s.fail(req, "cannot load '%s': %s", args.Program, err)
+	}
+	s.machine = m
+	s.debug = debug
+	s.stopOnEntry = args.StopOnEntry
+	if err := s.respond(req, nil); err != nil {
+		return err
+	}
+	return s.send("initialized", nil)
+}
+
+// sameFile returns true if the file names in the debug file and from the
+// client refer to the same file.  The debug file names are as given to the
+// assembler, so may be relative, in which case only the base name is compared.
+func sameFile(debugName, clientName string) bool {
+	if filepath.IsAbs(debugName) {
+		return filepath.Clean(debugName) == filepath.Clean(clientName)
+	}
+	if abs, err := filepath.Abs(debugName); err == nil && abs == filepath.Clean(clientName) {
+		return true
+	}
+	return filepath.Base(debugName) == filepath.Base(clientName)
+}
+
+// lineAddress returns the address of the first instruction on line, or on
+// the next line with code, and that line.
+func (s *Server) lineAddress(path string, line int) (uint16, int, bool) {
+	if s.debug == nil {
+		return 0, 0, false
+	}
+	var best *asm.DebugInfo
+	for i := range s.debug.Lines {
+		info := &s.debug.Lines[i]
+		if info.Bank != 0 || info.Line < line || !sameFile(info.File, path) {
+			continue
+		}
+		if best == nil || info.Line < best.Line || (info.Line == best.Line && info.PC < best.PC) {
+			best = info
+		}
+	}
+	if best == nil {
+		return 0, 0, false
+	}
+	return best.PC, best.Line, true
+}
+
+func (s *Server) setBreakpoints(req *request) error {
+	var args struct {
+		Source      source             `json:"source"`
+		Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.fail(req, "invalid arguments: %s", err)
+	}
+	for _, addr := range s.sources[args.Source.Path] {
+		delete(s.breakpoints, addr)
+	}
+	var addrs []uint16
+	result := []breakpoint{}
+	for _, sb := range args.Breakpoints {
+		addr, line, ok := s.lineAddress(args.Source.Path, sb.Line)
+		if !ok {
+			result = append(result, breakpoint{Line: sb.Line, Message: "no code at or after this line"})
+			continue
+		}
+		id, exists := s.breakpoints[addr]
+		if !exists {
+			s.lastID++
+			id = s.lastID
+			s.breakpoints[addr] = id
+		}
+		addrs = append(addrs, addr)
+		src := args.Source
+		result = append(result, breakpoint{ID: id, Verified: true, Line: line, Source: &src})
+	}
+	s.sources[args.Source.Path] = addrs
+	return s.respond(req, map[string]interface{}{"breakpoints": result})
+}
+
+func (s *Server) resume(req *request) error {
+	if s.running {
+		return s.fail(req, "already running")
+	}
+	var args struct {
+		Granularity string `json:"granularity"`
+	}
+	_ = json.Unmarshal(req.Arguments, &args)
+	mode := map[string]runMode{
+		"continue": runContinue, "next": runNext, "stepIn": runStepIn, "stepOut": runStepOut,
+	}[req.Command]
+	if args.Granularity == "instruction" && mode != runContinue && mode != runStepOut {
+		mode = runInstruction
+	}
+	var body interface{}
+	if req.Command == "continue" {
+		body = map[string]bool{"allThreadsContinued": true}
+	}
+	if err := s.respond(req, body); err != nil {
+		return err
+	}
+	return s.run(mode)
+}
+
+func (s *Server) opAt(pc uint16) machine.OpCode {
+	op, _, _ := machine.DecodeOp(s.machine.Memory().GetByte(pc))
+	return op
+}
+
+// location returns the source line for pc, or "" if there's no debug info.
+func (s *Server) location(pc uint16) string {
+	if s.debug == nil {
+		return ""
+	}
+	bank := 0
+	if pc >= machine.BankWindowStart && pc <= machine.BankWindowEnd {
+		bank = s.machine.Banks().Selected()
+	}
+	file, line := s.debug.SourceLine(pc, bank)
+	if file == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// run executes the program in the given mode until it stops, handling
+// requests that arrive in the meantime.
+func (s *Server) run(mode runMode) error {
+	if s.exited {
+		return s.exit(s.exitCode)
+	}
+	s.running = true
+	s.paused = false
+	defer func() { s.running = false }()
+	start := s.location(s.machine.Flags().PC)
+	depth := 0
+	for n := 1; ; n++ {
+		pc := s.machine.Flags().PC
+		op := s.opAt(pc)
+		if op == machine.Hlt {
+			return s.exit(0)
+		}
+		s.machine.Step(pc)
+		if fault := s.machine.Fault(); fault != nil {
+			s.exited = true
+			s.exitCode = 1
+			msg := fmt.Sprintf("machine fault: %s", fault)
+			if err := s.send("output", map[string]string{"category": "stderr", "output": msg + "\n"}); err != nil {
+				return err
+			}
+			return s.stopped("exception", msg)
+		}
+		switch op {
+		case machine.Jsr:
+			depth++
+		case machine.Ret, machine.Rst:
+			depth--
+		}
+		pc = s.machine.Flags().PC
+		if _, ok := s.breakpoints[pc]; ok {
+			return s.stopped("breakpoint", "")
+		}
+		loc := s.location(pc)
+		switch mode {
+		case runInstruction:
+			return s.stopped("step", "")
+		case runStepIn:
+			if start == "" || (loc != "" && loc != start) {
+				return s.stopped("step", "")
+			}
+		case runNext:
+			if depth < 0 || (depth == 0 && (start == "" || (loc != "" && loc != start))) {
+				return s.stopped("step", "")
+			}
+		case runStepOut:
+			if depth < 0 {
+				return s.stopped("step", "")
+			}
+		}
+		if n%pollInterval == 0 {
+			if err := s.poll(); err != nil {
+				return err
+			}
+			if s.done {
+				return nil
+			}
+			if s.paused {
+				return s.stopped("pause", "")
+			}
+		}
+	}
+}
+
+// poll handles any requests waiting while the program runs.
+func (s *Server) poll() error {
+	for {
+		select {
+		case req := <-s.requests:
+			if err := s.handle(req); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *Server) stopped(reason string, text string) error {
+	s.frames = nil
+	body := map[string]interface{}{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+	if text != "" {
+		body["text"] = text
+	}
+	if reason == "breakpoint" {
+		body["hitBreakpointIds"] = []int{s.breakpoints[s.machine.Flags().PC]}
+	}
+	return s.send("stopped", body)
+}
+
+func (s *Server) exit(code int) error {
+	s.exited = true
+	if err := s.send("exited", map[string]int{"exitCode": code}); err != nil {
+		return err
+	}
+	return s.send("terminated", nil)
+}
+
+// stack returns the frames at the current stop.
+func (s *Server) stack() []asm.Frame {
+	if s.frames != nil {
+		return s.frames
+	}
+	if s.debug == nil {
+		s.frames = []asm.Frame{{PC: s.machine.Flags().PC, FP: s.machine.Flags().FP}}
+	} else {
+		s.frames = asm.Backtrace(s.machine, s.debug)
+	}
+	return s.frames
+}
+
+func (s *Server) stackTrace(req *request) error {
+	var args struct {
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	_ = json.Unmarshal(req.Arguments, &args)
+	frames := s.stack()
+	result := []stackFrame{}
+	for i := args.StartFrame; i < len(frames); i++ {
+		if args.Levels > 0 && len(result) == args.Levels {
+			break
+		}
+		f := frames[i]
+		name := f.Function
+		if name == "" {
+			name = fmt.Sprintf("0x%04x", f.PC)
+		}
+		sf := stackFrame{ID: i, Name: name, Line: f.Line, Column: 1,
+			InstructionPointerReference: fmt.Sprintf("0x%04x", f.PC)}
+		if f.File != "" {
+			path, err := filepath.Abs(f.File)
+			if err != nil {
+				path = f.File
+			}
+			sf.Source = &source{Name: filepath.Base(f.File), Path: path}
+		}
+		result = append(result, sf)
+	}
+	return s.respond(req, map[string]interface{}{"stackFrames": result, "totalFrames": len(frames)})
+}
+
+// variablesReference encodes a frame and scope as a variables reference.
+func variablesReference(frame, kind int) int {
+	return frame*scopeCount + kind + 1
+}
+
+func (s *Server) scopes(req *request) error {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.fail(req, "invalid arguments: %s", err)
+	}
+	if args.FrameID < 0 || args.FrameID >= len(s.stack()) {
+		return s.fail(req, "invalid frame %d", args.FrameID)
+	}
+	result := []scope{
+		{Name: "Registers", VariablesReference: variablesReference(args.FrameID, scopeRegisters)},
+		{Name: "Flags", VariablesReference: variablesReference(args.FrameID, scopeFlags)},
+	}
+	f := s.stack()[args.FrameID]
+	if len(f.Args) > 0 {
+		result = append(result, scope{Name: "Arguments", VariablesReference: variablesReference(args.FrameID, scopeArgs)})
+	}
+	if len(f.Locals) > 0 {
+		result = append(result, scope{Name: "Locals", VariablesReference: variablesReference(args.FrameID, scopeLocals)})
+	}
+	return s.respond(req, map[string]interface{}{"scopes": result})
+}
+
+func word(name string, v uint16) variable {
+	value := fmt.Sprintf("0x%04x", v)
+	return variable{Name: name, Value: value, MemoryReference: value}
+}
+
+func boolean(name string, v bool) variable {
+	return variable{Name: name, Value: strconv.FormatBool(v)}
+}
+
+func frameValues(values []asm.FrameValue, fp uint16) []variable {
+	result := []variable{}
+	for _, v := range values {
+		value := fmt.Sprintf("%d (0x%0*x)", v.Value, v.Size*2, v.Value)
+		result = append(result, variable{Name: v.Name, Value: value,
+			MemoryReference: fmt.Sprintf("0x%04x", uint16(int(fp)+v.Offset))})
+	}
+	return result
+}
+
+func (s *Server) variables(req *request) error {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.fail(req, "invalid arguments: %s", err)
+	}
+	ref := args.VariablesReference - 1
+	frame, kind := ref/scopeCount, ref%scopeCount
+	if ref < 0 || frame >= len(s.stack()) {
+		return s.fail(req, "invalid variables reference %d", args.VariablesReference)
+	}
+	f := s.stack()[frame]
+	flags := s.machine.Flags()
+	var result []variable
+	switch kind {
+	case scopeRegisters:
+		if frame == 0 {
+			result = []variable{word("pc", flags.PC), word("sp", flags.SP), word("fp", flags.FP)}
+		} else {
+			result = []variable{word("pc", f.PC), word("fp", f.FP)}
+		}
+	case scopeFlags:
+		result = []variable{boolean("negative", flags.Negative), boolean("zero", flags.Zero),
+			boolean("carry", flags.Carry), boolean("bytes", flags.Bytes)}
+	case scopeArgs:
+		result = frameValues(f.Args, f.FP)
+	case scopeLocals:
+		result = frameValues(f.Locals, f.FP)
+	}
+	return s.respond(req, map[string]interface{}{"variables": result})
+}
+
+// parseAddress parses a memory reference, which is a number or a symbol.
+func (s *Server) parseAddress(ref string) (int, bool) {
+	if v, err := strconv.ParseUint(ref, 0, 16); err == nil {
+		return int(v), true
+	}
+	if s.debug != nil {
+		for _, sym := range s.debug.Symbols {
+			if sym.Name == ref && sym.Label {
+				return sym.Value, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (s *Server) readMemory(req *request) error {
+	var args struct {
+		MemoryReference string `json:"memoryReference"`
+		Offset          int    `json:"offset"`
+		Count           int    `json:"count"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return s.fail(req, "invalid arguments: %s", err)
+	}
+	base, ok := s.parseAddress(strings.TrimSpace(args.MemoryReference))
+	if !ok {
+		return s.fail(req, "invalid memory reference '%s'", args.MemoryReference)
+	}
+	addr := base + args.Offset
+	if addr < 0 || addr > 0xffff || args.Count < 0 {
+		return s.fail(req, "address out of range")
+	}
+	count := args.Count
+	unreadable := 0
+	if addr+count > 0x10000 {
+		unreadable = addr + count - 0x10000
+		count = 0x10000 - addr
+	}
+	data := make([]byte, count)
+	for i := range data {
+		data[i] = s.machine.Memory().GetByte(uint16(addr + i))
+	}
+	body := map[string]interface{}{
+		"address": fmt.Sprintf("0x%04x", addr),
+		"data":    base64.StdEncoding.EncodeToString(data),
+	}
+	if unreadable > 0 {
+		body["unreadableBytes"] = unreadable
+	}
+	return s.respond(req, body)
+}
@@ -0,0 +1,291 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSource = `
+		dw main
+		org 0x100
+main:	psh #3
+		jsr accum
+		pop #2
+		hlt
+accum(n word):
+		var total word
+		cpy total, n
+		add count, total
+		rst
+count:	dw 0
+`
+
+// message is a response or event read by the client.
+type message struct {
+	Type       string                 `json:"type"`
+	RequestSeq int                    `json:"request_seq"`
+	Success    bool                   `json:"success"`
+	Command    string                 `json:"command"`
+	Message    string                 `json:"message"`
+	Event      string                 `json:"event"`
+	Body       map[string]interface{} `json:"body"`
+}
+
+// client is a scripted DAP client.
+type client struct {
+	t      *testing.T
+	w      io.WriteCloser
+	r      *textproto.Reader
+	br     *bufio.Reader
+	seq    int
+	events []*message
+	done   chan error
+	linker *asm.Linker
+}
+
+func startServer(t *testing.T, source string) *client {
+	linker, err := asm.BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(program string, stdout io.Writer) (*machine.Machine, *asm.DebugFile, error) {
+		if program != "test.s" {
+			return nil, nil, fmt.Errorf("not found")
+		}
+		m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcherWithStdout(stdout), linker.Image())
+		return m, linker.DebugFile(), err
+	}
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, w: inW, done: make(chan error, 1), linker: linker}
+	c.br = bufio.NewReader(outR)
+	c.r = textproto.NewReader(c.br)
+	go func() {
+		c.done <- NewServer(load).Serve(inR, outW)
+		outW.Close()
+	}()
+	return c
+}
+
+func (c *client) read() *message {
+	header, err := c.r.ReadMIMEHeader()
+	if !assert.Nil(c.t, err) {
+		c.t.FailNow()
+	}
+	length, _ := strconv.Atoi(header.Get("Content-Length"))
+	data := make([]byte, length)
+	_, err = io.ReadFull(c.br, data)
+	assert.Nil(c.t, err)
+	msg := &message{}
+	assert.Nil(c.t, json.Unmarshal(data, msg))
+	return msg
+}
+
+// request sends a request and returns its response, saving any events that
+// arrive first.
+func (c *client) request(command string, args interface{}) *message {
+	c.seq++
+	data, _ := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	})
+	_, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	assert.Nil(c.t, err)
+	for {
+		msg := c.read()
+		if msg.Type == "response" && msg.RequestSeq == c.seq {
+			assert.Equal(c.t, command, msg.Command)
+			return msg
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+// event returns the next event with the given name, reading if needed.
+func (c *client) event(name string) *message {
+	for {
+		for i, msg := range c.events {
+			if msg.Event == name {
+				c.events = append(c.events[:i], c.events[i+1:]...)
+				return msg
+			}
+		}
+		c.events = append(c.events, c.read())
+	}
+}
+
+func (c *client) launch(args map[string]interface{}) {
+	resp := c.request("initialize", map[string]string{"adapterID": "mpu"})
+	assert.True(c.t, resp.Success)
+	assert.Equal(c.t, true, resp.Body["supportsConfigurationDoneRequest"])
+	args["program"] = "test.s"
+	assert.True(c.t, c.request("launch", args).Success)
+	c.event("initialized")
+}
+
+func (c *client) disconnect() {
+	assert.True(c.t, c.request("disconnect", nil).Success)
+	assert.Nil(c.t, <-c.done)
+}
+
+func (c *client) stoppedAt() (string, float64) {
+	stopped := c.event("stopped")
+	resp := c.request("stackTrace", map[string]int{"threadId": 1})
+	top := resp.Body["stackFrames"].([]interface{})[0].(map[string]interface{})
+	return stopped.Body["reason"].(string), top["line"].(float64)
+}
+
+func (c *client) variables(frame int, scope string) map[string]string {
+	resp := c.request("scopes", map[string]int{"frameId": frame})
+	assert.True(c.t, resp.Success)
+	for _, s := range resp.Body["scopes"].([]interface{}) {
+		s := s.(map[string]interface{})
+		if s["name"] != scope {
+			continue
+		}
+		resp = c.request("variables", map[string]interface{}{"variablesReference": s["variablesReference"]})
+		vars := map[string]string{}
+		for _, v := range resp.Body["variables"].([]interface{}) {
+			v := v.(map[string]interface{})
+			vars[v["name"].(string)] = v["value"].(string)
+		}
+		return vars
+	}
+	return nil
+}
+
+func TestLaunchAndRunToExit(t *testing.T) {
+	c := startServer(t, testSource)
+	c.launch(map[string]interface{}{})
+	assert.True(t, c.request("configurationDone", nil).Success)
+	assert.Equal(t, float64(0), c.event("exited").Body["exitCode"])
+	c.event("terminated")
+	c.disconnect()
+}
+
+func TestLaunchFails(t *testing.T) {
+	c := startServer(t, testSource)
+	c.request("initialize", nil)
+	resp := c.request("launch", map[string]string{"program": "missing.s"})
+	assert.False(t, resp.Success)
+	assert.Equal(t, "cannot load 'missing.s': not found", resp.Message)
+	assert.False(t, c.request("threads", nil).Success)
+	c.disconnect()
+}
+
+func TestBreakpointsAndStack(t *testing.T) {
+	c := startServer(t, testSource)
+	c.launch(map[string]interface{}{})
+	resp := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/work/test.s"},
+		"breakpoints": []map[string]int{{"line": 10}, {"line": 1}, {"line": 14}},
+	})
+	bps := resp.Body["breakpoints"].([]interface{})
+	assert.Equal(t, true, bps[0].(map[string]interface{})["verified"])
+	assert.Equal(t, float64(10), bps[0].(map[string]interface{})["line"])
+	assert.Equal(t, float64(4), bps[1].(map[string]interface{})["line"]) // moved to the next line with code
+	assert.Equal(t, false, bps[2].(map[string]interface{})["verified"])
+
+	// replace the breakpoints for the file
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": "/work/test.s"},
+		"breakpoints": []map[string]int{{"line": 10}},
+	})
+	c.request("configurationDone", nil)
+	reason, line := c.stoppedAt()
+	assert.Equal(t, "breakpoint", reason)
+	assert.Equal(t, float64(10), line)
+
+	resp = c.request("stackTrace", map[string]int{"threadId": 1})
+	frames := resp.Body["stackFrames"].([]interface{})
+	assert.Len(t, frames, 2)
+	assert.Equal(t, "accum", frames[0].(map[string]interface{})["name"])
+	assert.Equal(t, "test.s", frames[0].(map[string]interface{})["source"].(map[string]interface{})["name"])
+	assert.Equal(t, "main+6", frames[1].(map[string]interface{})["name"])
+	assert.Equal(t, float64(5), frames[1].(map[string]interface{})["line"])
+
+	assert.Equal(t, map[string]string{"n": "3 (0x0003)"}, c.variables(0, "Arguments"))
+	assert.Equal(t, map[string]string{"total": "0 (0x0000)"}, c.variables(0, "Locals"))
+	regs := c.variables(0, "Registers")
+	assert.Equal(t, fmt.Sprintf("0x%04x", c.linker.Symbols().GetSymbol("accum").Value()+2), regs["pc"])
+	assert.Equal(t, "false", c.variables(0, "Flags")["carry"])
+
+	c.request("continue", map[string]int{"threadId": 1})
+	c.event("exited")
+	c.disconnect()
+}
+
+func TestStepping(t *testing.T) {
+	c := startServer(t, testSource)
+	c.launch(map[string]interface{}{"stopOnEntry": true})
+	c.request("configurationDone", nil)
+	reason, line := c.stoppedAt()
+	assert.Equal(t, "entry", reason)
+	assert.Equal(t, float64(4), line)
+
+	c.request("next", map[string]int{"threadId": 1})
+	_, line = c.stoppedAt()
+	assert.Equal(t, float64(5), line)
+
+	c.request("stepIn", map[string]int{"threadId": 1})
+	_, line = c.stoppedAt()
+	assert.Equal(t, float64(8), line)
+
+	c.request("next", map[string]int{"threadId": 1})
+	_, line = c.stoppedAt()
+	assert.Equal(t, float64(10), line)
+
+	c.request("stepOut", map[string]int{"threadId": 1})
+	reason, line = c.stoppedAt()
+	assert.Equal(t, "step", reason)
+	assert.Equal(t, float64(6), line)
+
+	c.request("next", map[string]interface{}{"threadId": 1, "granularity": "instruction"})
+	_, line = c.stoppedAt()
+	assert.Equal(t, float64(7), line)
+	c.disconnect()
+}
+
+func TestReadMemory(t *testing.T) {
+	c := startServer(t, testSource)
+	c.launch(map[string]interface{}{"stopOnEntry": true})
+	c.request("configurationDone", nil)
+	c.event("stopped")
+
+	resp := c.request("readMemory", map[string]interface{}{"memoryReference": "main", "count": 2})
+	assert.True(t, resp.Success)
+	data, _ := base64.StdEncoding.DecodeString(resp.Body["data"].(string))
+	assert.Len(t, data, 2)
+	assert.Equal(t, "0x0100", resp.Body["address"])
+
+	resp = c.request("readMemory", map[string]interface{}{"memoryReference": "0xfffe", "offset": 1, "count": 4})
+	assert.Equal(t, float64(3), resp.Body["unreadableBytes"])
+	assert.False(t, c.request("readMemory", map[string]interface{}{"memoryReference": "nope", "count": 1}).Success)
+	c.disconnect()
+}
+
+func TestPauseAndOutput(t *testing.T) {
+	c := startServer(t, `
+		dw main
+		org 0x100
+main:	cpy 6, #req
+loop:	jmp loop
+req:	dw 0x0101, msg
+msg:	db "hi", 0
+`)
+	c.launch(map[string]interface{}{})
+	c.request("configurationDone", nil)
+	assert.True(t, c.request("pause", map[string]int{"threadId": 1}).Success)
+	assert.Equal(t, "pause", c.event("stopped").Body["reason"])
+	assert.Equal(t, "hi", c.event("output").Body["output"])
+	c.disconnect()
+}
@@ -0,0 +1,120 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// disassemble writes source for a binary to stdout, or to output, and checks
+// that it assembles back to the same image.
+func disassemble(name string, symName string, output string) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	img, err := machine.LoadImageFile(name, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot load '%s': %s\n", name, err)
+		os.Exit(1)
+	}
+	raw := !machine.IsImage(data) && !machine.IsIntelHex(data) && !machine.IsSRecord(data)
+	if raw && len(img.Segments) == 1 {
+		// build writes a raw image one byte past the last address the
+		// program wrote, which the source would write again
+		if seg := &img.Segments[0]; len(seg.Data) > 0 && seg.Data[len(seg.Data)-1] == 0 {
+			seg.Data = seg.Data[:len(seg.Data)-1]
+		}
+	}
+	var debug *asm.DebugFile
+	if symName != "" {
+		if debug = loadDebugFile(symName); debug == nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot read symbols from '%s'\n", symName)
+			os.Exit(1)
+		}
+	}
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// disassembled from %s\n", name)
+	if err := asm.Disassemble(&source, img, debug); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := checkReassembly(source.Bytes(), img, data, raw); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: the source doesn't reassemble to the same image: %s\n", err)
+	}
+	if output == "" {
+		w := bufio.NewWriter(os.Stdout)
+		w.Write(source.Bytes())
+		w.Flush()
+		return
+	}
+	if err := ioutil.WriteFile(output, source.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write output file '%s': %s\n", output, err)
+		os.Exit(1)
+	}
+}
+
+// checkReassembly assembles source and compares the result with img, or for
+// a raw image with the bytes of the file it was loaded from.
+func checkReassembly(source []byte, img *machine.Image, data []byte, raw bool) error {
+	parser := asm.NewParserFromReader("disasm.s", bytes.NewReader(source))
+	parser.Parse()
+	if parser.HasErrors() {
+		return firstMessage(parser.Messages())
+	}
+	linker := asm.NewLinker(parser.Statements())
+	linker.Link()
+	if linker.HasErrors() {
+		return firstMessage(linker.Messages())
+	}
+	if raw {
+		if !bytes.Equal(linker.Code(), data) {
+			return fmt.Errorf("raw image differs")
+		}
+		return nil
+	}
+	rebuilt := linker.Image()
+	switch {
+	case rebuilt.Entry != img.Entry || rebuilt.SP != img.SP || rebuilt.FP != img.FP:
+		return fmt.Errorf("registers are pc=0x%04x sp=0x%04x fp=0x%04x, not pc=0x%04x sp=0x%04x fp=0x%04x",
+			rebuilt.Entry, rebuilt.SP, rebuilt.FP, img.Entry, img.SP, img.FP)
+	case !reflect.DeepEqual(rebuilt.Segments, img.Segments):
+		return fmt.Errorf("segments differ")
+	case fmt.Sprint(rebuilt.Devices) != fmt.Sprint(img.Devices):
+		return fmt.Errorf("devices differ")
+	case fmt.Sprint(rebuilt.Protection) != fmt.Sprint(img.Protection):
+		return fmt.Errorf("protected regions differ")
+	}
+	return nil
+}
+
+// firstMessage returns the first message from the assembler as an error.
+func firstMessage(messages *asm.Messages) error {
+	var buf bytes.Buffer
+	messages.Fprint(&buf)
+	line, _, _ := strings.Cut(buf.String(), "\n")
+	return errors.New(line)
+}
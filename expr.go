@@ -0,0 +1,332 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// value is an expression that's evaluated against the machine when needed,
+// so a breakpoint condition sees the memory and registers when it's tested.
+type value func(*machine.Machine) int
+
+/*
+parseExpr parses an expression, using the assembler's grammar with the
+addition of registers and memory:
+
+	expr    := mul [('+' | '-' | '|' | '^') mul]*
+	mul     := unary [('*' | '/' | '%' | '<<' | '>>') unary]*
+	unary   := ['+' | '-'] primary
+	primary := number | 'c' | symbol | 'pc' | 'sp' | 'fp' | '(' expr ')'
+	         | '[' expr ']' | 'w[' expr ']'
+
+where [addr] is the byte at addr and w[addr] is the word.  Numbers are
+decimal, or 0x hex and 0b binary.  Division by zero gives zero.
+*/
+func (m *Monitor) parseExpr(s string) (value, error) {
+	p := &exprParser{mon: m, text: s}
+	p.next()
+	v, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected '%s'", p.tok)
+	}
+	return v, nil
+}
+
+// print handles "print expr", showing the value in hex, decimal, binary and
+// as a char if it's printable.  Values are 16 bit, with the signed decimal
+// shown too if the top bit is set.
+func (m *Monitor) print(cmd []string) {
+	if len(cmd) < 2 {
+		m.errorf("expected: print expr\n")
+		return
+	}
+	v, err := m.address(strings.Join(cmd[1:], " "))
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	decimal := strconv.Itoa(v)
+	if v >= 0x8000 {
+		decimal += fmt.Sprintf(" (%d)", int16(v))
+	}
+	text := fmt.Sprintf("0x%04x  %s  0b%016b", v, decimal, v)
+	if v >= ' ' && v <= '~' {
+		text += fmt.Sprintf("  '%c'", v)
+	}
+	fmt.Fprintln(m.out, text)
+}
+
+// comparison is a parsed condition, ie "w[count] == 5".
+type comparison struct {
+	text  string // the left hand expression as given
+	left  value
+	op    string
+	right value
+}
+
+var comparisons = map[string]func(a, b int) bool{
+	"==": func(a, b int) bool { return a == b },
+	"!=": func(a, b int) bool { return a != b },
+	"<":  func(a, b int) bool { return a < b },
+	"<=": func(a, b int) bool { return a <= b },
+	">":  func(a, b int) bool { return a > b },
+	">=": func(a, b int) bool { return a >= b },
+}
+
+// test compares both sides as 16 bit values, so -1 equals 0xffff.
+func (c *comparison) test(mach *machine.Machine) bool {
+	return comparisons[c.op](c.left(mach)&0xffff, c.right(mach)&0xffff)
+}
+
+// parseComparison parses "expr op expr", where op is one of ==, !=, <, <=, >
+// or >=.
+func (m *Monitor) parseComparison(s string) (*comparison, error) {
+	p := &exprParser{mon: m, text: s}
+	p.next()
+	left, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	c := &comparison{text: strings.TrimSpace(s[:p.start]), left: left, op: p.tok}
+	if comparisons[c.op] == nil {
+		return nil, fmt.Errorf("expected a comparison, ie [0x200] == 5")
+	}
+	p.next()
+	if c.right, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("unexpected '%s'", p.tok)
+	}
+	return c, nil
+}
+
+// parseCondition parses a breakpoint condition, see parseComparison.
+func (m *Monitor) parseCondition(s string) (machine.Condition, error) {
+	c, err := m.parseComparison(s)
+	if err != nil {
+		return nil, err
+	}
+	return c.test, nil
+}
+
+// exprParser is a recursive descent parser over the tokens of an expression.
+type exprParser struct {
+	mon   *Monitor
+	text  string
+	pos   int    // offset of the next token
+	start int    // offset of tok
+	tok   string // current token, "" at the end
+}
+
+// operators are the tokens that aren't numbers, names or chars, longest first.
+var operators = []string{"<<", ">>", "==", "!=", "<=", ">=", "+", "-", "*", "/", "%", "|", "^", "(", ")", "[", "]", "<", ">"}
+
+func (p *exprParser) next() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+	p.start = p.pos
+	if p.pos >= len(p.text) {
+		p.tok = ""
+		return
+	}
+	c := p.text[p.pos]
+	end := p.pos + 1
+	switch {
+	case isNameStart(c) || c == '.' || (c >= '0' && c <= '9'):
+		for end < len(p.text) && (isNameStart(p.text[end]) || p.text[end] == '.' || (p.text[end] >= '0' && p.text[end] <= '9')) {
+			end++
+		}
+	case c == '\'':
+		if i := strings.IndexByte(p.text[end+1:], '\''); i >= 0 {
+			end += i + 2
+		}
+	default:
+		for _, op := range operators {
+			if strings.HasPrefix(p.text[p.pos:], op) {
+				end = p.pos + len(op)
+				break
+			}
+		}
+	}
+	p.tok = p.text[p.pos:end]
+	p.pos = end
+}
+
+func (p *exprParser) expr() (value, error) {
+	return p.binary(p.mul, "+", "-", "|", "^")
+}
+
+func (p *exprParser) mul() (value, error) {
+	return p.binary(p.unary, "*", "/", "%", "<<", ">>")
+}
+
+// binary parses operands joined by any of ops, left to right.
+func (p *exprParser) binary(operand func() (value, error), ops ...string) (value, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for isOneOf(p.tok, ops) {
+		op := p.tok
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOp(op, left, right)
+	}
+	return left, nil
+}
+
+func isOneOf(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func binaryOp(op string, left, right value) value {
+	return func(mach *machine.Machine) int {
+		a, b := left(mach), right(mach)
+		switch op {
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "|":
+			return a | b
+		case "^":
+			return a ^ b
+		case "*":
+			return a * b
+		case "/":
+			if b == 0 {
+				return 0
+			}
+			return a / b
+		case "%":
+			if b == 0 {
+				return 0
+			}
+			return a % b
+		case "<<":
+			return a << uint(b&0xf)
+		default: // ">>"
+			return a >> uint(b&0xf)
+		}
+	}
+}
+
+func (p *exprParser) unary() (value, error) {
+	if p.tok == "-" || p.tok == "+" {
+		op := p.tok
+		p.next()
+		v, err := p.primary()
+		if err != nil || op == "+" {
+			return v, err
+		}
+		return func(mach *machine.Machine) int { return -v(mach) }, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (value, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("missing value")
+	case tok == "(":
+		p.next()
+		v, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return v, p.expect(")")
+	case tok == "[" || tok == "w" && p.pos < len(p.text) && p.text[p.pos] == '[':
+		if tok == "w" {
+			p.next()
+		}
+		p.next()
+		addr, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		if tok == "w" {
+			return func(mach *machine.Machine) int {
+				return int(mach.Memory().GetWord(uint16(addr(mach))))
+			}, nil
+		}
+		return func(mach *machine.Machine) int {
+			return int(mach.Memory().GetByte(uint16(addr(mach))))
+		}, nil
+	case tok == "pc":
+		p.next()
+		return func(mach *machine.Machine) int { return int(mach.Flags().PC) }, nil
+	case tok == "sp":
+		p.next()
+		return func(mach *machine.Machine) int { return int(mach.Flags().SP) }, nil
+	case tok == "fp":
+		p.next()
+		return func(mach *machine.Machine) int { return int(mach.Flags().FP) }, nil
+	case tok[0] == '\'':
+		if len(tok) != 3 || tok[2] != '\'' {
+			return nil, fmt.Errorf("invalid char literal %s", tok)
+		}
+		p.next()
+		return constant(int(tok[1])), nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		i, err := strconv.ParseInt(tok, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", tok)
+		}
+		p.next()
+		return constant(int(i)), nil
+	case isNameStart(tok[0]) || tok[0] == '.':
+		i, err := p.mon.symbol(tok)
+		if err != nil {
+			return nil, err
+		}
+		p.next()
+		return constant(i), nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", tok)
+}
+
+func (p *exprParser) expect(tok string) error {
+	if p.tok != tok {
+		return fmt.Errorf("expected '%s'", tok)
+	}
+	p.next()
+	return nil
+}
+
+func constant(i int) value {
+	return func(*machine.Machine) int { return i }
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/stretchr/testify/assert"
+)
+
+// exprMonitor returns a monitor with symbols, pc at 0x100, sp at 0xfff0 and
+// the word 0x1234 at 0x200.
+func exprMonitor() *Monitor {
+	m, _ := testMonitor()
+	m.debug = &asm.DebugFile{Symbols: []asm.DebugSymbol{
+		{Name: "main", Value: 0x100, Label: true},
+		{Name: "main.top", Value: 0x104, Label: true, Local: true},
+		{Name: "count", Value: 0x200, Label: true},
+		{Name: "a.x", Value: 1, Label: true, Local: true},
+		{Name: "b.x", Value: 2, Label: true, Local: true},
+		{Name: "n", Value: 4, FP: true},
+	}}
+	flags := m.machine.Flags()
+	flags.SP = 0xfff0
+	m.machine.SetFlags(flags)
+	m.memory.PutWord(0x200, 0x1234)
+	return m
+}
+
+func TestExprValues(t *testing.T) {
+	m := exprMonitor()
+	for _, test := range []struct {
+		expr  string
+		value int
+	}{
+		{"0xffff", 0xffff},
+		{"65535", 0xffff},
+		{"-1", 0xffff},
+		{"0b101", 5},
+		{"'A'", 65},
+		{"'A' + 1", 66},
+		{"1+2*3", 7},
+		{"(1+2)*3", 9},
+		{"10-2-3", 5},
+		{"7/2", 3},
+		{"7%4", 3},
+		{"5/0", 0},
+		{"5%0", 0},
+		{"1<<4", 16},
+		{"0x100>>4", 16},
+		{"1+1<<2", 5},
+		{"6|1", 7},
+		{"6^3", 5},
+		{"-(2+3)", 0xfffb},
+		{"+3", 3},
+		{"pc", 0x100},
+		{"sp", 0xfff0},
+		{"fp", 0},
+		{"[0x200]", 0x34},
+		{"[count+1]", 0x12},
+		{"w[0x200]", 0x1234},
+		{"w[count]+1", 0x1235},
+		{"w[0x1fe+2]", 0x1234},
+		{"main", 0x100},
+		{"main.top", 0x104},
+		{"top", 0x104},
+		{"count * 2", 0x400},
+	} {
+		v, err := m.address(test.expr)
+		if assert.NoError(t, err, test.expr) {
+			assert.Equal(t, test.value, v, test.expr)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	m := exprMonitor()
+	for _, test := range []struct {
+		expr string
+		err  string
+	}{
+		{"", "missing value"},
+		{"1+", "missing value"},
+		{"(1+2", "expected ')'"},
+		{"[0x200", "expected ']'"},
+		{"1 2", "unexpected '2'"},
+		{"1)", "unexpected ')'"},
+		{"'AB'", "invalid char literal 'AB'"},
+		{"0x", "invalid number '0x'"},
+		{"0x10000000000", "invalid number '0x10000000000'"},
+		{"bogus", "unknown symbol 'bogus'"},
+		{"x", "'x' is ambiguous"},
+		{"n", "unknown symbol 'n'"},
+		{"w [count]", "unknown symbol 'w'"}, // w must be followed by [
+		{"1 == 1", "unexpected '=='"},
+		{"@", "unexpected '@'"},
+	} {
+		_, err := m.address(test.expr)
+		if assert.Error(t, err, test.expr) {
+			assert.Equal(t, test.err, err.Error(), test.expr)
+		}
+	}
+
+	m.debug = nil
+	_, err := m.address("main")
+	assert.EqualError(t, err, "'main' is not a number and no symbols are loaded")
+}
+
+func TestComparisons(t *testing.T) {
+	m := exprMonitor()
+	for _, test := range []struct {
+		cond   string
+		text   string // the left hand side
+		result bool
+	}{
+		{"1 << 2 == 4", "1 << 2", true},
+		{"w[count] >> 8 == 0x12", "w[count] >> 8", true},
+		{"1 < 2", "1", true},
+		{"2 <= 1", "2", false},
+		{"1<<1>1", "1<<1", true},
+		{"8>>1>=4", "8>>1", true},
+		{"pc != main", "pc", false},
+		{"w[count] == 0x1234", "w[count]", true},
+		{"[count] > 0x40", "[count]", false},
+		{"-1 == 0xffff", "-1", true},
+		{"0x10000 + 1 == 1", "0x10000 + 1", true},
+		{"w[count] - 0x1235 == -1", "w[count] - 0x1235", true},
+		{"-1 > 0x7fff", "-1", true},
+	} {
+		c, err := m.parseComparison(test.cond)
+		if assert.NoError(t, err, test.cond) {
+			assert.Equal(t, test.text, c.text, test.cond)
+			assert.Equal(t, test.result, c.test(m.machine), test.cond)
+		}
+	}
+
+	for _, test := range []struct {
+		cond string
+		err  string
+	}{
+		{"1 + 2", "expected a comparison, ie [0x200] == 5"},
+		{"1 << 2", "expected a comparison, ie [0x200] == 5"},
+		{"1 ==", "missing value"},
+		{"1 == 2 3", "unexpected '3'"},
+		{"1 == 2 == 3", "unexpected '=='"},
+	} {
+		_, err := m.parseComparison(test.cond)
+		if assert.Error(t, err, test.cond) {
+			assert.Equal(t, test.err, err.Error(), test.cond)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	m, out := testMonitor()
+	m.Execute("print 0xffff")
+	m.Execute("? 'A'")
+	m.Execute("? 2 + 3")
+	assert.Equal(t, "0xffff  65535 (-1)  0b1111111111111111\n"+
+		"0x0041  65  0b0000000001000001  'A'\n"+
+		"0x0005  5  0b0000000000000101\n", out.String())
+}
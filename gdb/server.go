@@ -0,0 +1,581 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gdb implements a GDB remote serial protocol stub, so MPU programs
+// can be debugged from gdb or any other front-end that speaks the protocol.
+package gdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// Register numbers, in the order of the 'g' packet and the target description.
+const (
+	RegPC = iota
+	RegSP
+	RegFP
+	RegFlags
+	regCount
+)
+
+// Bits of the flags register.
+const (
+	FlagCarry    = 1 << 0
+	FlagZero     = 1 << 1
+	FlagNegative = 1 << 2
+	FlagBytes    = 1 << 3
+)
+
+// Stop signals reported to the debugger.
+const (
+	sigTrap = 5
+	sigSegv = 11
+)
+
+// pollInterval is how many instructions run between checks for an interrupt
+// from the debugger while continuing.
+const pollInterval = 1000
+
+// TargetXML describes the registers to the debugger.
+const TargetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.jsando.mpu.core">
+    <flags id="mpu_flags" size="2">
+      <field name="c" start="0" end="0"/>
+      <field name="z" start="1" end="1"/>
+      <field name="n" start="2" end="2"/>
+      <field name="b" start="3" end="3"/>
+    </flags>
+    <reg name="pc" bitsize="16" type="code_ptr" regnum="0"/>
+    <reg name="sp" bitsize="16" type="data_ptr"/>
+    <reg name="fp" bitsize="16" type="data_ptr"/>
+    <reg name="flags" bitsize="16" type="mpu_flags"/>
+  </feature>
+</target>
+`
+
+// Server is a GDB remote serial protocol stub for one machine.
+type Server struct {
+	machine     *machine.Machine
+	conn        io.ReadWriter
+	packets     chan string     // packets from the debugger, "\x03" for an interrupt
+	errs        chan error      // error that ended the reader
+	breakpoints map[uint16]bool // software and hardware breakpoints, by address
+	watchpoints map[string]int  // machine watchpoint ids, by "type,addr"
+	stopReason  string          // reply to '?'
+}
+
+// NewServer creates a stub for the machine, which should be loaded and
+// ready to run at its entry point.
+func NewServer(m *machine.Machine) *Server {
+	return &Server{
+		machine:     m,
+		breakpoints: make(map[uint16]bool),
+		watchpoints: make(map[string]int),
+		stopReason:  fmt.Sprintf("S%02x", sigTrap),
+	}
+}
+
+// ListenAndServe waits for one debugger connection on addr, ie ":1234", and
+// serves it until the debugger detaches or kills the program.  listening is
+// called once the address is bound, ie to tell the user.
+func ListenAndServe(addr string, m *machine.Machine, listening func(net.Addr)) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	if listening != nil {
+		listening(ln.Addr())
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return NewServer(m).Serve(conn)
+}
+
+// Serve handles packets from conn until the debugger detaches, kills the
+// program, or the connection closes.
+func (s *Server) Serve(conn io.ReadWriter) error {
+	s.conn = conn
+	s.packets = make(chan string)
+	s.errs = make(chan error, 1)
+	go s.readPackets(bufio.NewReader(conn))
+	for {
+		var packet string
+		select {
+		case packet = <-s.packets:
+		case err := <-s.errs:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if packet == "\x03" {
+			continue // not running, nothing to interrupt
+		}
+		reply, done := s.handle(packet)
+		if err := s.send(reply); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// readPackets decodes packets from r, acknowledging each one unless no-ack
+// mode was negotiated, and sends them to s.packets.  The reader switches to
+// no-ack mode itself after acknowledging QStartNoAckMode, since that's the
+// last packet the debugger expects an ack for.
+func (s *Server) readPackets(r *bufio.Reader) {
+	noAck := false
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			s.errs <- err
+			return
+		}
+		switch c {
+		case '+', '-':
+			continue // acks for our replies, which are never resent
+		case 0x03:
+			s.packets <- "\x03"
+			continue
+		case '$':
+		default:
+			continue
+		}
+		data, err := r.ReadString('#')
+		if err != nil {
+			s.errs <- err
+			return
+		}
+		data = data[:len(data)-1]
+		sum := make([]byte, 2)
+		if _, err := io.ReadFull(r, sum); err != nil {
+			s.errs <- err
+			return
+		}
+		if want, err := strconv.ParseUint(string(sum), 16, 8); err != nil || byte(want) != checksum(data) {
+			if !noAck {
+				s.conn.Write([]byte("-"))
+			}
+			continue
+		}
+		if !noAck {
+			s.conn.Write([]byte("+"))
+		}
+		packet := unescape(data)
+		if packet == "QStartNoAckMode" {
+			noAck = true
+		}
+		s.packets <- packet
+	}
+}
+
+func checksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// unescape decodes '}' escapes, used by binary packets.
+func unescape(data string) string {
+	if !strings.Contains(data, "}") {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '}' && i+1 < len(data) {
+			i++
+			b.WriteByte(data[i] ^ 0x20)
+			continue
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
+}
+
+func (s *Server) send(reply string) error {
+	_, err := fmt.Fprintf(s.conn, "$%s#%02x", reply, checksum(reply))
+	return err
+}
+
+// handle returns the reply to a packet, and true if the session is over.
+func (s *Server) handle(packet string) (string, bool) {
+	if packet == "" {
+		return "", false
+	}
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return s.stopReason, false
+	case 'g':
+		return s.readRegisters(), false
+	case 'G':
+		return s.writeRegisters(args), false
+	case 'p':
+		return s.readRegister(args), false
+	case 'P':
+		return s.writeRegister(args), false
+	case 'm':
+		return s.readMemory(args), false
+	case 'M':
+		return s.writeMemory(args), false
+	case 's':
+		return s.step(args), false
+	case 'c':
+		return s.cont(args), false
+	case 'Z':
+		return s.insertBreakpoint(args), false
+	case 'z':
+		return s.removeBreakpoint(args), false
+	case 'H':
+		return "OK", false
+	case 'T':
+		return "OK", false // the one thread is always alive
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	case 'q', 'Q':
+		return s.query(packet), false
+	}
+	return "", false // unsupported
+}
+
+func (s *Server) query(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+;swbreak+;hwbreak+"
+	case packet == "QStartNoAckMode":
+		return "OK"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		return readXfer(TargetXML, strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	}
+	return ""
+}
+
+// readXfer returns the part of doc given by "offset,length".
+func readXfer(doc string, args string) string {
+	offset, length, ok := parseAddrLen(args)
+	if !ok {
+		return "E01"
+	}
+	if offset >= len(doc) {
+		return "l"
+	}
+	end := offset + length
+	if end >= len(doc) {
+		return "l" + doc[offset:]
+	}
+	return "m" + doc[offset:end]
+}
+
+func (s *Server) registers() [regCount]uint16 {
+	f := s.machine.Flags()
+	var flags uint16
+	if f.Carry {
+		flags |= FlagCarry
+	}
+	if f.Zero {
+		flags |= FlagZero
+	}
+	if f.Negative {
+		flags |= FlagNegative
+	}
+	if f.Bytes {
+		flags |= FlagBytes
+	}
+	return [regCount]uint16{f.PC, f.SP, f.FP, flags}
+}
+
+func (s *Server) setRegisters(regs [regCount]uint16) {
+	flags := regs[RegFlags]
+	s.machine.SetFlags(machine.Flags{
+		PC:       regs[RegPC],
+		SP:       regs[RegSP],
+		FP:       regs[RegFP],
+		Carry:    flags&FlagCarry != 0,
+		Zero:     flags&FlagZero != 0,
+		Negative: flags&FlagNegative != 0,
+		Bytes:    flags&FlagBytes != 0,
+	})
+}
+
+// encodeWord formats a register value as little endian hex.
+func encodeWord(v uint16) string {
+	return fmt.Sprintf("%02x%02x", byte(v), byte(v>>8))
+}
+
+func decodeWord(s string) (uint16, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 2 {
+		return 0, false
+	}
+	return uint16(b[0]) | uint16(b[1])<<8, true
+}
+
+func (s *Server) readRegisters() string {
+	var b strings.Builder
+	for _, v := range s.registers() {
+		b.WriteString(encodeWord(v))
+	}
+	return b.String()
+}
+
+func (s *Server) writeRegisters(args string) string {
+	if len(args) != regCount*4 {
+		return "E01"
+	}
+	var regs [regCount]uint16
+	for i := range regs {
+		v, ok := decodeWord(args[i*4 : i*4+4])
+		if !ok {
+			return "E01"
+		}
+		regs[i] = v
+	}
+	s.setRegisters(regs)
+	return "OK"
+}
+
+func (s *Server) readRegister(args string) string {
+	n, err := strconv.ParseUint(args, 16, 8)
+	if err != nil || n >= regCount {
+		return "E01"
+	}
+	return encodeWord(s.registers()[n])
+}
+
+func (s *Server) writeRegister(args string) string {
+	i := strings.Index(args, "=")
+	if i < 0 {
+		return "E01"
+	}
+	n, err := strconv.ParseUint(args[:i], 16, 8)
+	v, ok := decodeWord(args[i+1:])
+	if err != nil || n >= regCount || !ok {
+		return "E01"
+	}
+	regs := s.registers()
+	regs[n] = v
+	s.setRegisters(regs)
+	return "OK"
+}
+
+// parseAddrLen parses "addr,length" in hex.
+func parseAddrLen(args string) (int, int, bool) {
+	parts := strings.SplitN(args, ",", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	addr, err1 := strconv.ParseUint(parts[0], 16, 32)
+	length, err2 := strconv.ParseUint(parts[1], 16, 32)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	return int(addr), int(length), true
+}
+
+func (s *Server) readMemory(args string) string {
+	addr, length, ok := parseAddrLen(args)
+	if !ok || addr+length > 0x10000 {
+		return "E01"
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = s.machine.Memory().GetByte(uint16(addr + i))
+	}
+	return hex.EncodeToString(data)
+}
+
+func (s *Server) writeMemory(args string) string {
+	i := strings.Index(args, ":")
+	if i < 0 {
+		return "E01"
+	}
+	addr, length, ok := parseAddrLen(args[:i])
+	data, err := hex.DecodeString(args[i+1:])
+	if !ok || err != nil || len(data) != length || addr+length > 0x10000 {
+		return "E01"
+	}
+	for j, b := range data {
+		s.machine.Memory().PutByte(uint16(addr+j), b)
+	}
+	return "OK"
+}
+
+// resume sets pc if the 's' or 'c' packet gives an address.
+func (s *Server) resume(args string) {
+	if args == "" {
+		return
+	}
+	if addr, err := strconv.ParseUint(args, 16, 16); err == nil {
+		f := s.machine.Flags()
+		f.PC = uint16(addr)
+		s.machine.SetFlags(f)
+	}
+}
+
+// stepOne executes one instruction and returns a stop reply if the machine
+// stopped, or "" if it can keep going.
+func (s *Server) stepOne() string {
+	pc := s.machine.Flags().PC
+	op, _, _ := machine.DecodeOp(s.machine.Memory().GetByte(pc))
+	if op == machine.Hlt {
+		return "W00"
+	}
+	s.machine.Step(pc)
+	if s.machine.Fault() != nil {
+		return fmt.Sprintf("S%02x", sigSegv)
+	}
+	if stop := s.machine.Stopped(); stop != nil {
+		kind := map[machine.WatchMode]string{
+			machine.WatchWrite:     "watch",
+			machine.WatchRead:      "rwatch",
+			machine.WatchReadWrite: "awatch",
+		}[s.watchMode(stop.ID)]
+		return fmt.Sprintf("T%02x%s:%x;", sigTrap, kind, stop.Addr)
+	}
+	return ""
+}
+
+func (s *Server) watchMode(id int) machine.WatchMode {
+	for _, wp := range s.machine.Watchpoints() {
+		if wp.ID == id {
+			return wp.Mode
+		}
+	}
+	return machine.WatchWrite
+}
+
+func (s *Server) step(args string) string {
+	s.resume(args)
+	reply := s.stepOne()
+	if reply == "" {
+		reply = fmt.Sprintf("S%02x", sigTrap)
+	}
+	s.stopReason = reply
+	return reply
+}
+
+// cont runs until a breakpoint, watchpoint, fault, hlt, or an interrupt
+// from the debugger.
+func (s *Server) cont(args string) string {
+	s.resume(args)
+	reply := ""
+	for n := 0; reply == ""; n++ {
+		reply = s.stepOne()
+		if reply != "" {
+			break
+		}
+		if s.breakpoints[s.machine.Flags().PC] {
+			reply = fmt.Sprintf("T%02xswbreak:;", sigTrap)
+			break
+		}
+		if n%pollInterval == 0 && s.interrupted() {
+			reply = fmt.Sprintf("S%02x", 2) // SIGINT
+		}
+	}
+	s.stopReason = reply
+	return reply
+}
+
+// interrupted returns true if the debugger sent an interrupt.  Other
+// packets aren't expected while running, and are dropped.
+func (s *Server) interrupted() bool {
+	select {
+	case packet := <-s.packets:
+		return packet == "\x03"
+	default:
+		return false
+	}
+}
+
+// breakpointArgs parses "type,addr,kind".
+func breakpointArgs(args string) (string, uint16, bool) {
+	parts := strings.Split(args, ",")
+	if len(parts) < 2 {
+		return "", 0, false
+	}
+	addr, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], uint16(addr), true
+}
+
+func (s *Server) insertBreakpoint(args string) string {
+	kind, addr, ok := breakpointArgs(args)
+	if !ok {
+		return "E01"
+	}
+	switch kind {
+	case "0", "1":
+		s.breakpoints[addr] = true
+	case "2", "3", "4":
+		mode := map[string]machine.WatchMode{"2": machine.WatchWrite, "3": machine.WatchRead, "4": machine.WatchReadWrite}[kind]
+		key := fmt.Sprintf("%s,%x", kind, addr)
+		if _, exists := s.watchpoints[key]; !exists {
+			s.watchpoints[key] = s.machine.SetWatchpoint(addr, mode)
+		}
+	default:
+		return ""
+	}
+	return "OK"
+}
+
+func (s *Server) removeBreakpoint(args string) string {
+	kind, addr, ok := breakpointArgs(args)
+	if !ok {
+		return "E01"
+	}
+	switch kind {
+	case "0", "1":
+		delete(s.breakpoints, addr)
+	case "2", "3", "4":
+		key := fmt.Sprintf("%s,%x", kind, addr)
+		if id, exists := s.watchpoints[key]; exists {
+			s.machine.DeleteBreakpoint(id)
+			delete(s.watchpoints, key)
+		}
+	default:
+		return ""
+	}
+	return "OK"
+}
@@ -0,0 +1,238 @@
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const loopSource = `
+		dw main
+		org 0x100
+main:	cpy count, #0
+loop:	inc count
+		cmp count, #10
+		jne loop
+done:	hlt
+count:	dw 0
+`
+
+// client is a scripted RSP client.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	errs chan error
+}
+
+// startServer links source, serves it on a loopback port, and connects.
+func startServer(t *testing.T, source string) (*client, *asm.Linker) {
+	linker, err := asm.BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	errs := make(chan error, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		errs <- NewServer(m).Serve(conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn), errs: errs}, linker
+}
+
+func (c *client) symbol(linker *asm.Linker, name string) int {
+	return linker.Symbols().GetSymbol(name).Value()
+}
+
+// send writes a packet and returns the reply.
+func (c *client) send(packet string) string {
+	c.sendRaw(fmt.Sprintf("$%s#%02x", packet, checksum(packet)))
+	return c.reply()
+}
+
+func (c *client) sendRaw(data string) {
+	_, err := io.WriteString(c.conn, data)
+	assert.Nil(c.t, err)
+}
+
+// reply reads one reply packet, skipping acks, and acknowledges it.
+func (c *client) reply() string {
+	for {
+		b, err := c.r.ReadByte()
+		if !assert.Nil(c.t, err) {
+			return ""
+		}
+		if b == '$' {
+			break
+		}
+	}
+	data, err := c.r.ReadString('#')
+	assert.Nil(c.t, err)
+	data = data[:len(data)-1]
+	sum := make([]byte, 2)
+	_, err = io.ReadFull(c.r, sum)
+	assert.Nil(c.t, err)
+	assert.Equal(c.t, fmt.Sprintf("%02x", checksum(data)), string(sum))
+	c.sendRaw("+")
+	return data
+}
+
+func (c *client) close() {
+	assert.Equal(c.t, "OK", c.send("D"))
+	assert.Nil(c.t, <-c.errs)
+	c.conn.Close()
+}
+
+func TestHandshake(t *testing.T) {
+	c, _ := startServer(t, loopSource)
+	assert.Contains(t, c.send("qSupported:multiprocess+;swbreak+"), "qXfer:features:read+")
+	assert.Equal(t, "S05", c.send("?"))
+
+	xml := ""
+	for offset := 0; ; {
+		reply := c.send(fmt.Sprintf("qXfer:features:read:target.xml:%x,%x", offset, 100))
+		xml += reply[1:]
+		offset += len(reply) - 1
+		if reply[0] == 'l' {
+			break
+		}
+		assert.Equal(t, byte('m'), reply[0])
+	}
+	assert.Equal(t, TargetXML, xml)
+	assert.Equal(t, "", c.send("vMustReplyEmpty"))
+	c.close()
+}
+
+func TestNoAckMode(t *testing.T) {
+	c, _ := startServer(t, loopSource)
+	assert.Equal(t, "OK", c.send("QStartNoAckMode"))
+	c.sendRaw("$?#3f")
+	b, _ := c.r.ReadByte()
+	assert.Equal(t, byte('$'), b) // no '+' before the reply
+	c.r.UnreadByte()
+	assert.Equal(t, "S05", c.reply())
+	c.close()
+}
+
+func TestBadChecksumIsNacked(t *testing.T) {
+	c, _ := startServer(t, loopSource)
+	c.sendRaw("$?#00")
+	b, _ := c.r.ReadByte()
+	assert.Equal(t, byte('-'), b)
+	assert.Equal(t, "S05", c.send("?"))
+	c.close()
+}
+
+func TestRegisters(t *testing.T) {
+	c, linker := startServer(t, loopSource)
+	main := c.symbol(linker, "main")
+	assert.Equal(t, fmt.Sprintf("%02x%02x000000000000", main&0xff, main>>8), c.send("g"))
+	assert.Equal(t, fmt.Sprintf("%02x%02x", main&0xff, main>>8), c.send("p0"))
+
+	assert.Equal(t, "OK", c.send("G3412001002200e00"))
+	assert.Equal(t, "3412001002200e00", c.send("g"))
+	assert.Equal(t, "0010", c.send("p1"))
+	assert.Equal(t, "0e00", c.send("p3"))
+
+	assert.Equal(t, "OK", c.send("P1=0020"))
+	assert.Equal(t, "0020", c.send("p1"))
+	assert.Equal(t, "E01", c.send("p9"))
+	assert.Equal(t, "E01", c.send("G00"))
+	c.close()
+}
+
+func TestMemory(t *testing.T) {
+	c, linker := startServer(t, loopSource)
+	count := c.symbol(linker, "count")
+	assert.Equal(t, "0000", c.send(fmt.Sprintf("m%x,2", count)))
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("M%x,2:0700", count)))
+	assert.Equal(t, "0700", c.send(fmt.Sprintf("m%x,2", count)))
+	assert.Equal(t, "E01", c.send("mffff,2"))
+	assert.Equal(t, "E01", c.send("M300,2:07"))
+	c.close()
+}
+
+func TestStep(t *testing.T) {
+	c, linker := startServer(t, loopSource)
+	loop := c.symbol(linker, "loop")
+	assert.Equal(t, "S05", c.send("s"))
+	assert.Equal(t, fmt.Sprintf("%02x%02x", loop&0xff, loop>>8), c.send("p0"))
+	assert.Equal(t, "S05", c.send("s"))
+	assert.Equal(t, "0100", c.send(fmt.Sprintf("m%x,2", c.symbol(linker, "count"))))
+	c.close()
+}
+
+func TestBreakpointAndContinue(t *testing.T) {
+	c, linker := startServer(t, loopSource)
+	loop := c.symbol(linker, "loop")
+	count := c.symbol(linker, "count")
+
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("Z0,%x,1", loop)))
+	assert.Equal(t, "T05swbreak:;", c.send("c"))
+	assert.Equal(t, "0000", c.send(fmt.Sprintf("m%x,2", count)))
+	assert.Equal(t, "T05swbreak:;", c.send("c"))
+	assert.Equal(t, "0100", c.send(fmt.Sprintf("m%x,2", count)))
+
+	// hardware breakpoints behave the same
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("z0,%x,1", loop)))
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("Z1,%x,1", c.symbol(linker, "done"))))
+	assert.Equal(t, "T05swbreak:;", c.send("c"))
+	assert.Equal(t, "0a00", c.send(fmt.Sprintf("m%x,2", count)))
+
+	assert.Equal(t, "W00", c.send("c"))
+	assert.Equal(t, "W00", c.send("?"))
+	c.close()
+}
+
+func TestWatchpoint(t *testing.T) {
+	c, linker := startServer(t, loopSource)
+	count := c.symbol(linker, "count")
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("Z2,%x,2", count)))
+	assert.Equal(t, fmt.Sprintf("T05watch:%x;", count), c.send("c"))
+	assert.Equal(t, fmt.Sprintf("T05watch:%x;", count), c.send("c"))
+	assert.Equal(t, "0100", c.send(fmt.Sprintf("m%x,2", count)))
+
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("z2,%x,2", count)))
+	assert.Equal(t, "OK", c.send(fmt.Sprintf("Z3,%x,2", count)))
+	assert.Equal(t, fmt.Sprintf("T05rwatch:%x;", count), c.send("c"))
+	c.close()
+}
+
+func TestInterrupt(t *testing.T) {
+	c, _ := startServer(t, `
+		dw main
+		org 0x100
+main:	jmp main
+`)
+	c.sendRaw("$c#63")
+	b, _ := c.r.ReadByte()
+	assert.Equal(t, byte('+'), b)
+	c.sendRaw("\x03")
+	assert.Equal(t, "S02", c.reply())
+	c.close()
+}
+
+func TestKill(t *testing.T) {
+	c, _ := startServer(t, loopSource)
+	c.sendRaw("$k#6b")
+	assert.Nil(t, <-c.errs)
+	c.conn.Close()
+}
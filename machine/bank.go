@@ -0,0 +1,133 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+const (
+	BankWindowStart = 0x8000 // First address of the bank-switched window
+	BankWindowSize  = 0x4000 // Size of the window, and of each bank
+	BankWindowEnd   = BankWindowStart + BankWindowSize - 1
+	MaxBanks        = 256 // Bank numbers 0..MaxBanks-1, bank 0 is main memory
+)
+
+// BankController selects which bank of extended memory is visible in the
+// window from BankWindowStart to BankWindowEnd.  Bank 0 is the 64k of main
+// memory itself, so a program that never writes the bank register sees a flat
+// address space.  Banks 1 and up live in host memory and are allocated the
+// first time they are selected or loaded.
+type BankController struct {
+	selected uint16   // value of the bank register
+	banks    [][]byte // indexed by bank number, nil if not allocated yet
+}
+
+func NewBankController() *BankController {
+	return &BankController{
+		banks: make([][]byte, MaxBanks),
+	}
+}
+
+// Register returns the memory-mapped bank select register.
+func (b *BankController) Register() Memory {
+	return &Register{&b.selected}
+}
+
+// Selected returns the currently selected bank number.
+func (b *BankController) Selected() int {
+	return int(b.selected)
+}
+
+// Bank returns the storage for the given bank, allocating it if needed.
+// Returns nil for bank 0 (main memory) or a bank number out of range.
+func (b *BankController) Bank(n int) []byte {
+	if n <= 0 || n >= MaxBanks {
+		return nil
+	}
+	if b.banks[n] == nil {
+		b.banks[n] = make([]byte, BankWindowSize)
+	}
+	return b.banks[n]
+}
+
+// Count returns one more than the highest bank number in use.
+func (b *BankController) Count() int {
+	n := 1
+	for i := range b.banks {
+		if b.banks[i] != nil {
+			n = i + 1
+		}
+	}
+	return n
+}
+
+// active returns the bank mapped into the window, or nil if main memory is.
+func (b *BankController) active() []byte {
+	if b.selected == 0 {
+		return nil
+	}
+	return b.Bank(int(b.selected))
+}
+
+// LoadBanks copies images into banks 1, 2, ... in order, BankWindowSize bytes each.
+func (b *BankController) LoadBanks(images []byte) {
+	for n := 1; len(images) > 0; n++ {
+		bank := b.Bank(n)
+		if bank == nil {
+			return
+		}
+		copied := copy(bank, images)
+		images = images[copied:]
+	}
+}
+
+func inBankWindow(addr uint16) bool {
+	return addr >= BankWindowStart && addr <= BankWindowEnd
+}
+
+// ReadBankByte reads a byte from the given bank, regardless of which bank
+// is currently selected.  Addresses outside the window read main memory.
+func (m *Machine) ReadBankByte(bank int, addr uint16) byte {
+	if !inBankWindow(addr) {
+		return m.memory.GetByte(addr)
+	}
+	if bank == 0 {
+		return m.memory.raw[addr]
+	}
+	storage := m.memory.banks.Bank(bank)
+	if storage == nil {
+		return 0
+	}
+	return storage[addr-BankWindowStart]
+}
+
+// WriteBankByte writes a byte to the given bank, regardless of which bank
+// is currently selected.  Addresses outside the window write main memory.
+func (m *Machine) WriteBankByte(bank int, addr uint16, value byte) {
+	if !inBankWindow(addr) {
+		m.memory.PutByte(addr, value)
+		return
+	}
+	if bank == 0 {
+		m.memory.raw[addr] = value
+		return
+	}
+	storage := m.memory.banks.Bank(bank)
+	if storage != nil {
+		storage[addr-BankWindowStart] = value
+	}
+}
+
+// Banks returns the bank controller.
+func (m *Machine) Banks() *BankController {
+	return m.memory.banks
+}
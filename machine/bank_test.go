@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBankSwitching(t *testing.T) {
+	m := NewMachine([]byte{})
+	mem := m.Memory()
+	mem.PutWord(0x8000, 0x1111)
+	mem.PutWord(BankAddr, 1)
+	assert.Equal(t, uint16(0), mem.GetWord(0x8000))
+	mem.PutWord(0x8000, 0x2222)
+	mem.PutWord(BankAddr, 2)
+	mem.PutWord(0x8000, 0x3333)
+
+	// addresses outside the window aren't affected by the bank register
+	mem.PutWord(0x7ffe, 0x4444)
+	mem.PutWord(BankAddr, 0)
+	assert.Equal(t, uint16(0x4444), mem.GetWord(0x7ffe))
+
+	assert.Equal(t, uint16(0x1111), mem.GetWord(0x8000))
+	mem.PutWord(BankAddr, 1)
+	assert.Equal(t, uint16(0x2222), mem.GetWord(0x8000))
+	assert.Equal(t, byte(0x33), m.ReadBankByte(2, 0x8000))
+	assert.Equal(t, byte(0x11), m.ReadBankByte(0, 0x8000))
+	assert.Equal(t, 3, m.Banks().Count())
+}
+
+func TestBankWordStraddlesWindow(t *testing.T) {
+	m := NewMachine([]byte{})
+	mem := m.Memory()
+	mem.PutWord(BankAddr, 1)
+	mem.PutWord(BankWindowEnd, 0xabcd)
+	assert.Equal(t, byte(0xcd), m.ReadBankByte(1, BankWindowEnd))
+	assert.Equal(t, byte(0xab), m.ReadBankByte(0, BankWindowEnd+1))
+	assert.Equal(t, uint16(0xabcd), mem.GetWord(BankWindowEnd))
+
+	mem.PutWord(BankWindowStart-1, 0x1234)
+	assert.Equal(t, byte(0x34), m.ReadBankByte(0, BankWindowStart-1))
+	assert.Equal(t, byte(0x12), m.ReadBankByte(1, BankWindowStart))
+	assert.Equal(t, byte(0), m.ReadBankByte(0, BankWindowStart))
+	assert.Equal(t, uint16(0x1234), mem.GetWord(BankWindowStart-1))
+}
+
+func TestImageLoadsBanks(t *testing.T) {
+	image := make([]byte, 65536+BankWindowSize+2)
+	image[0x8000] = 0x10
+	image[65536] = 0x20
+	image[65536+BankWindowSize] = 0x30
+	m := NewMachine(image)
+	assert.Equal(t, byte(0x10), m.ReadBankByte(0, 0x8000))
+	assert.Equal(t, byte(0x20), m.ReadBankByte(1, 0x8000))
+	assert.Equal(t, byte(0x30), m.ReadBankByte(2, 0x8000))
+}
+
+func TestBankedZString(t *testing.T) {
+	m := NewMachine([]byte{})
+	m.WriteBankByte(3, 0x8010, 'h')
+	m.WriteBankByte(3, 0x8011, 'i')
+	m.Memory().PutWord(BankAddr, 3)
+	assert.Equal(t, "hi", m.Memory().ReadZString(0x8010))
+}
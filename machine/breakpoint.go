@@ -0,0 +1,246 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"fmt"
+	"sort"
+)
+
+// WatchMode selects which accesses trigger a watchpoint.
+type WatchMode byte
+
+const (
+	WatchRead      WatchMode = 1 << iota // stop after an instruction reads the address
+	WatchWrite                           // stop after an instruction writes the address
+	WatchReadWrite = WatchRead | WatchWrite
+)
+
+func (w WatchMode) String() string {
+	switch w {
+	case WatchRead:
+		return "r"
+	case WatchWrite:
+		return "w"
+	}
+	return "rw"
+}
+
+// Condition is evaluated when a breakpoint is reached, and the machine only
+// stops if it returns true.
+type Condition func(m *Machine) bool
+
+// Breakpoint stops the machine before executing the instruction at Addr.
+type Breakpoint struct {
+	ID        int
+	Addr      uint16
+	Condition Condition // nil to always stop
+	Text      string    // condition as the user entered it, for display
+	Hits      int
+}
+
+// Watchpoint stops the machine after an instruction accesses Addr.
+type Watchpoint struct {
+	ID   int
+	Addr uint16
+	Mode WatchMode
+	Hits int
+}
+
+// StopKind is why a run stopped early.
+type StopKind int
+
+const (
+	StopBreakpoint StopKind = iota
+	StopWatchRead
+	StopWatchWrite
+)
+
+// Stop describes a breakpoint or watchpoint that stopped the last run.
+type Stop struct {
+	Kind StopKind
+	ID   int    // breakpoint or watchpoint id
+	PC   uint16 // instruction at the breakpoint, or that accessed the watched address
+	Addr uint16 // address accessed, for watchpoints
+}
+
+func (s *Stop) String() string {
+	switch s.Kind {
+	case StopWatchRead:
+		return fmt.Sprintf("watchpoint %d: read 0x%04x (pc=0x%04x)", s.ID, s.Addr, s.PC)
+	case StopWatchWrite:
+		return fmt.Sprintf("watchpoint %d: write 0x%04x (pc=0x%04x)", s.ID, s.Addr, s.PC)
+	}
+	return fmt.Sprintf("breakpoint %d at 0x%04x", s.ID, s.PC)
+}
+
+// SetBreakpoint adds a breakpoint at addr and returns its id.  If cond is
+// not nil the machine only stops when it returns true.
+func (m *Machine) SetBreakpoint(addr uint16, cond Condition, text string) int {
+	m.lastBreakID++
+	if m.breakpoints == nil {
+		m.breakpoints = make(map[uint16][]*Breakpoint)
+	}
+	m.breakpoints[addr] = append(m.breakpoints[addr], &Breakpoint{
+		ID:        m.lastBreakID,
+		Addr:      addr,
+		Condition: cond,
+		Text:      text,
+	})
+	return m.lastBreakID
+}
+
+// SetWatchpoint adds a watchpoint on addr and returns its id.  Breakpoints
+// and watchpoints share the same ids.
+func (m *Machine) SetWatchpoint(addr uint16, mode WatchMode) int {
+	m.lastBreakID++
+	m.watchpoints = append(m.watchpoints, &Watchpoint{
+		ID:   m.lastBreakID,
+		Addr: addr,
+		Mode: mode,
+	})
+	return m.lastBreakID
+}
+
+// DeleteBreakpoint removes the breakpoint or watchpoint with the given id,
+// and returns false if there isn't one.
+func (m *Machine) DeleteBreakpoint(id int) bool {
+	for addr, list := range m.breakpoints {
+		for i, bp := range list {
+			if bp.ID == id {
+				list = append(list[:i], list[i+1:]...)
+				if len(list) == 0 {
+					delete(m.breakpoints, addr)
+				} else {
+					m.breakpoints[addr] = list
+				}
+				return true
+			}
+		}
+	}
+	for i, wp := range m.watchpoints {
+		if wp.ID == id {
+			m.watchpoints = append(m.watchpoints[:i], m.watchpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ClearBreakpoints removes all breakpoints and watchpoints.
+func (m *Machine) ClearBreakpoints() {
+	m.breakpoints = nil
+	m.watchpoints = nil
+}
+
+// Breakpoints returns all breakpoints ordered by id.
+func (m *Machine) Breakpoints() []Breakpoint {
+	var list []Breakpoint
+	for _, bps := range m.breakpoints {
+		for _, bp := range bps {
+			list = append(list, *bp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Watchpoints returns all watchpoints ordered by id.
+func (m *Machine) Watchpoints() []Watchpoint {
+	var list []Watchpoint
+	for _, wp := range m.watchpoints {
+		list = append(list, *wp)
+	}
+	return list
+}
+
+// Stopped returns the breakpoint or watchpoint that stopped the last run, or
+// nil if it ran to completion.
+func (m *Machine) Stopped() *Stop {
+	return m.stop
+}
+
+// CheckBreakpoint returns true if a breakpoint at the current pc should stop
+// the machine, counting the hit and recording it as the reason the machine
+// stopped (see Stopped).  Run checks breakpoints itself, this is for callers
+// that run a program with Step.
+func (m *Machine) CheckBreakpoint() bool {
+	m.stop = nil
+	return m.breakpoints != nil && m.checkBreakpoint()
+}
+
+// checkBreakpoint returns true if a breakpoint at the current pc should stop
+// the machine, recording the reason.
+func (m *Machine) checkBreakpoint() bool {
+	for _, bp := range m.breakpoints[m.pc] {
+		if bp.Condition != nil && !bp.Condition(m) {
+			continue
+		}
+		bp.Hits++
+		m.stop = &Stop{Kind: StopBreakpoint, ID: bp.ID, PC: m.pc, Addr: m.pc}
+		return true
+	}
+	return false
+}
+
+// watchOperands checks read watchpoints against the memory operands of an
+// instruction.  The first operand of cpy and pop is only written.
+func (m *Machine) watchOperands(op OpCode, m1 AddressMode, addr1 uint16, m2 AddressMode, addr2 uint16) {
+	if isMemoryMode(m1) && op != Cpy && op != Pop {
+		m.checkWatch(addr1, m.operandSize(), WatchRead)
+	}
+	if isMemoryMode(m2) {
+		m.checkWatch(addr2, m.operandSize(), WatchRead)
+	}
+}
+
+// isMemoryMode returns true if the operand's value is read from memory.
+func isMemoryMode(mode AddressMode) bool {
+	switch mode {
+	case Absolute, Indirect, Relative, RelativeIndirect:
+		return true
+	}
+	return false
+}
+
+// operandSize returns the number of bytes instructions read and write.
+func (m *Machine) operandSize() int {
+	if m.bytes {
+		return 1
+	}
+	return 2
+}
+
+// checkWatch records a stop if an access of size bytes at addr hits a
+// watchpoint.  The machine stops once the current instruction completes.
+func (m *Machine) checkWatch(addr uint16, size int, mode WatchMode) {
+	if m.stop != nil {
+		return
+	}
+	for _, wp := range m.watchpoints {
+		if wp.Mode&mode == 0 || uint16(wp.Addr-addr) >= uint16(size) {
+			continue
+		}
+		wp.Hits++
+		kind := StopWatchRead
+		if mode == WatchWrite {
+			kind = StopWatchWrite
+		}
+		m.stop = &Stop{Kind: kind, ID: wp.ID, PC: m.opPC, Addr: wp.Addr}
+		return
+	}
+}
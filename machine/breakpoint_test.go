@@ -0,0 +1,125 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakpointStopsAndContinues(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 1) // 0x100
+	tester.emit2(Cpy, Absolute, 0x202, Immediate, 2) // 0x105
+	tester.emit2(Cpy, Absolute, 0x204, Immediate, 3) // 0x10a
+	m := NewMachine(tester.code)
+	id := m.SetBreakpoint(0x105, nil, "")
+	m.Run()
+
+	stop := m.Stopped()
+	assert.NotNil(t, stop)
+	assert.Equal(t, StopBreakpoint, stop.Kind)
+	assert.Equal(t, id, stop.ID)
+	assert.Equal(t, uint16(0x105), m.Flags().PC)
+	assert.Equal(t, uint16(1), m.memory.GetWord(0x200))
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x202))
+
+	// running again continues past the breakpoint
+	m.Run()
+	assert.Nil(t, m.Stopped())
+	assert.Equal(t, uint16(3), m.memory.GetWord(0x204))
+	assert.Equal(t, 1, m.Breakpoints()[0].Hits)
+}
+
+func TestBreakpointAtStartingPC(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 1) // 0x100
+	tester.emit2(Cpy, Absolute, 0x202, Immediate, 2) // 0x105
+	m := NewMachine(tester.code)
+	m.SetBreakpoint(0x100, nil, "")
+	m.Run()
+	assert.NotNil(t, m.Stopped())
+	assert.Equal(t, uint16(0x100), m.Flags().PC)
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x200))
+
+	// resuming from the stop runs the instruction at the breakpoint
+	m.Run()
+	assert.Nil(t, m.Stopped())
+	assert.Equal(t, uint16(2), m.memory.GetWord(0x202))
+
+	// but starting there again stops, since the last run didn't
+	m.RunAt(0x100)
+	assert.NotNil(t, m.Stopped())
+	assert.Equal(t, 2, m.Breakpoints()[0].Hits)
+}
+
+func TestConditionalBreakpoint(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit1(Inc, Absolute, 0x200)  // 0x100
+	tester.emit1(Jmp, Immediate, 0x100) // 0x103
+	m := NewMachine(tester.code)
+	m.SetBreakpoint(0x103, func(m *Machine) bool {
+		return m.memory.GetWord(0x200) == 5
+	}, "[0x200] == 5")
+	m.Run()
+	assert.NotNil(t, m.Stopped())
+	assert.Equal(t, uint16(5), m.memory.GetWord(0x200))
+	assert.Equal(t, "[0x200] == 5", m.Breakpoints()[0].Text)
+}
+
+func TestCheckBreakpointWhenStepping(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit1(Inc, Absolute, 0x200)  // 0x100
+	tester.emit1(Jmp, Immediate, 0x100) // 0x103
+	m := NewMachine(tester.code)
+	assert.False(t, m.CheckBreakpoint())
+	id := m.SetBreakpoint(0x103, func(m *Machine) bool {
+		return m.memory.GetWord(0x200) == 2
+	}, "[0x200] == 2")
+
+	m.Step(m.Flags().PC)
+	assert.False(t, m.CheckBreakpoint()) // condition is false
+	assert.Nil(t, m.Stopped())
+	m.Step(m.Flags().PC)
+	m.Step(m.Flags().PC)
+	assert.True(t, m.CheckBreakpoint())
+	assert.Equal(t, &Stop{Kind: StopBreakpoint, ID: id, PC: 0x103, Addr: 0x103}, m.Stopped())
+	assert.Equal(t, 1, m.Breakpoints()[0].Hits)
+}
+
+func TestWatchpoints(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 1)    // 0x100
+	tester.emit2(Cpy, Absolute, 0x202, Absolute, 0x200) // 0x105
+	m := NewMachine(tester.code)
+	m.SetWatchpoint(0x200, WatchRead)
+	write := m.SetWatchpoint(0x203, WatchWrite)
+
+	// cpy only writes its first operand, so the read watch isn't hit
+	m.Run()
+	stop := m.Stopped()
+	assert.NotNil(t, stop)
+	assert.Equal(t, StopWatchRead, stop.Kind)
+	assert.Equal(t, uint16(0x105), stop.PC)
+	assert.Equal(t, uint16(0x10a), m.Flags().PC)
+	assert.Equal(t, "watchpoint 1: read 0x0200 (pc=0x0105)", stop.String())
+
+	assert.True(t, m.DeleteBreakpoint(1))
+	m.Step(0x105)
+	assert.Equal(t, StopWatchWrite, m.Stopped().Kind)
+	assert.Equal(t, write, m.Stopped().ID)
+	assert.Equal(t, uint16(0x203), m.Stopped().Addr)
+
+	assert.False(t, m.DeleteBreakpoint(1))
+	m.ClearBreakpoints()
+	assert.Empty(t, m.Watchpoints())
+}
+
+func TestWatchStackWrite(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit1(Jsr, Immediate, 0x200)
+	m := NewMachine(tester.code)
+	m.SetWatchpoint(0x0ffe, WatchWrite)
+	m.Run()
+	assert.NotNil(t, m.Stopped())
+	assert.Equal(t, uint16(0x200), m.Flags().PC)
+}
@@ -49,6 +49,17 @@ func (m AddressMode) String() string {
 	panic("invalid mode")
 }
 
+// Size returns the number of operand bytes following the opcode for the mode.
+func (m AddressMode) Size() int {
+	switch m {
+	case Absolute, Immediate, Indirect:
+		return 2
+	case ImmediateByte, OffsetByte, Relative, RelativeIndirect:
+		return 1
+	}
+	return 0
+}
+
 type OpCode byte
 
 const (
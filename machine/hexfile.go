@@ -0,0 +1,313 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Intel HEX and Motorola S-record files carry only memory contents and a
+// start address, so device requirements and protected regions are lost.
+// Banks other than 0 are stored above 64k, at bank<<16 | addr.
+
+// hexRecordSize is the number of data bytes written per record.
+const hexRecordSize = 16
+
+// LoadImageFile decodes an image using the file name extension to pick the
+// format, falling back to the contents when the extension isn't known.
+func LoadImageFile(name string, data []byte) (*Image, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".hex", ".ihex", ".ihx":
+		return ParseIntelHex(data)
+	case ".srec", ".s19", ".s28", ".mot":
+		return ParseSRecord(data)
+	}
+	return LoadImage(data)
+}
+
+// isHexText returns true if data starts with the given prefix followed by at
+// least n hex digits, which is how both text formats start every record.
+func isHexText(data []byte, prefix string, n int) bool {
+	if !bytes.HasPrefix(data, []byte(prefix)) || len(data) < len(prefix)+n {
+		return false
+	}
+	for _, c := range data[len(prefix) : len(prefix)+n] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsIntelHex returns true if data looks like an Intel HEX file.
+func IsIntelHex(data []byte) bool {
+	return isHexText(data, ":", 8)
+}
+
+// IsSRecord returns true if data looks like a Motorola S-record file.
+func IsSRecord(data []byte) bool {
+	return len(data) > 1 && data[0] == 'S' && data[1] >= '0' && data[1] <= '9' && isHexText(data[2:], "", 4)
+}
+
+// WriteIntelHex writes the image segments as Intel HEX records, followed by
+// a start linear address record for the entry point.
+func (img *Image) WriteIntelHex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bank := 0
+	for _, seg := range img.Segments {
+		if seg.Bank != bank {
+			bank = seg.Bank
+			writeIntelHexRecord(bw, 0x04, 0, []byte{byte(bank >> 8), byte(bank)})
+		}
+		for offset := 0; offset < len(seg.Data); offset += hexRecordSize {
+			end := offset + hexRecordSize
+			if end > len(seg.Data) {
+				end = len(seg.Data)
+			}
+			writeIntelHexRecord(bw, 0x00, seg.Addr+uint16(offset), seg.Data[offset:end])
+		}
+	}
+	writeIntelHexRecord(bw, 0x05, 0, []byte{0, 0, byte(img.Entry >> 8), byte(img.Entry)})
+	writeIntelHexRecord(bw, 0x01, 0, nil)
+	return bw.Flush()
+}
+
+func writeIntelHexRecord(w io.Writer, kind byte, addr uint16, data []byte) {
+	record := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), kind}, data...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	fmt.Fprintf(w, ":%X%02X\n", record, -sum)
+}
+
+// ParseIntelHex decodes an Intel HEX file.  The initial SP and FP, and the
+// entry point if there's no start address record, are read from the first
+// 6 bytes of memory the same as for a raw image.
+func ParseIntelHex(data []byte) (*Image, error) {
+	var b imageBuilder
+	var upper uint32
+	var entry *uint16
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, fmt.Errorf("line %d: intel hex record must start with ':'", i+1)
+		}
+		record, err := decodeHexRecord(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if len(record) < 5 || int(record[0]) != len(record)-5 {
+			return nil, fmt.Errorf("line %d: intel hex record length mismatch", i+1)
+		}
+		var sum byte
+		for _, v := range record {
+			sum += v
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("line %d: intel hex checksum mismatch", i+1)
+		}
+		addr := uint32(record[1])<<8 | uint32(record[2])
+		payload := record[4 : len(record)-1]
+		switch record[3] {
+		case 0x00:
+			if err := b.add(upper+addr, payload); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+		case 0x01:
+			return b.image(entry)
+		case 0x02:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: bad extended segment address record", i+1)
+			}
+			upper = (uint32(payload[0])<<8 | uint32(payload[1])) << 4
+		case 0x04:
+			if len(payload) != 2 {
+				return nil, fmt.Errorf("line %d: bad extended linear address record", i+1)
+			}
+			upper = (uint32(payload[0])<<8 | uint32(payload[1])) << 16
+		case 0x03, 0x05:
+			if len(payload) != 4 {
+				return nil, fmt.Errorf("line %d: bad start address record", i+1)
+			}
+			start := uint16(payload[2])<<8 | uint16(payload[3])
+			entry = &start
+		default:
+			return nil, fmt.Errorf("line %d: unknown intel hex record type %02x", i+1, record[3])
+		}
+	}
+	return nil, fmt.Errorf("intel hex file has no end of file record")
+}
+
+// WriteSRecord writes the image segments as Motorola S-records, using S1
+// records for main memory and S2 records for banks, followed by a record
+// count and an S9 record with the entry point.
+func (img *Image) WriteSRecord(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeSRecord(bw, '0', []byte{0, 0}, []byte("mpu"))
+	count := 0
+	for _, seg := range img.Segments {
+		for offset := 0; offset < len(seg.Data); offset += hexRecordSize {
+			end := offset + hexRecordSize
+			if end > len(seg.Data) {
+				end = len(seg.Data)
+			}
+			addr := seg.Addr + uint16(offset)
+			if seg.Bank == 0 {
+				writeSRecord(bw, '1', []byte{byte(addr >> 8), byte(addr)}, seg.Data[offset:end])
+			} else {
+				writeSRecord(bw, '2', []byte{byte(seg.Bank), byte(addr >> 8), byte(addr)}, seg.Data[offset:end])
+			}
+			count++
+		}
+	}
+	if count <= 0xffff {
+		writeSRecord(bw, '5', []byte{byte(count >> 8), byte(count)}, nil)
+	}
+	writeSRecord(bw, '9', []byte{byte(img.Entry >> 8), byte(img.Entry)}, nil)
+	return bw.Flush()
+}
+
+func writeSRecord(w io.Writer, kind byte, addr []byte, data []byte) {
+	record := append([]byte{byte(len(addr) + len(data) + 1)}, addr...)
+	record = append(record, data...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	fmt.Fprintf(w, "S%c%X%02X\n", kind, record, ^sum)
+}
+
+// ParseSRecord decodes a Motorola S-record file.  Registers are initialized
+// the same as for ParseIntelHex.
+func ParseSRecord(data []byte) (*Image, error) {
+	var b imageBuilder
+	var entry *uint16
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(line) < 2 || line[0] != 'S' {
+			return nil, fmt.Errorf("line %d: s-record must start with 'S'", i+1)
+		}
+		record, err := decodeHexRecord(line[2:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if len(record) < 2 || int(record[0]) != len(record)-1 {
+			return nil, fmt.Errorf("line %d: s-record length mismatch", i+1)
+		}
+		var sum byte
+		for _, v := range record {
+			sum += v
+		}
+		if sum != 0xff {
+			return nil, fmt.Errorf("line %d: s-record checksum mismatch", i+1)
+		}
+		addrLen := map[byte]int{'0': 2, '1': 2, '2': 3, '3': 4, '5': 2, '6': 3, '7': 4, '8': 3, '9': 2}[line[1]]
+		if addrLen == 0 {
+			return nil, fmt.Errorf("line %d: unknown s-record type S%c", i+1, line[1])
+		}
+		if len(record) < addrLen+2 {
+			return nil, fmt.Errorf("line %d: s-record too short", i+1)
+		}
+		var addr uint32
+		for _, v := range record[1 : 1+addrLen] {
+			addr = addr<<8 | uint32(v)
+		}
+		payload := record[1+addrLen : len(record)-1]
+		switch line[1] {
+		case '1', '2', '3':
+			if err := b.add(addr, payload); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+		case '7', '8', '9':
+			start := uint16(addr)
+			entry = &start
+			return b.image(entry)
+		}
+	}
+	return b.image(entry)
+}
+
+func decodeHexRecord(text string) ([]byte, error) {
+	if len(text)%2 != 0 {
+		return nil, fmt.Errorf("odd number of hex digits")
+	}
+	record := make([]byte, len(text)/2)
+	for i := range record {
+		v, err := strconv.ParseUint(text[i*2:i*2+2], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex digits '%s'", text[i*2:i*2+2])
+		}
+		record[i] = byte(v)
+	}
+	return record, nil
+}
+
+// imageBuilder collects records into segments, merging records that follow
+// on from the previous one.
+type imageBuilder struct {
+	segments []Segment
+}
+
+func (b *imageBuilder) add(addr uint32, data []byte) error {
+	bank := int(addr >> 16)
+	start := uint16(addr)
+	if bank >= MaxBanks || int(start)+len(data) > 65536 {
+		return fmt.Errorf("address 0x%x out of range", addr)
+	}
+	if bank != 0 && (!inBankWindow(start) || int(start)+len(data) > BankWindowEnd+1) {
+		return fmt.Errorf("address 0x%x for bank %d is outside the bank window", addr, bank)
+	}
+	if n := len(b.segments); n > 0 {
+		last := &b.segments[n-1]
+		if last.Bank == bank && int(last.Addr)+len(last.Data) == int(start) {
+			last.Data = append(last.Data, data...)
+			return nil
+		}
+	}
+	b.segments = append(b.segments, Segment{Addr: start, Bank: bank, Data: append([]byte{}, data...)})
+	return nil
+}
+
+func (b *imageBuilder) image(entry *uint16) (*Image, error) {
+	var low []byte
+	for _, seg := range b.segments {
+		if seg.Bank == 0 && seg.Addr == 0 {
+			low = seg.Data
+		}
+	}
+	img := &Image{
+		Entry:    readOrDefault(low, PCAddr, 0x100),
+		SP:       readOrDefault(low, SPAddr, 0xffff),
+		FP:       readOrDefault(low, FPAddr, 0),
+		Segments: b.segments,
+	}
+	if entry != nil {
+		img.Entry = *entry
+	}
+	return img, nil
+}
@@ -0,0 +1,88 @@
+package machine
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hexTestImage() *Image {
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return &Image{
+		Entry: 0x0100,
+		SP:    0xfff0,
+		Segments: []Segment{
+			{Addr: 0, Data: []byte{0x00, 0x01, 0xf0, 0xff, 0x00, 0x00}},
+			{Addr: 0x100, Data: data},
+			{Addr: BankWindowStart, Bank: 3, Data: []byte{9, 8, 7}},
+		},
+	}
+}
+
+func TestIntelHexRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, hexTestImage().WriteIntelHex(&buf))
+	assert.True(t, IsIntelHex(buf.Bytes()))
+	assert.Contains(t, buf.String(), ":020000040003F7\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte(":00000001FF\n")))
+
+	img, err := LoadImage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, hexTestImage(), img)
+}
+
+func TestSRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, hexTestImage().WriteSRecord(&buf))
+	assert.True(t, IsSRecord(buf.Bytes()))
+	assert.Contains(t, buf.String(), "S1090000")
+	assert.Contains(t, buf.String(), "S207038000090807")
+	assert.Contains(t, buf.String(), "S9030100FB\n")
+
+	img, err := LoadImage(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, hexTestImage(), img)
+}
+
+func TestIntelHexChecksumError(t *testing.T) {
+	_, err := ParseIntelHex([]byte(":0100000001FF\n:00000001FF\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 1: intel hex checksum mismatch")
+}
+
+func TestIntelHexSegmentAddress(t *testing.T) {
+	// segment bases are the segment value * 16, which overlaps the offset
+	// unless the segment is a multiple of 0x1000
+	img, err := ParseIntelHex([]byte(":020000020001FB\n:01001000AA45\n:020000020801F3\n:01001000BB34\n:00000001FF\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []Segment{
+		{Addr: 0x0020, Data: []byte{0xaa}},
+		{Addr: 0x8020, Data: []byte{0xbb}},
+	}, img.Segments)
+}
+
+func TestIntelHexMissingEOF(t *testing.T) {
+	_, err := ParseIntelHex([]byte(":0100000001FE\n"))
+	assert.NotNil(t, err)
+}
+
+func TestSRecordChecksumError(t *testing.T) {
+	_, err := ParseSRecord([]byte("S1040000017A\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "s-record checksum mismatch")
+}
+
+func TestLoadImageFileByExtension(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, hexTestImage().WriteIntelHex(&buf))
+	img, err := LoadImageFile("prog.HEX", buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0xfff0), img.SP)
+
+	_, err = LoadImageFile("prog.s19", buf.Bytes())
+	assert.NotNil(t, err)
+}
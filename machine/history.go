@@ -0,0 +1,180 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+// historyEntry is the state before one instruction executed, so it can be
+// undone.  Instructions write at most one value to memory (devices aside),
+// which is recorded with the bytes it replaced.
+type historyEntry struct {
+	pc, sp, fp uint16
+	negative   bool
+	zero       bool
+	carry      bool
+	bytes      bool
+	assertion  bool
+	bank       uint16 // selected bank
+	written    bool
+	writeAddr  uint16
+	writeBank  int // bank the write went to, 0 outside the bank window
+	writeSize  int
+	old        [2]byte
+	new        [2]byte
+}
+
+// LastWrite describes the most recent write to an address in the history.
+type LastWrite struct {
+	PC    uint16 // address of the instruction that wrote it
+	Addr  uint16 // address written, which may be one less than asked for a word write
+	Size  int
+	Old   uint16 // value before the write
+	New   uint16 // value written
+	Steps int    // number of instructions ago, 1 for the last one executed
+}
+
+// EnableHistory records the last limit instructions executed so they can be
+// undone with StepBack or ReverseContinue, or disables it if limit is 0.
+// Memory written by devices, ie a file read, isn't recorded.
+func (m *Machine) EnableHistory(limit int) {
+	m.historyLimit = limit
+	if limit == 0 {
+		m.history = nil
+		return
+	}
+	if len(m.history) > limit {
+		m.history = append([]historyEntry(nil), m.history[len(m.history)-limit:]...)
+	}
+}
+
+// HistoryLen returns the number of instructions that can be undone.
+func (m *Machine) HistoryLen() int {
+	return len(m.history)
+}
+
+// recordHistory saves the state before the instruction at m.pc executes.
+func (m *Machine) recordHistory() {
+	// trim in batches so recording doesn't copy on every instruction
+	if len(m.history) >= 2*m.historyLimit {
+		n := copy(m.history, m.history[len(m.history)-m.historyLimit+1:])
+		m.history = m.history[:n]
+	}
+	m.history = append(m.history, historyEntry{
+		pc:        m.pc,
+		sp:        m.sp,
+		fp:        m.fp,
+		negative:  m.negative,
+		zero:      m.zero,
+		carry:     m.carry,
+		bytes:     m.bytes,
+		assertion: m.assertion,
+		bank:      m.memory.banks.selected,
+	})
+}
+
+// recordWrite saves the bytes about to be overwritten by the instruction
+// executing, and the value replacing them.  Writes to the registers are
+// restored from the entry itself.
+func (m *Machine) recordWrite(addr uint16, value uint16, size int) {
+	if addr < m.memory.mappedCount || len(m.history) == 0 {
+		return
+	}
+	e := &m.history[len(m.history)-1]
+	e.written = true
+	e.writeAddr = addr
+	e.writeSize = size
+	e.writeBank = 0
+	if inBankWindow(addr) {
+		e.writeBank = m.memory.banks.Selected()
+	}
+	for i := 0; i < size; i++ {
+		e.old[i] = m.ReadBankByte(e.writeBank, addr+uint16(i))
+	}
+	e.new = [2]byte{byte(value), byte(value >> 8)}
+}
+
+// StepBack undoes the last instruction executed, returning false if there's
+// no history left.
+func (m *Machine) StepBack() bool {
+	_, ok := m.stepBack()
+	return ok
+}
+
+// stepBack undoes the last instruction and returns its history entry.
+func (m *Machine) stepBack() (historyEntry, bool) {
+	if len(m.history) == 0 {
+		return historyEntry{}, false
+	}
+	e := m.history[len(m.history)-1]
+	m.history = m.history[:len(m.history)-1]
+	if e.written {
+		for i := 0; i < e.writeSize; i++ {
+			m.WriteBankByte(e.writeBank, e.writeAddr+uint16(i), e.old[i])
+		}
+	}
+	m.pc, m.sp, m.fp = e.pc, e.sp, e.fp
+	m.negative, m.zero, m.carry, m.bytes, m.assertion = e.negative, e.zero, e.carry, e.bytes, e.assertion
+	m.memory.banks.selected = e.bank
+	m.fault = nil
+	m.stop = nil
+	return e, true
+}
+
+// ReverseContinue steps back until the pc is at a breakpoint whose condition
+// is true, or an instruction that wrote a write watchpoint's address is
+// undone, or the history runs out.  Like Run, Stopped reports which stopped it.
+func (m *Machine) ReverseContinue() {
+	for {
+		e, ok := m.stepBack()
+		if !ok {
+			return
+		}
+		if e.written {
+			for _, wp := range m.watchpoints {
+				if wp.Mode != WatchRead && wp.Addr >= e.writeAddr && int(wp.Addr) < int(e.writeAddr)+e.writeSize {
+					wp.Hits++
+					m.stop = &Stop{Kind: StopWatchWrite, ID: wp.ID, PC: e.pc, Addr: wp.Addr}
+					return
+				}
+			}
+		}
+		if m.checkBreakpoint() {
+			return
+		}
+	}
+}
+
+// LastWriteTo searches the history for the most recent instruction that
+// wrote addr.
+func (m *Machine) LastWriteTo(addr uint16) (*LastWrite, bool) {
+	for i := len(m.history) - 1; i >= 0; i-- {
+		e := &m.history[i]
+		if !e.written || addr < e.writeAddr || int(addr) >= int(e.writeAddr)+e.writeSize {
+			continue
+		}
+		w := &LastWrite{
+			PC:    e.pc,
+			Addr:  e.writeAddr,
+			Size:  e.writeSize,
+			Old:   uint16(e.old[0]),
+			New:   uint16(e.new[0]),
+			Steps: len(m.history) - i,
+		}
+		if e.writeSize == 2 {
+			w.Old |= uint16(e.old[1]) << 8
+			w.New |= uint16(e.new[1]) << 8
+		}
+		return w, true
+	}
+	return nil, false
+}
@@ -0,0 +1,108 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func historyMachine() *Machine {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 5)    // 0x100
+	tester.emit2(Add, Absolute, 0x200, Absolute, 0x200) // 0x105
+	tester.emit1(Psh, Absolute, 0x200)                  // 0x10a
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 1)    // 0x10d
+	m := NewMachine(append(tester.code, 0))
+	m.EnableHistory(100)
+	return m
+}
+
+func TestStepBack(t *testing.T) {
+	m := historyMachine()
+	m.Run()
+	assert.Equal(t, 4, m.HistoryLen())
+	assert.Equal(t, uint16(1), m.memory.GetWord(0x200))
+	assert.Equal(t, uint16(0x0ffe), m.Flags().SP)
+
+	assert.True(t, m.StepBack())
+	assert.Equal(t, uint16(0x10d), m.Flags().PC)
+	assert.Equal(t, uint16(10), m.memory.GetWord(0x200))
+
+	assert.True(t, m.StepBack())
+	assert.Equal(t, uint16(0x10a), m.Flags().PC)
+	assert.Equal(t, uint16(0x1000), m.Flags().SP)
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x0ffe))
+
+	assert.True(t, m.StepBack())
+	assert.True(t, m.StepBack())
+	assert.Equal(t, uint16(0x100), m.Flags().PC)
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x200))
+	assert.False(t, m.StepBack())
+
+	// and forward again
+	m.Run()
+	assert.Equal(t, uint16(1), m.memory.GetWord(0x200))
+	assert.Equal(t, uint16(10), m.memory.GetWord(0x0ffe))
+}
+
+func TestHistoryLimit(t *testing.T) {
+	m := historyMachine()
+	m.EnableHistory(2)
+	m.Run()
+	assert.LessOrEqual(t, m.HistoryLen(), 4)
+	assert.True(t, m.StepBack())
+	assert.True(t, m.StepBack())
+	assert.Equal(t, uint16(0x10a), m.Flags().PC)
+
+	m.EnableHistory(1)
+	assert.Equal(t, 1, m.HistoryLen())
+	m.EnableHistory(0)
+	assert.False(t, m.StepBack())
+}
+
+func TestReverseContinue(t *testing.T) {
+	m := historyMachine()
+	m.Run()
+	id := m.SetBreakpoint(0x105, nil, "")
+	m.ReverseContinue()
+	assert.Equal(t, &Stop{Kind: StopBreakpoint, ID: id, PC: 0x105, Addr: 0x105}, m.Stopped())
+	assert.Equal(t, uint16(5), m.memory.GetWord(0x200))
+
+	// a write watchpoint stops with the writing instruction undone
+	m.DeleteBreakpoint(id)
+	m.Run()
+	wp := m.SetWatchpoint(0x0fff, WatchWrite)
+	m.ReverseContinue()
+	assert.Equal(t, &Stop{Kind: StopWatchWrite, ID: wp, PC: 0x10a, Addr: 0x0fff}, m.Stopped())
+	assert.Equal(t, uint16(0x10a), m.Flags().PC)
+
+	// with nothing to stop at, it goes back to the start
+	m.DeleteBreakpoint(wp)
+	m.ReverseContinue()
+	assert.Nil(t, m.Stopped())
+	assert.Equal(t, uint16(0x100), m.Flags().PC)
+}
+
+func TestLastWriteTo(t *testing.T) {
+	m := historyMachine()
+	m.Run()
+	w, ok := m.LastWriteTo(0x201)
+	assert.True(t, ok)
+	assert.Equal(t, &LastWrite{PC: 0x10d, Addr: 0x200, Size: 2, Old: 10, New: 1, Steps: 1}, w)
+
+	w, ok = m.LastWriteTo(0x0ffe)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(0x10a), w.PC)
+	assert.Equal(t, 2, w.Steps)
+
+	_, ok = m.LastWriteTo(0x300)
+	assert.False(t, ok)
+}
+
+func TestStepBackFaultIsNotRecorded(t *testing.T) {
+	m := historyMachine()
+	m.Protect(0x200, 0x201, ProtectWrite)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, 0, m.HistoryLen())
+}
@@ -0,0 +1,244 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// ImageMagic starts every executable image with a header.  Files without it
+// are legacy raw memory images.
+const ImageMagic = "MPU\x1a"
+
+// ImageVersion is the current (and only) version of the header format.
+const ImageVersion = 1
+
+/*
+Executable image format, all values little endian:
+
+	imageHeader
+	devices     [DeviceCount]uint16   required device ids, ie 0x0100 for stdout
+	segments    [SegmentCount]        segmentHeader followed by Length bytes of data
+	regions     [RegionCount]regionHeader
+
+The checksum is the CRC-32 (IEEE) of everything following the header.
+*/
+type imageHeader struct {
+	Magic        [4]byte
+	Version      uint16
+	Flags        uint16 // reserved, must be zero
+	Entry        uint16
+	SP           uint16
+	FP           uint16
+	DeviceCount  uint16
+	SegmentCount uint16
+	RegionCount  uint16
+	Checksum     uint32
+}
+
+type segmentHeader struct {
+	Addr   uint16
+	Bank   uint8
+	Flags  uint8 // reserved, must be zero
+	Length uint32
+}
+
+type regionHeader struct {
+	Start      uint16
+	End        uint16
+	Protection uint8
+	Reserved   uint8
+}
+
+// Segment is a block of bytes loaded at Addr.  Segments in banks other than
+// 0 must fall within the bank window.
+type Segment struct {
+	Addr uint16
+	Bank int
+	Data []byte
+}
+
+// Image is a program ready to load into a Machine.
+type Image struct {
+	Entry      uint16   // initial PC
+	SP         uint16   // initial stack pointer
+	FP         uint16   // initial frame pointer
+	Devices    []uint16 // device ids the program requires
+	Segments   []Segment
+	Protection []Region
+}
+
+// IsImage returns true if data starts with the executable image header magic.
+func IsImage(data []byte) bool {
+	return len(data) >= len(ImageMagic) && string(data[:len(ImageMagic)]) == ImageMagic
+}
+
+// LoadImage decodes an executable image, Intel HEX or S-record file, or
+// converts a legacy raw memory image if data isn't recognized as any of those.
+func LoadImage(data []byte) (*Image, error) {
+	switch {
+	case IsImage(data):
+		return ParseImage(data)
+	case IsIntelHex(data):
+		return ParseIntelHex(data)
+	case IsSRecord(data):
+		return ParseSRecord(data)
+	}
+	return RawImage(data), nil
+}
+
+// RawImage converts a legacy raw memory image, which is loaded at address 0
+// and has the initial PC/SP/FP in its first 6 bytes.  Anything past 64k is
+// loaded into banks 1, 2, ... in order.
+func RawImage(data []byte) *Image {
+	img := &Image{
+		Entry: readOrDefault(data, PCAddr, 0x100),
+		SP:    readOrDefault(data, SPAddr, 0xffff),
+		FP:    readOrDefault(data, FPAddr, 0),
+	}
+	main := data
+	if len(main) > 65536 {
+		main = main[:65536]
+	}
+	img.Segments = append(img.Segments, Segment{Addr: 0, Data: main})
+	for bank, rest := 1, data[len(main):]; len(rest) > 0; bank++ {
+		n := BankWindowSize
+		if len(rest) < n {
+			n = len(rest)
+		}
+		img.Segments = append(img.Segments, Segment{Addr: BankWindowStart, Bank: bank, Data: rest[:n]})
+		rest = rest[n:]
+	}
+	return img
+}
+
+// ParseImage decodes an image with a header, verifying its version and checksum.
+func ParseImage(data []byte) (*Image, error) {
+	r := bytes.NewReader(data)
+	var h imageHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, errors.New("image header truncated")
+	}
+	if string(h.Magic[:]) != ImageMagic {
+		return nil, errors.New("not an mpu image")
+	}
+	if h.Version != ImageVersion {
+		return nil, fmt.Errorf("unsupported image version %d (expected %d)", h.Version, ImageVersion)
+	}
+	body := data[binary.Size(h):]
+	if sum := crc32.ChecksumIEEE(body); sum != h.Checksum {
+		return nil, fmt.Errorf("image checksum mismatch (header 0x%08x, computed 0x%08x)", h.Checksum, sum)
+	}
+	img := &Image{
+		Entry:   h.Entry,
+		SP:      h.SP,
+		FP:      h.FP,
+		Devices: make([]uint16, h.DeviceCount),
+	}
+	if err := binary.Read(r, binary.LittleEndian, img.Devices); err != nil {
+		return nil, errors.New("image device list truncated")
+	}
+	for i := 0; i < int(h.SegmentCount); i++ {
+		var sh segmentHeader
+		if err := binary.Read(r, binary.LittleEndian, &sh); err != nil {
+			return nil, fmt.Errorf("image segment %d truncated", i)
+		}
+		if int(sh.Addr)+int(sh.Length) > 65536 || int(sh.Bank) >= MaxBanks {
+			return nil, fmt.Errorf("image segment %d out of range (bank %d, 0x%04x+%d)", i, sh.Bank, sh.Addr, sh.Length)
+		}
+		if sh.Bank != 0 && (!inBankWindow(sh.Addr) || int(sh.Addr)+int(sh.Length) > BankWindowEnd+1) {
+			return nil, fmt.Errorf("image segment %d for bank %d is outside the bank window", i, sh.Bank)
+		}
+		seg := Segment{Addr: sh.Addr, Bank: int(sh.Bank), Data: make([]byte, sh.Length)}
+		if _, err := io.ReadFull(r, seg.Data); err != nil {
+			return nil, fmt.Errorf("image segment %d truncated", i)
+		}
+		img.Segments = append(img.Segments, seg)
+	}
+	for i := 0; i < int(h.RegionCount); i++ {
+		var rh regionHeader
+		if err := binary.Read(r, binary.LittleEndian, &rh); err != nil {
+			return nil, fmt.Errorf("image protection region %d truncated", i)
+		}
+		img.Protection = append(img.Protection, Region{Start: rh.Start, End: rh.End, Protection: Protection(rh.Protection)})
+	}
+	return img, nil
+}
+
+// MarshalBinary encodes the image with a header.
+func (img *Image) MarshalBinary() ([]byte, error) {
+	var body bytes.Buffer
+	write := func(v interface{}) {
+		// writes to a bytes.Buffer can't fail
+		_ = binary.Write(&body, binary.LittleEndian, v)
+	}
+	write(img.Devices)
+	for _, seg := range img.Segments {
+		write(segmentHeader{Addr: seg.Addr, Bank: uint8(seg.Bank), Length: uint32(len(seg.Data))})
+		body.Write(seg.Data)
+	}
+	for _, region := range img.Protection {
+		write(regionHeader{Start: region.Start, End: region.End, Protection: uint8(region.Protection)})
+	}
+	h := imageHeader{
+		Version:      ImageVersion,
+		Entry:        img.Entry,
+		SP:           img.SP,
+		FP:           img.FP,
+		DeviceCount:  uint16(len(img.Devices)),
+		SegmentCount: uint16(len(img.Segments)),
+		RegionCount:  uint16(len(img.Protection)),
+		Checksum:     crc32.ChecksumIEEE(body.Bytes()),
+	}
+	copy(h.Magic[:], ImageMagic)
+	var out bytes.Buffer
+	if err := binary.Write(&out, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// NewMachineFromImage creates a machine with the image loaded, its registers
+// initialized, and its protected regions applied.  Returns an error if the
+// image requires a device that isn't registered with the dispatcher.
+func NewMachineFromImage(d *IODispatcher, img *Image) (*Machine, error) {
+	for _, device := range img.Devices {
+		if !d.HasDevice(device) {
+			return nil, fmt.Errorf("image requires device 0x%04x which is not available", device)
+		}
+	}
+	m := NewMachineWithDevices(d, nil)
+	for _, seg := range img.Segments {
+		if seg.Bank == 0 {
+			copy(m.memory.raw[seg.Addr:], seg.Data)
+			continue
+		}
+		bank := m.memory.banks.Bank(seg.Bank)
+		copy(bank[seg.Addr-BankWindowStart:], seg.Data)
+	}
+	m.pc = img.Entry
+	m.sp = img.SP
+	m.fp = img.FP
+	for _, r := range img.Protection {
+		m.Protect(r.Start, r.End, r.Protection)
+	}
+	return m, nil
+}
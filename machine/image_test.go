@@ -0,0 +1,83 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testImage() *Image {
+	return &Image{
+		Entry:   0x200,
+		SP:      0xfff0,
+		FP:      0,
+		Devices: []uint16{0x0100},
+		Segments: []Segment{
+			{Addr: 0x200, Data: []byte{1, 2, 3, 4}},
+			{Addr: BankWindowStart, Bank: 2, Data: []byte{5, 6}},
+		},
+		Protection: []Region{{Start: 0x200, End: 0x203, Protection: ProtectWrite}},
+	}
+}
+
+func TestImageRoundTrip(t *testing.T) {
+	img := testImage()
+	data, err := img.MarshalBinary()
+	assert.Nil(t, err)
+	assert.True(t, IsImage(data))
+	parsed, err := LoadImage(data)
+	assert.Nil(t, err)
+	assert.Equal(t, img, parsed)
+}
+
+func TestImageChecksumMismatch(t *testing.T) {
+	data, _ := testImage().MarshalBinary()
+	data[len(data)-1] ^= 0xff
+	_, err := ParseImage(data)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "checksum mismatch")
+}
+
+func TestImageBadVersion(t *testing.T) {
+	data, _ := testImage().MarshalBinary()
+	data[4] = 9
+	_, err := ParseImage(data)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unsupported image version 9")
+}
+
+func TestImageTruncated(t *testing.T) {
+	data, _ := testImage().MarshalBinary()
+	_, err := ParseImage(data[:10])
+	assert.NotNil(t, err)
+}
+
+func TestLegacyRawImage(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 7)
+	img, err := LoadImage(tester.code)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0x100), img.Entry)
+	assert.Equal(t, uint16(0x1000), img.SP)
+	m, err := NewMachineFromImage(NewDefaultDispatcher(), img)
+	assert.Nil(t, err)
+	m.Run()
+	assert.Equal(t, uint16(7), m.memory.GetWord(0x200))
+}
+
+func TestNewMachineFromImage(t *testing.T) {
+	m, err := NewMachineFromImage(NewDefaultDispatcher(), testImage())
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0x200), m.Flags().PC)
+	assert.Equal(t, byte(3), m.memory.GetByte(0x202))
+	assert.Equal(t, byte(6), m.ReadBankByte(2, BankWindowStart+1))
+	assert.Equal(t, ProtectWrite, m.ProtectionAt(0x201))
+}
+
+func TestImageMissingDevice(t *testing.T) {
+	img := testImage()
+	img.Devices = []uint16{0x7700}
+	_, err := NewMachineFromImage(NewDefaultDispatcher(), img)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "device 0x7700")
+}
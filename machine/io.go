@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -28,6 +29,13 @@ type IOHandler interface {
 	Handle(m Memory, addr uint16) (errCode uint16)
 }
 
+// IORequester is implemented by handlers that hold more than the request,
+// such as where to send output.  The request is unmarshalled into the value
+// returned by Request instead of the handler itself.
+type IORequester interface {
+	Request() interface{}
+}
+
 const (
 	ErrNoErr uint16 = iota
 	ErrInvalidHandler
@@ -47,8 +55,14 @@ type IODispatcher struct {
 }
 
 func NewDefaultDispatcher() *IODispatcher {
+	return NewDefaultDispatcherWithStdout(os.Stdout)
+}
+
+// NewDefaultDispatcherWithStdout is like NewDefaultDispatcher, but programs
+// writing to the stdout device write to w.
+func NewDefaultDispatcherWithStdout(w io.Writer) *IODispatcher {
 	d := NewDispatcher()
-	d.RegisterIOHandler(StdoutDeviceId|StdoutCommandWrite, &StdoutWriteHandler{})
+	d.RegisterIOHandler(StdoutDeviceId|StdoutCommandWrite, &StdoutWriteHandler{W: w})
 	RegisterSDLHandlers(d)
 	return d
 }
@@ -66,6 +80,17 @@ func (d *IODispatcher) RegisterIOHandler(id int, h IOHandler) {
 	d.ioHandlers[id] = h
 }
 
+// HasDevice returns true if any handler is registered for the device, ie
+// the high byte of id.
+func (d *IODispatcher) HasDevice(id uint16) bool {
+	for handler := range d.ioHandlers {
+		if handler&0xff00 == int(id&0xff00) {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *IODispatcher) StatusRegister() Memory {
 	return d.statusRegister
 }
@@ -78,7 +103,11 @@ func (d *IODispatcher) execIORequest(addr uint16) {
 		_, _ = fmt.Fprintf(os.Stderr, "io request to unknown handler (0x%04x)\n", id)
 		return
 	}
-	err := binary.Read(d.memory.BytesReaderAt(addr), binary.LittleEndian, handler)
+	var request interface{} = handler
+	if r, ok := handler.(IORequester); ok {
+		request = r.Request()
+	}
+	err := binary.Read(d.memory.BytesReaderAt(addr), binary.LittleEndian, request)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "io request decode error (handler=0x%04x, error=%s)\n", id, err.Error())
 		d.status = ErrIOError
@@ -86,7 +115,7 @@ func (d *IODispatcher) execIORequest(addr uint16) {
 	}
 	errCode := handler.Handle(d.memory, addr)
 	if d.traceIO || errCode != ErrNoErr {
-		_, _ = fmt.Fprintf(os.Stderr, "io request (handler: 0x%04x, parameters: %v, status: %d)\n", id, handler, errCode)
+		_, _ = fmt.Fprintf(os.Stderr, "io request (handler: 0x%04x, parameters: %v, status: %d)\n", id, request, errCode)
 	}
 	d.status = errCode
 }
@@ -26,6 +26,7 @@ const (
 	IOReqAddr  = 6  // Address of I/O commands are written here to execute
 	IOStatAddr = 8  // I/O status of last command, 0 = success, != 0 error
 	RandAddr   = 10 // Writes are ignored, reads return random uint8/uint16
+	BankAddr   = 12 // Selects the bank of extended memory mapped into the bank window
 )
 
 // BaseDirEnv is the key for an environment variable to use for loading relative files.
@@ -41,7 +42,7 @@ type AssertionFailure struct {
 // Machine implements MPU ... memory processing unit.
 // It supports 27 instructions and 6 addressing modes.
 type Machine struct {
-	memory         Memory            // 64kb of memory + dma overlay
+	memory         *ByteSliceMemory  // 64kb of memory + dma overlay
 	pc             uint16            // program counter ... shadowed on read/write to address $0
 	sp             uint16            // stack pointer ... shadowed on read/write to address $2
 	fp             uint16            // frame pointer ... shadowed on read/write to address $4
@@ -54,6 +55,19 @@ type Machine struct {
 	testMode       bool              // Test mode, enables assertion checking
 	assertionFails int               // Count of assertion failures
 	lastFailure    *AssertionFailure // Details of the last assertion failure
+	opPC           uint16            // address of the instruction currently executing
+	protection     []Protection      // per-address protection flags, nil if nothing is protected
+	stackBounded   bool              // some memory is ProtectStack, so pushes and pops are checked
+	fault          *Fault            // fault that stopped the last run, if any
+	breakpoints    map[uint16][]*Breakpoint
+	watchpoints    []*Watchpoint
+	lastBreakID    int   // id of the last breakpoint or watchpoint added
+	stop           *Stop // breakpoint or watchpoint that stopped the last run, if any
+	onAssertion    func(*AssertionFailure)
+	tracer         Tracer
+	trace          TraceRecord // record for the instruction executing, if tracing
+	history        []historyEntry
+	historyLimit   int // number of instructions kept in history, 0 if not recording
 }
 
 func NewMachineWithDevices(d *IODispatcher, image []byte) *Machine {
@@ -66,8 +80,8 @@ func NewMachineWithDevices(d *IODispatcher, image []byte) *Machine {
 		sp: readOrDefault(image, SPAddr, 0xffff),
 		fp: readOrDefault(image, FPAddr, 0),
 	}
-	var unused1 uint16
-	var unused2 uint16
+	var unused uint16
+	banks := NewBankController()
 	memory := NewByteSliceMemory(
 		[]Memory{
 			&Register{value: &m.pc},
@@ -76,11 +90,16 @@ func NewMachineWithDevices(d *IODispatcher, image []byte) *Machine {
 			d,
 			d.StatusRegister(),
 			NewRNG(time.Now().Unix()),
-			&Register{&unused1}, // Currently, 2 unused registers
-			&Register{&unused2},
+			banks.Register(),
+			&Register{&unused}, // Currently, 1 unused register
 		},
 		image,
 	)
+	// Anything past the first 64k of a raw image is loaded into banks 1, 2, ...
+	memory.banks = banks
+	if len(image) > len(memory.raw) {
+		banks.LoadBanks(image[len(memory.raw):])
+	}
 	m.memory = memory
 	d.memory = memory
 	return m
@@ -95,9 +114,27 @@ func (m *Machine) Memory() Memory {
 	return m.memory
 }
 
+// Run executes instructions from the current PC until a HLT, a single step
+// completes, a memory protection fault stops the machine (see Fault), or a
+// breakpoint or watchpoint is hit (see Stopped).  If the last run stopped at
+// a breakpoint at the PC Run starts from, that breakpoint is ignored so
+// calling Run again continues past it.  Single steps don't check breakpoints.
 func (m *Machine) Run() {
+	m.fault = nil
+	resume := m.stop != nil && m.stop.Kind == StopBreakpoint && m.stop.PC == m.pc
+	m.stop = nil
 	for {
+		m.opPC = m.pc
+		if !resume && !m.step && m.breakpoints != nil && m.checkBreakpoint() {
+			return
+		}
+		resume = false
+		if !m.checkExec(m.pc) {
+			return
+		}
 		in := m.memory.GetByte(m.pc)
+		// restored if the instruction faults
+		sp, fp := m.sp, m.fp
 		var n uint16      // Number of bytes for each operand
 		var bytes uint16  // Total count of operand bytes (to skip pc to next instruction)
 		var target uint16 // the address being updated, ie often the address of value1
@@ -109,15 +146,25 @@ func (m *Machine) Run() {
 		if opCode == Hlt {
 			return
 		}
+		if m.historyLimit > 0 {
+			m.recordHistory()
+		}
 		if m1 != Implied {
 			target, value1, n = m.fetchOperand(m1, m.pc+1)
 			bytes = n
 		}
+		var source uint16 // address of the second operand
 		if m2 != Implied {
-			_, value2, n = m.fetchOperand(m2, m.pc+1+bytes)
+			source, value2, n = m.fetchOperand(m2, m.pc+1+bytes)
 			bytes += n
 		}
+		if m.tracer != nil {
+			m.traceFetch(opCode, m1, target, value1, m2, source, value2, bytes+1)
+		}
 		m.pc = m.pc + uint16(bytes) + 1
+		if m.watchpoints != nil {
+			m.watchOperands(opCode, m1, target, m2, source)
+		}
 
 		switch opCode {
 		case Add: // todo carry
@@ -141,6 +188,9 @@ func (m *Machine) Run() {
 						Expected: value2,
 						Actual:   value1,
 					}
+					if m.onAssertion != nil {
+						m.onAssertion(m.lastFailure)
+					}
 				}
 			}
 		case And:
@@ -156,6 +206,9 @@ func (m *Machine) Run() {
 		case Dec:
 			m.writeTarget(target, value1-1)
 		case Psh:
+			if m.stackBounded && !m.checkPush(m.operandSize()) {
+				break
+			}
 			if m.bytes {
 				m.sp -= 1
 			} else {
@@ -163,9 +216,15 @@ func (m *Machine) Run() {
 			}
 			m.writeTarget(m.sp, value1)
 		case Pop:
+			if m.stackBounded && !m.checkPop(m.sp, m.popSize(m1, value1)) {
+				break
+			}
 			if m1 == ImmediateByte {
 				m.sp += uint16(value1)
 			} else {
+				if m.watchpoints != nil {
+					m.checkWatch(m.sp, m.operandSize(), WatchRead)
+				}
 				m.writeTarget(target, int(m.memory.GetWord(m.sp)))
 				if m.bytes {
 					m.sp += 1
@@ -200,16 +259,28 @@ func (m *Machine) Run() {
 				m.pc = uint16(value1)
 			}
 		case Jsr:
+			if m.stackBounded && !m.checkPush(2) {
+				break
+			}
 			m.pushUint16(m.pc)
 			m.pc = uint16(value1)
 		case Ret:
+			if m.stackBounded && !m.checkPop(m.sp, 2) {
+				break
+			}
 			m.pc = m.popUint16()
 		case Sav:
+			if m.stackBounded && !m.checkPush(2+value1) {
+				break
+			}
 			// push frame pointer, copy sp->fp, adjust stack for locals
 			m.pushUint16(m.fp)
 			m.fp = m.sp
 			m.sp -= uint16(value1)
 		case Rst:
+			if m.stackBounded && !m.checkPop(m.fp, 4) {
+				break
+			}
 			// discard locals from stack, restore fp, ret
 			m.sp = m.fp
 			m.fp = m.popUint16()
@@ -226,6 +297,24 @@ func (m *Machine) Run() {
 			m.assertion = true
 		}
 
+		if m.fault != nil {
+			// leave the machine as it was before the instruction, so it
+			// can be resumed once the cause is fixed
+			m.pc = m.fault.PC
+			m.sp = sp
+			m.fp = fp
+			if m.historyLimit > 0 {
+				m.history = m.history[:len(m.history)-1]
+			}
+			return
+		}
+		if m.tracer != nil {
+			m.trace.Flags = m.Flags()
+			m.tracer(&m.trace)
+		}
+		if m.stop != nil {
+			return
+		}
 		if m.step {
 			break
 		}
@@ -241,12 +330,36 @@ func (m *Machine) ReadInt8(addr uint16) int {
 // such as zero and negative.
 func (m *Machine) writeTarget(addr uint16, value int) {
 	if m.bytes {
+		if !m.checkWrite(addr, 1) {
+			return
+		}
+		if m.historyLimit > 0 {
+			m.recordWrite(addr, uint16(byte(value)), 1)
+		}
 		m.memory.PutByte(addr, byte(value))
 		m.updateFlagsByte(value)
+		if m.tracer != nil {
+			m.traceWrite(addr, uint16(byte(value)), 1)
+		}
+		if m.watchpoints != nil {
+			m.checkWatch(addr, 1, WatchWrite)
+		}
 		//fmt.Printf("  0x%04x <- 0x%02x [z:%t, n:%t]\n", addr, value, m.zero, m.negative)
 	} else {
+		if !m.checkWrite(addr, 2) {
+			return
+		}
+		if m.historyLimit > 0 {
+			m.recordWrite(addr, uint16(value), 2)
+		}
 		m.memory.PutWord(addr, uint16(value))
 		m.updateFlagsWord(value)
+		if m.tracer != nil {
+			m.traceWrite(addr, uint16(value), 2)
+		}
+		if m.watchpoints != nil {
+			m.checkWatch(addr, 2, WatchWrite)
+		}
 		//fmt.Printf("  0x%04x <- 0x%04x [z:%t, n:%t]\n", addr, value, m.zero, m.negative)
 	}
 }
@@ -274,10 +387,25 @@ func (m *Machine) popWord() int {
 
 func (m *Machine) pushUint16(w uint16) {
 	m.sp -= 2
+	if !m.checkWrite(m.sp, 2) {
+		return
+	}
+	if m.historyLimit > 0 {
+		m.recordWrite(m.sp, w, 2)
+	}
 	m.memory.PutWord(m.sp, w)
+	if m.tracer != nil {
+		m.traceWrite(m.sp, w, 2)
+	}
+	if m.watchpoints != nil {
+		m.checkWatch(m.sp, 2, WatchWrite)
+	}
 }
 
 func (m *Machine) popUint16() uint16 {
+	if m.watchpoints != nil {
+		m.checkWatch(m.sp, 2, WatchRead)
+	}
 	val := m.memory.GetWord(m.sp)
 	m.sp += 2
 	return val
@@ -360,11 +488,28 @@ func (m *Machine) AssertionFailures() int {
 	return m.assertionFails
 }
 
+// OnAssertionFailure sets a function to call when an assertion fails, while
+// the stack is still as it was at the failing instruction.
+func (m *Machine) OnAssertionFailure(f func(*AssertionFailure)) {
+	m.onAssertion = f
+}
+
 // LastAssertionFailure returns details of the last assertion failure
 func (m *Machine) LastAssertionFailure() *AssertionFailure {
 	return m.lastFailure
 }
 
+// SetFlags sets the registers and flags, ie to restore a snapshot from Flags.
+func (m *Machine) SetFlags(f Flags) {
+	m.pc = f.PC
+	m.sp = f.SP
+	m.fp = f.FP
+	m.negative = f.Negative
+	m.zero = f.Zero
+	m.carry = f.Carry
+	m.bytes = f.Bytes
+}
+
 // Flags returns a snapshot of the current state of the registers and flags.
 func (m *Machine) Flags() Flags {
 	return Flags{
@@ -80,6 +80,18 @@ func TestReadWriteFP(t *testing.T) {
 	}
 }
 
+func TestSetFlags(t *testing.T) {
+	machine := NewMachine([]byte{})
+	flags := Flags{PC: 0x200, SP: 0x1000, FP: 0x1002, Zero: true, Carry: true}
+	machine.SetFlags(flags)
+	if machine.Flags() != flags {
+		t.Errorf("expected %+v, got %+v", flags, machine.Flags())
+	}
+	if machine.memory.GetWord(SPAddr) != 0x1000 {
+		t.Errorf("expected sp 0x1000, got %0x", machine.memory.GetWord(SPAddr))
+	}
+}
+
 func TestReadByte(t *testing.T) {
 	machine := NewMachine([]byte{20: 7 ^ 0xff + 1})
 	val := machine.ReadInt8(20)
@@ -82,13 +82,17 @@ func (r *Register) Set(w uint16) {
 // and a raw byte slice.  The memory mapped area must be contiguous, and
 // start at offset zero, and must consist of all word-sized memory.
 type ByteSliceMemory struct {
-	mapped      []Memory      // Optional memory-mapped, uh, memory ... indexed by address (incl. addr + 1)
-	mappedCount uint16        // len(mapped), to avoid computing it at GHz/sec
-	raw         []byte        // Raw underlying bytes
-	reader      *bytes.Reader // Re-use reader
+	mapped      []Memory        // Optional memory-mapped, uh, memory ... indexed by address (incl. addr + 1)
+	mappedCount uint16          // len(mapped), to avoid computing it at GHz/sec
+	raw         []byte          // Raw underlying bytes
+	reader      *bytes.Reader   // Re-use reader
+	banks       *BankController // Optional bank switching for the bank window
 }
 
 func (m *ByteSliceMemory) BytesReaderAt(addr uint16) *bytes.Reader {
+	if bank := m.activeBank(addr); bank != nil {
+		return bytes.NewReader(bank[addr-BankWindowStart:])
+	}
 	r := m.reader
 	offset := int64(addr)
 	n, err := r.Seek(offset, io.SeekStart)
@@ -100,6 +104,9 @@ func (m *ByteSliceMemory) BytesReaderAt(addr uint16) *bytes.Reader {
 
 func (m *ByteSliceMemory) ReadZString(addr uint16) string {
 	buf := m.raw[addr:]
+	if bank := m.activeBank(addr); bank != nil {
+		buf = bank[addr-BankWindowStart:]
+	}
 	i := 0
 	for _, b := range buf {
 		if b == 0 {
@@ -127,6 +134,8 @@ func NewByteSliceMemory(registers []Memory, raw []byte) *ByteSliceMemory {
 func (m *ByteSliceMemory) PutByte(addr uint16, b byte) {
 	if addr < m.mappedCount {
 		m.mapped[addr].PutByte(addr, b)
+	} else if m.banked(addr) {
+		*m.cell(addr) = b
 	} else {
 		m.raw[addr] = b
 	}
@@ -136,12 +145,18 @@ func (m *ByteSliceMemory) GetByte(addr uint16) byte {
 	if addr < m.mappedCount {
 		return m.mapped[addr].GetByte(addr)
 	}
+	if m.banked(addr) {
+		return *m.cell(addr)
+	}
 	return m.raw[addr]
 }
 
 func (m *ByteSliceMemory) PutWord(addr uint16, w uint16) {
 	if addr < m.mappedCount {
 		m.mapped[addr].PutWord(addr, w)
+	} else if m.banked(addr) || m.banked(addr+1) {
+		*m.cell(addr) = byte(w & 0xff)
+		*m.cell(addr + 1) = byte(w >> 8 & 0xff)
 	} else {
 		m.raw[addr] = byte(w & 0xff)
 		m.raw[addr+1] = byte(w >> 8 & 0xff)
@@ -152,9 +167,37 @@ func (m *ByteSliceMemory) GetWord(addr uint16) uint16 {
 	if addr < m.mappedCount {
 		return m.mapped[addr].GetWord(addr)
 	}
+	if m.banked(addr) || m.banked(addr+1) {
+		return uint16(*m.cell(addr + 1))<<8 + uint16(*m.cell(addr))
+	}
 	return uint16(m.raw[addr+1])<<8 + uint16(m.raw[addr])
 }
 
+// banked reports if addr is in the bank window while a bank other than main
+// memory is selected.  It's checked inline before falling back to cell, so
+// accesses to main memory stay as cheap as they were without banks.
+func (m *ByteSliceMemory) banked(addr uint16) bool {
+	return inBankWindow(addr) && m.banks != nil && m.banks.selected != 0
+}
+
+// cell returns the storage for addr, which is in the selected bank if addr
+// is within the bank window.
+func (m *ByteSliceMemory) cell(addr uint16) *byte {
+	if bank := m.activeBank(addr); bank != nil {
+		return &bank[addr-BankWindowStart]
+	}
+	return &m.raw[addr]
+}
+
+// activeBank returns the selected bank if addr is in the bank window and a
+// bank other than main memory is selected, otherwise nil.
+func (m *ByteSliceMemory) activeBank(addr uint16) []byte {
+	if !m.banked(addr) {
+		return nil
+	}
+	return m.banks.active()
+}
+
 func readOrDefault(image []byte, addr int, i uint16) uint16 {
 	if len(image) > addr+1 {
 		return uint16(image[addr]) | uint16(image[addr+1])<<8
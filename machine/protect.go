@@ -0,0 +1,196 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Protection is a set of flags restricting how running code may access a byte of memory.
+type Protection byte
+
+const (
+	ProtectNone  Protection = 0
+	ProtectWrite Protection = 1 << 0 // read-only, ie ROM
+	ProtectExec  Protection = 1 << 1 // no-execute
+	ProtectStack Protection = 1 << 2 // within the stack bounds, see SetStackBounds
+)
+
+func (p Protection) String() string {
+	if p == ProtectNone {
+		return "rwx"
+	}
+	var sb strings.Builder
+	sb.WriteString("r")
+	if p&ProtectWrite != 0 {
+		sb.WriteString("-")
+	} else {
+		sb.WriteString("w")
+	}
+	if p&ProtectExec != 0 {
+		sb.WriteString("-")
+	} else {
+		sb.WriteString("x")
+	}
+	if p&ProtectStack != 0 {
+		sb.WriteString(" stack")
+	}
+	return sb.String()
+}
+
+// Region is an inclusive range of addresses sharing the same protection.
+type Region struct {
+	Start      uint16
+	End        uint16
+	Protection Protection
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("0x%04x-0x%04x %s", r.Start, r.End, r.Protection)
+}
+
+// FaultKind identifies the reason the machine stopped with a fault.
+type FaultKind int
+
+const (
+	FaultWrite          FaultKind = iota // write to read-only memory
+	FaultExec                            // instruction fetch from no-execute memory
+	FaultStackOverflow                   // push below the stack bounds
+	FaultStackUnderflow                  // pop above the stack bounds
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultWrite:
+		return "write to read-only memory"
+	case FaultExec:
+		return "execute from no-execute memory"
+	case FaultStackOverflow:
+		return "stack overflow"
+	case FaultStackUnderflow:
+		return "stack underflow"
+	}
+	return fmt.Sprintf("fault(%d)", int(k))
+}
+
+// Fault records an access that was blocked by memory protection.  The machine
+// stops with PC pointing at the offending instruction.
+type Fault struct {
+	Kind FaultKind
+	PC   uint16 // address of the instruction that faulted
+	Addr uint16 // address being accessed, or for a stack fault the new sp
+}
+
+// IsStack returns true for a stack overflow or underflow.
+func (f *Fault) IsStack() bool {
+	return f.Kind == FaultStackOverflow || f.Kind == FaultStackUnderflow
+}
+
+func (f *Fault) Error() string {
+	if f.IsStack() {
+		return fmt.Sprintf("%s (pc=0x%04x, sp=0x%04x)", f.Kind, f.PC, f.Addr)
+	}
+	return fmt.Sprintf("%s at 0x%04x (pc=0x%04x)", f.Kind, f.Addr, f.PC)
+}
+
+// Protect adds the given protection flags to all addresses from start to end inclusive.
+func (m *Machine) Protect(start, end uint16, p Protection) {
+	if m.protection == nil {
+		m.protection = make([]Protection, 65536)
+	}
+	for addr := int(start); addr <= int(end); addr++ {
+		m.protection[addr] |= p
+	}
+	if p&ProtectStack != 0 {
+		m.stackBounded = true
+	}
+}
+
+// Unprotect clears the given protection flags from all addresses from start to end inclusive.
+func (m *Machine) Unprotect(start, end uint16, p Protection) {
+	if m.protection == nil {
+		return
+	}
+	for addr := int(start); addr <= int(end); addr++ {
+		m.protection[addr] &^= p
+	}
+	if p&ProtectStack != 0 {
+		_, _, m.stackBounded = m.StackBounds()
+	}
+}
+
+// ProtectionAt returns the protection flags for a single address.
+func (m *Machine) ProtectionAt(addr uint16) Protection {
+	if m.protection == nil {
+		return ProtectNone
+	}
+	return m.protection[addr]
+}
+
+// ProtectionMap returns the protected regions of memory, in address order.
+// Unprotected memory is omitted.
+func (m *Machine) ProtectionMap() []Region {
+	var regions []Region
+	if m.protection == nil {
+		return regions
+	}
+	for addr := 0; addr < len(m.protection); {
+		p := m.protection[addr]
+		end := addr
+		for end+1 < len(m.protection) && m.protection[end+1] == p {
+			end++
+		}
+		if p != ProtectNone {
+			regions = append(regions, Region{Start: uint16(addr), End: uint16(end), Protection: p})
+		}
+		addr = end + 1
+	}
+	return regions
+}
+
+// Fault returns the fault that stopped the last run, or nil if it stopped normally.
+func (m *Machine) Fault() *Fault {
+	return m.fault
+}
+
+// checkWrite raises a fault if any of the size bytes at addr are read-only.
+func (m *Machine) checkWrite(addr uint16, size int) bool {
+	if m.protection == nil {
+		return true
+	}
+	for i := 0; i < size; i++ {
+		if m.protection[addr+uint16(i)]&ProtectWrite != 0 {
+			m.raise(FaultWrite, addr+uint16(i))
+			return false
+		}
+	}
+	return true
+}
+
+// checkExec raises a fault if the instruction at addr is in no-execute memory.
+func (m *Machine) checkExec(addr uint16) bool {
+	if m.protection == nil || m.protection[addr]&ProtectExec == 0 {
+		return true
+	}
+	m.raise(FaultExec, addr)
+	return false
+}
+
+func (m *Machine) raise(kind FaultKind, addr uint16) {
+	if m.fault == nil {
+		m.fault = &Fault{Kind: kind, PC: m.opPC, Addr: addr}
+	}
+}
@@ -0,0 +1,121 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteToReadOnlyFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 1)
+	tester.emit2(Cpy, Absolute, 0x300, Immediate, 2) // faults, at 0x105
+	tester.emit2(Cpy, Absolute, 0x202, Immediate, 3)
+	m := NewMachine(tester.code)
+	m.Protect(0x300, 0x3ff, ProtectWrite)
+	m.Run()
+
+	fault := m.Fault()
+	assert.NotNil(t, fault)
+	assert.Equal(t, FaultWrite, fault.Kind)
+	assert.Equal(t, uint16(0x105), fault.PC)
+	assert.Equal(t, uint16(0x300), fault.Addr)
+	assert.Equal(t, uint16(0x105), m.Flags().PC)
+	assert.Equal(t, uint16(1), m.memory.GetWord(0x200))
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x300))
+	assert.Equal(t, uint16(0), m.memory.GetWord(0x202))
+}
+
+func TestWordWriteOverlappingReadOnlyFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x2ff, Immediate, 0x1234)
+	m := NewMachine(tester.code)
+	m.Protect(0x300, 0x300, ProtectWrite)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, uint16(0x300), m.Fault().Addr)
+}
+
+func TestPushIntoReadOnlyFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit1(Jsr, Immediate, 0x200)
+	m := NewMachine(tester.code)
+	m.Protect(0x0f00, 0x0fff, ProtectWrite)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, FaultWrite, m.Fault().Kind)
+	assert.Equal(t, uint16(0x0ffe), m.Fault().Addr)
+}
+
+func TestPushFaultLeavesStackUnchanged(t *testing.T) {
+	for _, test := range []struct {
+		op        OpCode
+		code      []byte
+		sp, fp    uint16 // after resuming
+		resumedPC uint16
+	}{
+		{Psh, []byte{EncodeOp(Psh, Immediate, Implied), 0x34, 0x12}, 0x0ffe, 0x0800, 0x103},
+		{Jsr, []byte{EncodeOp(Jsr, Immediate, Implied), 0x00, 0x02}, 0x0ffe, 0x0800, 0x200},
+		{Sav, []byte{EncodeOp(Sav, ImmediateByte, Implied), 4}, 0x0ffa, 0x0ffe, 0x102},
+	} {
+		tester := NewMachineTester(0x100, 0x1000)
+		for _, b := range test.code {
+			tester.writeByte(b)
+		}
+		m := NewMachine(tester.code)
+		m.fp = 0x0800
+		m.Protect(0x0f00, 0x0fff, ProtectWrite)
+		m.Run()
+		assert.NotNil(t, m.Fault(), test.op.String())
+		assert.Equal(t, uint16(0x100), m.Flags().PC, test.op.String())
+		assert.Equal(t, uint16(0x1000), m.Flags().SP, test.op.String())
+		assert.Equal(t, uint16(0x0800), m.Flags().FP, test.op.String())
+
+		// resuming runs the instruction once
+		m.Unprotect(0x0f00, 0x0fff, ProtectWrite)
+		m.Run()
+		assert.Nil(t, m.Fault(), test.op.String())
+		assert.Equal(t, test.resumedPC, m.Flags().PC, test.op.String())
+		assert.Equal(t, test.sp, m.Flags().SP, test.op.String())
+		assert.Equal(t, test.fp, m.Flags().FP, test.op.String())
+	}
+}
+
+func TestExecuteNoExecFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit1(Jmp, Immediate, 0x200)
+	m := NewMachine(tester.code)
+	m.Protect(0x200, 0x2ff, ProtectExec)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, FaultExec, m.Fault().Kind)
+	assert.Equal(t, uint16(0x200), m.Fault().PC)
+	assert.Equal(t, uint16(0x200), m.Fault().Addr)
+}
+
+func TestRunClearsFault(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x300, Immediate, 2)
+	m := NewMachine(tester.code)
+	m.Protect(0x300, 0x300, ProtectWrite)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	m.Unprotect(0x300, 0x300, ProtectWrite)
+	m.Run()
+	assert.Nil(t, m.Fault())
+	assert.Equal(t, uint16(2), m.memory.GetWord(0x300))
+}
+
+func TestProtectionMap(t *testing.T) {
+	m := NewMachine([]byte{})
+	assert.Empty(t, m.ProtectionMap())
+	m.Protect(0x100, 0x1ff, ProtectWrite)
+	m.Protect(0x180, 0x27f, ProtectExec)
+	assert.Equal(t, []Region{
+		{Start: 0x100, End: 0x17f, Protection: ProtectWrite},
+		{Start: 0x180, End: 0x1ff, Protection: ProtectWrite | ProtectExec},
+		{Start: 0x200, End: 0x27f, Protection: ProtectExec},
+	}, m.ProtectionMap())
+	assert.Equal(t, "r-x", ProtectWrite.String())
+	assert.Equal(t, "r--", (ProtectWrite | ProtectExec).String())
+}
@@ -0,0 +1,78 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+// SetStackBounds limits the stack to the addresses from low to high
+// inclusive.  A push, jsr or sav that would move sp below low raises a stack
+// overflow fault, and a pop, ret or rst that would read above high raises a
+// stack underflow, leaving sp unchanged.  The bounds are kept as ProtectStack
+// flags, so they show in the protection map and can be stored in an image.
+func (m *Machine) SetStackBounds(low, high uint16) {
+	m.Unprotect(0, 0xffff, ProtectStack)
+	m.Protect(low, high, ProtectStack)
+}
+
+// StackBounds returns the lowest and highest addresses flagged ProtectStack,
+// and false if there are none.
+func (m *Machine) StackBounds() (low, high uint16, ok bool) {
+	for _, r := range m.ProtectionMap() {
+		if r.Protection&ProtectStack == 0 {
+			continue
+		}
+		if !ok {
+			low = r.Start
+		}
+		high, ok = r.End, true
+	}
+	return low, high, ok
+}
+
+// checkPush raises a stack overflow if the size bytes below sp aren't all
+// within the stack bounds.
+func (m *Machine) checkPush(size int) bool {
+	sp := m.sp - uint16(size)
+	if !m.inStack(sp, size) {
+		m.raise(FaultStackOverflow, sp)
+		return false
+	}
+	return true
+}
+
+// checkPop raises a stack underflow if the size bytes from sp aren't all
+// within the stack bounds.
+func (m *Machine) checkPop(sp uint16, size int) bool {
+	if !m.inStack(sp, size) {
+		m.raise(FaultStackUnderflow, sp+uint16(size))
+		return false
+	}
+	return true
+}
+
+func (m *Machine) inStack(addr uint16, size int) bool {
+	for i := 0; i < size; i++ {
+		if m.protection[addr+uint16(i)]&ProtectStack == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// popSize returns how many bytes a pop instruction removes from the stack.
+func (m *Machine) popSize(mode AddressMode, value int) int {
+	if mode == ImmediateByte {
+		return value
+	}
+	return m.operandSize()
+}
@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushBelowStackBoundsFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1004)
+	tester.emit1(Psh, Immediate, 1)
+	tester.emit1(Psh, Immediate, 2)
+	tester.emit1(Psh, Immediate, 3) // faults, at 0x106
+	m := NewMachine(tester.code)
+	m.SetStackBounds(0x1000, 0x10ff)
+	m.Run()
+
+	fault := m.Fault()
+	assert.NotNil(t, fault)
+	assert.Equal(t, FaultStackOverflow, fault.Kind)
+	assert.Equal(t, uint16(0x106), fault.PC)
+	assert.Equal(t, uint16(0x0ffe), fault.Addr)
+	assert.Equal(t, uint16(0x1000), m.Flags().SP, "sp is left unchanged")
+	assert.Equal(t, "stack overflow (pc=0x0106, sp=0x0ffe)", fault.Error())
+}
+
+func TestJsrAndSavCheckStackBounds(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x1004)
+	tester.emit1(Jsr, Immediate, 0x103) // return address fits
+	tester.emit1(Sav, ImmediateByte, 4) // saved fp fits, locals don't
+	m := NewMachine(tester.code)
+	m.SetStackBounds(0x1000, 0x10ff)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, FaultStackOverflow, m.Fault().Kind)
+	assert.Equal(t, uint16(0x103), m.Fault().PC)
+	assert.Equal(t, uint16(0x0ffc), m.Fault().Addr)
+}
+
+func TestPopAboveStackBoundsFaults(t *testing.T) {
+	tester := NewMachineTester(0x100, 0x10fe)
+	tester.emit1(Pop, Absolute, 0x200)  // pops 0x10fe-0x10ff
+	tester.emit1(Pop, ImmediateByte, 2) // faults, at 0x103
+	m := NewMachine(tester.code)
+	m.SetStackBounds(0x1000, 0x10ff)
+	m.Run()
+	assert.NotNil(t, m.Fault())
+	assert.Equal(t, FaultStackUnderflow, m.Fault().Kind)
+	assert.Equal(t, uint16(0x103), m.Fault().PC)
+	assert.Equal(t, uint16(0x1102), m.Fault().Addr)
+}
+
+func TestStackBounds(t *testing.T) {
+	m := NewMachine(nil)
+	_, _, ok := m.StackBounds()
+	assert.False(t, ok)
+
+	m.Protect(0x2000, 0x2fff, ProtectWrite)
+	m.SetStackBounds(0xf000, 0xffff)
+	low, high, ok := m.StackBounds()
+	assert.True(t, ok)
+	assert.Equal(t, uint16(0xf000), low)
+	assert.Equal(t, uint16(0xffff), high)
+	assert.Equal(t, "0xf000-0xffff rwx stack", m.ProtectionMap()[1].String())
+
+	// a full stack from the top of memory, sp=0, doesn't fault
+	tester := NewMachineTester(0x100, 0)
+	tester.emit1(Psh, Immediate, 1)
+	tester.emit1(Pop, Absolute, 0x200)
+	tester.writeByte(byte(EncodeOp(Hlt, Implied, Implied)))
+	m = NewMachine(tester.code)
+	m.SetStackBounds(0xf000, 0xffff)
+	m.Run()
+	assert.Nil(t, m.Fault())
+	assert.Equal(t, uint16(1), m.Memory().GetWord(0x200))
+}
@@ -15,7 +15,7 @@
 package machine
 
 import (
-	"os"
+	"io"
 )
 
 const (
@@ -23,17 +23,28 @@ const (
 	StdoutCommandWrite = 1
 )
 
-type StdoutWriteHandler struct {
+type StdoutWriteRequest struct {
 	Id       uint16 // 0x0101
 	PZString uint16 // pointer to zero-terminated string
 }
 
+// StdoutWriteHandler writes the string in each request to W, which a
+// debugger can set when it owns the process stdout.
+type StdoutWriteHandler struct {
+	StdoutWriteRequest
+	W io.Writer
+}
+
+func (s *StdoutWriteHandler) Request() interface{} {
+	return &s.StdoutWriteRequest
+}
+
 func (s *StdoutWriteHandler) Handle(m Memory, addr uint16) (errCode uint16) {
 	// This could use copy to avoid creating a string just to print it, but this
 	// was simpler to code want the Memory interface for now.  For a toy 16 bit project
 	// I doubt anything writing to stdout is going to be a bottleneck.
 	str := m.ReadZString(s.PZString)
-	_, err := os.Stdout.WriteString(str)
+	_, err := io.WriteString(s.W, str)
 	if err != nil {
 		return ErrIOError
 	}
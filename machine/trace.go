@@ -0,0 +1,282 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package machine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TraceMagic starts every trace file.
+const TraceMagic = "MPUT"
+
+// TraceVersion is the current version of the trace file format.
+const TraceVersion = 1
+
+// maxInstructionSize is the longest instruction, an opcode and two word operands.
+const maxInstructionSize = 5
+
+// TraceRecord describes one executed instruction.  Operand addresses are the
+// effective addresses after any indirection, and values are as read before
+// the instruction executed.
+type TraceRecord struct {
+	PC         uint16
+	Code       []byte // the instruction's opcode and operand bytes
+	Op         OpCode
+	Mode1      AddressMode
+	Mode2      AddressMode
+	Addr1      uint16
+	Value1     uint16
+	Addr2      uint16
+	Value2     uint16
+	Bytes      bool // operands were bytes, the mode when the instruction was fetched
+	Read1      bool // first operand was read from memory
+	Read2      bool // second operand was read from memory
+	Written    bool // the instruction wrote memory
+	WriteAddr  uint16
+	WriteValue uint16
+	WriteSize  int   // 1 or 2 bytes
+	Flags      Flags // registers and flags after the instruction
+}
+
+// Tracer is called after each instruction executes, see SetTracer.  The
+// record is reused, so it must be copied to be kept.
+type Tracer func(*TraceRecord)
+
+// SetTracer sets a function to call after every instruction, or nil to stop
+// tracing.  Instructions that fault aren't traced.
+func (m *Machine) SetTracer(t Tracer) {
+	m.tracer = t
+}
+
+// AddTracer sets a function to call after every instruction, after the
+// tracer already set if there is one.
+func (m *Machine) AddTracer(t Tracer) {
+	prev := m.tracer
+	if prev == nil {
+		m.tracer = t
+		return
+	}
+	m.tracer = func(r *TraceRecord) {
+		prev(r)
+		t(r)
+	}
+}
+
+// traceFetch starts the record for the instruction being executed.
+func (m *Machine) traceFetch(op OpCode, m1 AddressMode, addr1 uint16, value1 int, m2 AddressMode, addr2 uint16, value2 int, size uint16) {
+	t := &m.trace
+	t.PC = m.opPC
+	t.Code = t.Code[:0]
+	for i := uint16(0); i < size; i++ {
+		t.Code = append(t.Code, m.memory.GetByte(m.opPC+i))
+	}
+	t.Op, t.Mode1, t.Mode2 = op, m1, m2
+	t.Addr1, t.Value1 = addr1, uint16(value1)
+	t.Addr2, t.Value2 = addr2, uint16(value2)
+	t.Bytes = m.bytes
+	t.Read1 = isMemoryMode(m1) && op != Cpy && op != Pop
+	t.Read2 = isMemoryMode(m2)
+	t.Written, t.WriteAddr, t.WriteValue, t.WriteSize = false, 0, 0, 0
+}
+
+// traceWrite records a write by the instruction being executed.
+func (m *Machine) traceWrite(addr uint16, value uint16, size int) {
+	m.trace.Written = true
+	m.trace.WriteAddr = addr
+	m.trace.WriteValue = value
+	m.trace.WriteSize = size
+}
+
+/*
+Trace file format, all values little endian:
+
+	magic   [4]byte  "MPUT"
+	version uint16
+	records [...]traceRecord, to the end of the file
+*/
+type traceRecord struct {
+	PC         uint16
+	Code       [maxInstructionSize]byte // zero padded
+	Size       uint8
+	Addr1      uint16
+	Value1     uint16
+	Addr2      uint16
+	Value2     uint16
+	WriteAddr  uint16
+	WriteValue uint16
+	NextPC     uint16
+	SP         uint16
+	FP         uint16
+	Bits       uint16 // flags and which fields are valid, see below
+}
+
+// Bits in traceRecord.Bits.
+const (
+	traceNegative = 1 << iota
+	traceZero
+	traceCarry
+	traceBytes
+	traceRead1
+	traceRead2
+	traceWritten
+	traceWriteByte
+	traceByteOperands
+)
+
+// TraceWriter writes trace records to a file.
+type TraceWriter struct {
+	w      io.Writer
+	header bool
+}
+
+// NewTraceWriter creates a writer; the header is written with the first record,
+// or by Flush if there are none.
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	return &TraceWriter{w: w}
+}
+
+func (t *TraceWriter) writeHeader() error {
+	if t.header {
+		return nil
+	}
+	t.header = true
+	if _, err := io.WriteString(t.w, TraceMagic); err != nil {
+		return err
+	}
+	return binary.Write(t.w, binary.LittleEndian, uint16(TraceVersion))
+}
+
+// Write appends a record.
+func (t *TraceWriter) Write(r *TraceRecord) error {
+	if err := t.writeHeader(); err != nil {
+		return err
+	}
+	rec := traceRecord{
+		PC:     r.PC,
+		Size:   uint8(len(r.Code)),
+		Addr1:  r.Addr1,
+		Value1: r.Value1,
+		Addr2:  r.Addr2,
+		Value2: r.Value2,
+		NextPC: r.Flags.PC,
+		SP:     r.Flags.SP,
+		FP:     r.Flags.FP,
+	}
+	copy(rec.Code[:], r.Code)
+	bits := []struct {
+		set bool
+		bit uint16
+	}{
+		{r.Flags.Negative, traceNegative},
+		{r.Flags.Zero, traceZero},
+		{r.Flags.Carry, traceCarry},
+		{r.Flags.Bytes, traceBytes},
+		{r.Read1, traceRead1},
+		{r.Read2, traceRead2},
+		{r.Written, traceWritten},
+		{r.Written && r.WriteSize == 1, traceWriteByte},
+		{r.Bytes, traceByteOperands},
+	}
+	for _, b := range bits {
+		if b.set {
+			rec.Bits |= b.bit
+		}
+	}
+	if r.Written {
+		rec.WriteAddr = r.WriteAddr
+		rec.WriteValue = r.WriteValue
+	}
+	return binary.Write(t.w, binary.LittleEndian, &rec)
+}
+
+// Flush writes the header if no records were written, so an empty trace is
+// still a valid file.
+func (t *TraceWriter) Flush() error {
+	return t.writeHeader()
+}
+
+// TraceReader reads records written by TraceWriter.
+type TraceReader struct {
+	r io.Reader
+}
+
+// NewTraceReader checks the trace file header.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	var h struct {
+		Magic   [4]byte
+		Version uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, errors.New("not an mpu trace file")
+	}
+	if string(h.Magic[:]) != TraceMagic {
+		return nil, errors.New("not an mpu trace file")
+	}
+	if h.Version != TraceVersion {
+		return nil, fmt.Errorf("unsupported trace version %d (expected %d)", h.Version, TraceVersion)
+	}
+	return &TraceReader{r: r}, nil
+}
+
+// Read returns the next record, or io.EOF at the end of the trace.
+func (t *TraceReader) Read() (*TraceRecord, error) {
+	var rec traceRecord
+	if err := binary.Read(t.r, binary.LittleEndian, &rec); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errors.New("trace record truncated")
+		}
+		return nil, err
+	}
+	if rec.Size == 0 || rec.Size > maxInstructionSize {
+		return nil, fmt.Errorf("invalid trace record at pc 0x%04x", rec.PC)
+	}
+	op, m1, m2 := DecodeOp(rec.Code[0])
+	r := &TraceRecord{
+		PC:     rec.PC,
+		Code:   append([]byte(nil), rec.Code[:rec.Size]...),
+		Op:     op,
+		Mode1:  m1,
+		Mode2:  m2,
+		Addr1:  rec.Addr1,
+		Value1: rec.Value1,
+		Addr2:  rec.Addr2,
+		Value2: rec.Value2,
+		Bytes:  rec.Bits&traceByteOperands != 0,
+		Read1:  rec.Bits&traceRead1 != 0,
+		Read2:  rec.Bits&traceRead2 != 0,
+		Flags: Flags{
+			PC:       rec.NextPC,
+			SP:       rec.SP,
+			FP:       rec.FP,
+			Negative: rec.Bits&traceNegative != 0,
+			Zero:     rec.Bits&traceZero != 0,
+			Carry:    rec.Bits&traceCarry != 0,
+			Bytes:    rec.Bits&traceBytes != 0,
+		},
+	}
+	if rec.Bits&traceWritten != 0 {
+		r.Written = true
+		r.WriteAddr = rec.WriteAddr
+		r.WriteValue = rec.WriteValue
+		r.WriteSize = 2
+		if rec.Bits&traceWriteByte != 0 {
+			r.WriteSize = 1
+		}
+	}
+	return r, nil
+}
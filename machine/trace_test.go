@@ -0,0 +1,143 @@
+package machine
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func traceProgram(t *testing.T) []TraceRecord {
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.emit2(Cpy, Absolute, 0x200, Immediate, 5)    // 0x100
+	tester.emit2(Add, Absolute, 0x200, Absolute, 0x200) // 0x105
+	tester.emit1(Psh, Absolute, 0x200)                  // 0x10a
+	tester.emit1(Jmp, Immediate, 0x111)                 // 0x10d
+	tester.writeByte(0)
+	m := NewMachine(append(tester.code, 0))
+	var records []TraceRecord
+	m.SetTracer(func(r *TraceRecord) {
+		rec := *r
+		rec.Code = append([]byte(nil), r.Code...)
+		records = append(records, rec)
+	})
+	m.Run()
+	return records
+}
+
+func TestTracer(t *testing.T) {
+	records := traceProgram(t)
+	assert.Len(t, records, 4)
+
+	cpy := records[0]
+	assert.Equal(t, uint16(0x100), cpy.PC)
+	assert.Equal(t, Cpy, cpy.Op)
+	assert.Len(t, cpy.Code, 5)
+	assert.False(t, cpy.Read1)
+	assert.False(t, cpy.Read2)
+	assert.True(t, cpy.Written)
+	assert.Equal(t, uint16(0x200), cpy.WriteAddr)
+	assert.Equal(t, uint16(5), cpy.WriteValue)
+	assert.Equal(t, 2, cpy.WriteSize)
+	assert.Equal(t, uint16(0x105), cpy.Flags.PC)
+
+	add := records[1]
+	assert.True(t, add.Read1)
+	assert.True(t, add.Read2)
+	assert.Equal(t, uint16(0x200), add.Addr2)
+	assert.Equal(t, uint16(5), add.Value2)
+	assert.Equal(t, uint16(10), add.WriteValue)
+
+	psh := records[2]
+	assert.Equal(t, uint16(0x0ffe), psh.WriteAddr)
+	assert.Equal(t, uint16(0x0ffe), psh.Flags.SP)
+
+	jmp := records[3]
+	assert.False(t, jmp.Written)
+	assert.Equal(t, uint16(0x111), jmp.Flags.PC)
+}
+
+func TestTraceFileRoundTrip(t *testing.T) {
+	records := traceProgram(t)
+	var buf bytes.Buffer
+	w := NewTraceWriter(&buf)
+	for i := range records {
+		assert.Nil(t, w.Write(&records[i]))
+	}
+	assert.Nil(t, w.Flush())
+
+	r, err := NewTraceReader(&buf)
+	assert.Nil(t, err)
+	for i := range records {
+		rec, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, records[i], *rec)
+	}
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestTraceFileErrors(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, NewTraceWriter(&buf).Flush())
+	r, err := NewTraceReader(bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = NewTraceReader(bytes.NewReader([]byte("MPU\x1a\x01\x00")))
+	assert.EqualError(t, err, "not an mpu trace file")
+	_, err = NewTraceReader(bytes.NewReader([]byte("MPUT\x02\x00")))
+	assert.EqualError(t, err, "unsupported trace version 2 (expected 1)")
+
+	r, _ = NewTraceReader(bytes.NewReader(append(buf.Bytes(), 0, 1, 2)))
+	_, err = r.Read()
+	assert.EqualError(t, err, "trace record truncated")
+}
+
+func TestAddTracer(t *testing.T) {
+	m := NewMachine(nil)
+	var calls []string
+	m.AddTracer(func(r *TraceRecord) { calls = append(calls, "first") })
+	m.AddTracer(func(r *TraceRecord) { calls = append(calls, "second") })
+	m.tracer(&m.trace)
+	assert.Equal(t, []string{"first", "second"}, calls)
+}
+
+func TestTraceByteMode(t *testing.T) {
+	// operand sizes come from the mode the instruction was fetched in, not
+	// the flags after it
+	tester := NewMachineTester(0x100, 0x1000)
+	tester.writeByte(EncodeOp(Seb, Implied, Implied))   // 0x100
+	tester.emit2(Add, Absolute, 0x200, Absolute, 0x202) // 0x101
+	tester.writeByte(EncodeOp(Clb, Implied, Implied))   // 0x106
+	tester.emit2(Add, Absolute, 0x200, Absolute, 0x202) // 0x107
+	m := NewMachine(append(tester.code, 0))
+	var records []TraceRecord
+	m.SetTracer(func(r *TraceRecord) {
+		records = append(records, *r)
+	})
+	m.Run()
+	assert.Len(t, records, 4)
+	assert.False(t, records[0].Bytes)
+	assert.True(t, records[0].Flags.Bytes)
+	assert.True(t, records[1].Bytes)
+	assert.Equal(t, 1, records[1].WriteSize)
+	assert.True(t, records[2].Bytes)
+	assert.False(t, records[2].Flags.Bytes)
+	assert.False(t, records[3].Bytes)
+
+	var buf bytes.Buffer
+	w := NewTraceWriter(&buf)
+	for i := range records {
+		assert.Nil(t, w.Write(&records[i]))
+	}
+	r, err := NewTraceReader(&buf)
+	assert.Nil(t, err)
+	for i := range records {
+		rec, err := r.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, records[i].Bytes, rec.Bytes)
+	}
+}
@@ -15,14 +15,18 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/gdb"
 	"github.com/jsando/mpu/machine"
 	"github.com/jsando/mpu/test"
 )
@@ -50,11 +54,28 @@ func main() {
 
 	buildCmd := flag.NewFlagSet("build", flag.ContinueOnError)
 	outputFile := buildCmd.String("o", "", "output file (default: input.bin)")
+	buildFormat := buildCmd.String("format", "raw", "output format: raw, bin, ihex or srec")
 	buildHelp := buildCmd.Bool("help", false, "show help for build command")
 
 	runCmd := flag.NewFlagSet("run", flag.ContinueOnError)
 	sysmon := runCmd.Bool("m", false, "open system monitor/debugger")
 	runHelp := runCmd.Bool("help", false, "show help for run command")
+	tuiMode := runCmd.Bool("tui", false, "open the monitor as a full screen terminal UI")
+	stackBounds := runCmd.String("stack", "", "limit the stack to this address range, ie 0xf000-0xffff")
+	scriptFile := runCmd.String("script", "", "run monitor commands from this file")
+	gdbAddr := runCmd.String("gdb", "", "serve the gdb remote protocol on this address")
+	traceFile := runCmd.String("trace", "", "write an execution trace to this file")
+	traceRange := runCmd.String("trace-range", "", "only trace instructions in this address range, ie 0x100-0x1ff")
+	traceFunc := runCmd.String("trace-func", "", "only trace instructions in this function")
+	traceMax := runCmd.Int("trace-max", 0, "stop tracing after this many instructions")
+	runProfile := runCmd.String("profile", "", "write a pprof profile of the instructions executed to this file")
+	runProfileText := runCmd.String("profile-text", "", "write a text profile report to this file, - for stdout")
+	runMemcheck := runCmd.Bool("memcheck", false, "warn about reads of uninitialized memory and writes to executed code")
+	runHeatmap := runCmd.String("heatmap", "", "write a map of memory accesses to this file, .png for an image")
+
+	traceCmd := flag.NewFlagSet("trace", flag.ContinueOnError)
+	traceDebug := traceCmd.String("dbg", "", "debug file for symbols (default: next to the trace file)")
+	traceHelp := traceCmd.Bool("help", false, "show help for trace command")
 
 	fmtCmd := flag.NewFlagSet("fmt", flag.ContinueOnError)
 	rewrite := fmtCmd.Bool("w", false, "rewrite original file (not yet implemented)")
@@ -64,12 +85,37 @@ func main() {
 	testVerbose := testCmd.Bool("v", false, "verbose output")
 	testColor := testCmd.Bool("color", true, "colorize output")
 	testHelp := testCmd.Bool("help", false, "show help for test command")
+	testProfile := testCmd.String("profile", "", "write a pprof profile of the instructions executed to this file")
+	testProfileText := testCmd.String("profile-text", "", "write a text profile report to this file, - for stdout")
+	testMemcheck := testCmd.Bool("memcheck", false, "warn about reads of uninitialized memory and writes to executed code")
+	testHeatmap := testCmd.String("heatmap", "", "write a map of memory accesses to this file, .png for an image")
+	testCover := testCmd.Bool("cover", false, "report the percentage of lines and branches the tests executed")
+	testCoverProfile := testCmd.String("coverprofile", "", "write a coverage profile to this file (implies -cover)")
+
+	disasmCmd := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	disasmSym := disasmCmd.String("sym", "", "debug file for labels and code addresses")
+	disasmOutput := disasmCmd.String("o", "", "output file (default: stdout)")
+	disasmHelp := disasmCmd.Bool("help", false, "show help for disasm command")
+
+	objdumpCmd := flag.NewFlagSet("objdump", flag.ContinueOnError)
+	objdumpSym := objdumpCmd.String("sym", "", "debug file for symbols (default: the .dbg next to the binary)")
+	objdumpHex := objdumpCmd.Bool("hex", true, "include a hex dump of each segment")
+	objdumpDiff := objdumpCmd.Bool("diff", false, "compare two binaries")
+	objdumpHelp := objdumpCmd.Bool("help", false, "show help for objdump command")
+
+	coverCmd := flag.NewFlagSet("cover", flag.ContinueOnError)
+	coverHTML := coverCmd.String("html", "", "write the annotated source as HTML to this file")
+	coverHelp := coverCmd.Bool("help", false, "show help for cover command")
 
 	// Custom usage for subcommands
 	buildCmd.Usage = func() { printBuildUsage() }
 	runCmd.Usage = func() { printRunUsage() }
 	fmtCmd.Usage = func() { printFmtUsage() }
 	testCmd.Usage = func() { printTestUsage() }
+	traceCmd.Usage = func() { printTraceUsage() }
+	coverCmd.Usage = func() { printCoverUsage() }
+	disasmCmd.Usage = func() { printDisasmUsage() }
+	objdumpCmd.Usage = func() { printObjdumpUsage() }
 
 	if len(os.Args) <= 1 {
 		printUsage()
@@ -89,9 +135,9 @@ func main() {
 		var output = *outputFile
 		if output == "" {
 			file := inputs[0]
-			output = strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())) + ".bin"
+			output = strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())) + outputExt(*buildFormat)
 		}
-		build(inputs, output)
+		build(inputs, output, *buildFormat)
 	case "run":
 		if err := runCmd.Parse(os.Args[2:]); err != nil {
 			os.Exit(1)
@@ -101,7 +147,10 @@ func main() {
 			os.Exit(0)
 		}
 		inputs := getInputs(runCmd)
-		run(inputs, *sysmon)
+		run(inputs, *sysmon || *tuiMode || *scriptFile != "", *tuiMode, *scriptFile, *stackBounds, *gdbAddr, traceOptions{
+			file: *traceFile, addrRange: *traceRange, function: *traceFunc, max: *traceMax,
+		}, profileOptions{file: *runProfile, text: *runProfileText},
+			memcheckOptions{warn: *runMemcheck, heatmap: *runHeatmap})
 	case "fmt":
 		if err := fmtCmd.Parse(os.Args[2:]); err != nil {
 			os.Exit(1)
@@ -121,7 +170,76 @@ func main() {
 			os.Exit(0)
 		}
 		inputs := getInputs(testCmd)
-		runTests(inputs, *testVerbose, *testColor)
+		runTests(inputs, *testVerbose, *testColor, *testCover || *testCoverProfile != "", *testCoverProfile,
+			profileOptions{file: *testProfile, text: *testProfileText},
+			memcheckOptions{warn: *testMemcheck, heatmap: *testHeatmap})
+	case "cover":
+		if err := coverCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if *coverHelp {
+			printCoverUsage()
+			os.Exit(0)
+		}
+		if coverCmd.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: expected one coverage profile\n\n")
+			printCoverUsage()
+			os.Exit(1)
+		}
+		showCoverage(coverCmd.Arg(0), *coverHTML)
+	case "trace":
+		if err := traceCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if *traceHelp {
+			printTraceUsage()
+			os.Exit(0)
+		}
+		if traceCmd.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: expected one trace file\n\n")
+			printTraceUsage()
+			os.Exit(1)
+		}
+		showTrace(traceCmd.Arg(0), *traceDebug)
+	case "disasm":
+		if err := disasmCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if *disasmHelp {
+			printDisasmUsage()
+			os.Exit(0)
+		}
+		if disasmCmd.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: expected one binary file\n\n")
+			printDisasmUsage()
+			os.Exit(1)
+		}
+		disassemble(disasmCmd.Arg(0), *disasmSym, *disasmOutput)
+	case "objdump":
+		if err := objdumpCmd.Parse(os.Args[2:]); err != nil {
+			os.Exit(1)
+		}
+		if *objdumpHelp {
+			printObjdumpUsage()
+			os.Exit(0)
+		}
+		if *objdumpDiff {
+			if objdumpCmd.NArg() != 2 {
+				fmt.Fprintf(os.Stderr, "Error: -diff expects two binary files\n\n")
+				printObjdumpUsage()
+				os.Exit(1)
+			}
+			objdiff(objdumpCmd.Arg(0), objdumpCmd.Arg(1))
+			break
+		}
+		if objdumpCmd.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Error: expected one binary file\n\n")
+			printObjdumpUsage()
+			os.Exit(1)
+		}
+		objdump(objdumpCmd.Arg(0), *objdumpSym, *objdumpHex)
+	case "dap":
+		debugAdapter()
 	default:
 		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n\n", os.Args[1])
 		printUsage()
@@ -141,6 +259,11 @@ func printUsage() {
 	fmt.Println("  run      Execute a program")
 	fmt.Println("  fmt      Format assembly source code")
 	fmt.Println("  test     Run unit tests in assembly files")
+	fmt.Println("  trace    Show an execution trace written by run --trace")
+	fmt.Println("  cover    Show the source annotated with a coverage profile from test")
+	fmt.Println("  disasm   Disassemble a binary into source that builds the same binary")
+	fmt.Println("  objdump  Show a binary's segments, symbols and contents, or compare two")
+	fmt.Println("  dap      Serve the Debug Adapter Protocol on stdin/stdout")
 	fmt.Println()
 	fmt.Println("Global Options:")
 	fmt.Println("  --help, -h     Show this help message")
@@ -162,6 +285,11 @@ func printBuildUsage() {
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -o <file>    Output filename (default: first_input.bin)")
+	fmt.Println("  -format <f>  Output format (default: raw)")
+	fmt.Println("                 raw - memory image loaded at address 0")
+	fmt.Println("                 bin - executable image with header, only written segments")
+	fmt.Println("                 ihex - Intel HEX, only written segments")
+	fmt.Println("                 srec - Motorola S-records, only written segments")
 	fmt.Println("  --help       Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
@@ -178,18 +306,60 @@ func printRunUsage() {
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -m         Open system monitor/debugger for single-stepping")
+	fmt.Println("  --tui      Open the monitor as a full screen terminal UI (implies -m)")
+	fmt.Println("  --script f Run monitor commands from file f (implies -m)")
+	fmt.Println("  --stack start-end")
+	fmt.Println("             Fault if the stack grows below start or pops above end")
+	fmt.Println("  --gdb addr Wait for a gdb remote protocol connection on addr (ie :1234)")
+	fmt.Println("  --trace f  Write a trace of each executed instruction to file f")
+	fmt.Println("  --trace-range start-end")
+	fmt.Println("             Only trace instructions between two addresses or labels")
+	fmt.Println("  --trace-func name")
+	fmt.Println("             Only trace instructions in a function")
+	fmt.Println("  --trace-max n")
+	fmt.Println("             Stop tracing after n instructions")
+	fmt.Println("  --profile f")
+	fmt.Println("             Write a pprof profile of the instructions executed to file f")
+	fmt.Println("  --profile-text f")
+	fmt.Println("             Write instruction counts per function and line to file f (- for stdout)")
+	fmt.Println("  --memcheck Warn about reads of uninitialized memory and writes to executed code")
+	fmt.Println("  --heatmap f")
+	fmt.Println("             Write a map of the memory read, written and executed to file f,")
+	fmt.Println("             as an image if f ends in .png, otherwise as text (- for stdout)")
 	fmt.Println("  --help     Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  mpu run example/hello.s")
 	fmt.Println("  mpu run game.bin")
 	fmt.Println("  mpu run -m debug_this.s")
+	fmt.Println("  mpu run -m --tui debug_this.s")
+	fmt.Println("  mpu run -m --script check.txt debug_this.s")
+	fmt.Println("  mpu run --gdb :1234 debug_this.s")
+	fmt.Println("  mpu run --trace out.trace --trace-max 1000 debug_this.s")
+	fmt.Println("  mpu run --profile out.prof game.s && go tool pprof -http=: out.prof")
+	fmt.Println("  mpu run --memcheck --heatmap memory.png game.s")
 	fmt.Println()
 	fmt.Println("Graphics programs:")
 	fmt.Println("  - Press ESC to quit")
 	fmt.Println("  - Press Ctrl-C in terminal for non-graphics programs")
 }
 
+func printTraceUsage() {
+	fmt.Println("Usage: mpu trace [options] <file.trace>")
+	fmt.Println()
+	fmt.Println("Shows a trace written by 'mpu run --trace' as text, one instruction per line:")
+	fmt.Println("the address and its symbol, the disassembled instruction, the memory it read")
+	fmt.Println("(name=value) and wrote (name<-value), then the registers and flags after it.")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -dbg file  Debug file for symbols (default: the .dbg next to the trace)")
+	fmt.Println("  --help     Show this help message")
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  mpu trace out.trace")
+	fmt.Println("  mpu trace -dbg game.dbg out.trace")
+}
+
 func printFmtUsage() {
 	fmt.Println("Usage: mpu fmt [options] <file.s>")
 	fmt.Println()
@@ -214,12 +384,81 @@ func printTestUsage() {
 	fmt.Println("Options:")
 	fmt.Println("  -v         Show verbose output (display all test names)")
 	fmt.Println("  -color     Colorize output (default: true)")
+	fmt.Println("  -cover     Report the percentage of lines and branches executed in each file")
+	fmt.Println("  -coverprofile f")
+	fmt.Println("             Write a coverage profile to file f for 'mpu cover' (implies -cover)")
+	fmt.Println("  -profile f Write a pprof profile of the instructions the tests executed to file f")
+	fmt.Println("  -profile-text f")
+	fmt.Println("             Write instruction counts per function and line to file f (- for stdout)")
+	fmt.Println("  -memcheck  Warn about reads of uninitialized memory and writes to executed code")
+	fmt.Println("  -heatmap f Write a map of the memory read, written and executed to file f")
 	fmt.Println("  --help     Show this help message")
 	fmt.Println()
 	fmt.Println("Examples:")
 	fmt.Println("  mpu test tests.s")
 	fmt.Println("  mpu test -v tests/*.s")
 	fmt.Println("  mpu test -color=false tests.s > results.txt")
+	fmt.Println("  mpu test -profile-text - tests.s")
+	fmt.Println("  mpu test -coverprofile cover.out tests.s")
+}
+
+func printDisasmUsage() {
+	fmt.Println("Usage: mpu disasm [options] <file.bin>")
+	fmt.Println()
+	fmt.Println("Disassembles a binary into source that 'mpu build' assembles back to the same")
+	fmt.Println("binary.  Code is found by following jumps and calls from the entry point, and")
+	fmt.Println("everything else is written as data (db, dw, ds).  Jump targets and the addresses")
+	fmt.Println("instructions use get generated labels, Lxxxx for code and Dxxxx for data.")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -sym file  Debug file written by build, for label names and code only reached")
+	fmt.Println("             indirectly")
+	fmt.Println("  -o file    Output file (default: stdout)")
+	fmt.Println("  --help     Show this help message")
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  mpu disasm game.bin")
+	fmt.Println("  mpu disasm -sym game.dbg -o game.s game.bin")
+}
+
+func printObjdumpUsage() {
+	fmt.Println("Usage: mpu objdump [options] <file.bin>")
+	fmt.Println("       mpu objdump -diff <old.bin> <new.bin>")
+	fmt.Println()
+	fmt.Println("Shows a binary's initial registers and where they come from, its devices,")
+	fmt.Println("protected regions and segments, its symbols and functions if the debug file")
+	fmt.Println("written by build is next to it, and a hex dump of each segment with labels.")
+	fmt.Println()
+	fmt.Println("With -diff, reports how the second binary differs from the first: registers,")
+	fmt.Println("segments, and each label or function that was added, removed, moved, resized")
+	fmt.Println("or changed.  Exits with status 1 if they differ.")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -sym file  Debug file for symbols (default: the .dbg next to the binary)")
+	fmt.Println("  -hex=false Leave out the hex dump")
+	fmt.Println("  -diff      Compare two binaries")
+	fmt.Println("  --help     Show this help message")
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  mpu objdump game.bin")
+	fmt.Println("  mpu objdump -hex=false -sym game.dbg game.hex")
+	fmt.Println("  mpu objdump -diff old/game.bin game.bin")
+}
+
+func printCoverUsage() {
+	fmt.Println("Usage: mpu cover [options] <cover.out>")
+	fmt.Println()
+	fmt.Println("Shows the source files in a profile written by 'mpu test -coverprofile', with")
+	fmt.Println("the number of times each line executed, '#####' for lines with code that never")
+	fmt.Println("executed, and how often each conditional jump was taken and not taken.")
+	fmt.Println()
+	fmt.Println("Options:")
+	fmt.Println("  -html f    Write the annotated source as HTML to file f instead")
+	fmt.Println("  --help     Show this help message")
+	fmt.Println()
+	fmt.Println("Examples:")
+	fmt.Println("  mpu cover cover.out")
+	fmt.Println("  mpu cover -html cover.html cover.out")
 }
 
 func format(inputs []*os.File, rewrite bool) {
@@ -272,7 +511,7 @@ func getInputs(flagSet *flag.FlagSet) []*os.File {
 
 // Run can be invoked with 1 file that doesn't end with .s, or a list
 // of files ending with .s
-func run(inputs []*os.File, monitor bool) {
+func run(inputs []*os.File, monitor bool, tui bool, script string, stack string, gdbAddr string, trace traceOptions, prof profileOptions, check memcheckOptions) {
 	bin := false
 	src := false
 	for _, f := range inputs {
@@ -293,28 +532,125 @@ func run(inputs []*os.File, monitor bool) {
 		os.Exit(1)
 	}
 
-	var bytes []byte
-	var err error
+	var img *machine.Image
+	var debug *asm.DebugFile
 	setBaseDirFromInputFile(inputs[0].Name())
 	if src {
 		linker, _ := compile(inputs)
-		bytes = linker.Code()
+		img = linker.Image()
+		debug = linker.DebugFile()
 	} else {
 		// run program
-		bytes, err = ioutil.ReadAll(inputs[0])
+		data, err := ioutil.ReadAll(inputs[0])
 		if err != nil {
 			panic(err)
 		}
+		img, err = machine.LoadImageFile(inputs[0].Name(), data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot load '%s': %s\n", inputs[0].Name(), err)
+			os.Exit(1)
+		}
+		debug = loadDebugFile(asm.DebugFileName(inputs[0].Name()))
 	}
-	m := machine.NewMachine(bytes)
-	if monitor {
-		monitor := &Monitor{machine: m, memory: m.Memory()}
-		monitor.Run()
+	var stdout io.Writer = os.Stdout
+	console := &consoleBuffer{}
+	if tui {
+		stdout = console
+	}
+	m := newMachine(img, stdout)
+	if stack != "" {
+		low, high, err := newMonitor(m, debug).addressRange(stack)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: stack %s\n", err)
+			os.Exit(1)
+		}
+		m.SetStackBounds(uint16(low), uint16(high))
+	}
+	finishTrace := func() {}
+	if trace.file != "" {
+		var err error
+		if finishTrace, err = startTrace(m, debug, trace); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	finishProfile := startProfile(m, debug, inputs[0].Name(), prof)
+	finishMemcheck := startMemcheck(m, img, debug, check)
+	finish := func() {
+		finishTrace()
+		finishProfile()
+		finishMemcheck()
+	}
+	defer finish()
+	if gdbAddr != "" {
+		err := gdb.ListenAndServe(gdbAddr, m, func(addr net.Addr) {
+			fmt.Fprintf(os.Stderr, "Waiting for gdb on %s\n", addr)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	} else if tui {
+		if err := runTUI(newMonitor(m, debug), console); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+	} else if monitor {
+		monitor := newMonitor(m, debug)
+		in, interactive := io.Reader(os.Stdin), isTerminal(os.Stdin)
+		if script != "" {
+			f, err := os.Open(script)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			in, interactive = f, false
+		}
+		if !monitor.Run(in, interactive) {
+			finish()
+			os.Exit(1)
+		}
 	} else {
 		m.Run()
 		//fmt.Printf("Program completed, memory dump:\n")
 		//m.Dump(os.Stdout, 0, 65535)
+		if fault := m.Fault(); fault != nil {
+			finish()
+			fmt.Fprintf(os.Stderr, "Error: machine fault: %s\n", fault)
+			if debug != nil {
+				for i, frame := range asm.Backtrace(m, debug) {
+					fmt.Fprintf(os.Stderr, "  #%d %s\n", i, frame)
+				}
+			}
+			os.Exit(1)
+		}
+	}
+}
+
+// loadDebugFile reads the debug file written by build next to a binary.  It's
+// optional, so returns nil if it doesn't exist or can't be read.
+func loadDebugFile(name string) *asm.DebugFile {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	debug, err := asm.ReadDebugFile(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring '%s': %s\n", name, err)
+		return nil
+	}
+	return debug
+}
+
+func newMachine(img *machine.Image, stdout io.Writer) *machine.Machine {
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcherWithStdout(stdout), img)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
 	}
+	return m
 }
 
 func setBaseDirFromInputFile(path string) {
@@ -324,30 +660,78 @@ func setBaseDirFromInputFile(path string) {
 
 func compile(inputs []*os.File) (*asm.Linker, []string) {
 	parser := asm.NewParser(newTokenReader(inputs))
-	parser.Parse()
+	linker, err := asm.Build(parser)
 	parser.PrintErrors()
-	if parser.HasErrors() {
-		os.Exit(1)
+	if linker != nil {
+		linker.PrintMessages()
 	}
-	linker := asm.NewLinker(parser.Statements())
-	linker.Link()
-	linker.PrintMessages()
-	if linker.HasErrors() {
+	if err != nil {
 		os.Exit(1)
 	}
 	return linker, parser.Files()
 }
 
-func build(inputs []*os.File, outputName string) {
+func build(inputs []*os.File, outputName string, format string) {
+	var code []byte
+	var err error
+	switch format {
+	case "bin", "raw", "ihex", "srec":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown output format '%s'\n", format)
+		os.Exit(1)
+	}
 	linker, files := compile(inputs)
 	asm.WriteListing(files, linker)
-	code := linker.Code()
-	err := ioutil.WriteFile(outputName, code, 0644)
+	switch format {
+	case "bin":
+		code, err = linker.Image().MarshalBinary()
+	case "ihex", "srec":
+		var buf bytes.Buffer
+		if format == "ihex" {
+			err = linker.Image().WriteIntelHex(&buf)
+		} else {
+			err = linker.Image().WriteSRecord(&buf)
+		}
+		code = buf.Bytes()
+	default:
+		code = linker.Code()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to encode image: %s\n", err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(outputName, code, 0644)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: failed to write output file '%s': %s\n", outputName, err)
 		os.Exit(1)
 	}
 	fmt.Printf("Successfully wrote %d bytes to %s\n", len(code), outputName)
+	writeDebugFile(asm.DebugFileName(outputName), linker.DebugFile())
+}
+
+func writeDebugFile(name string, debug *asm.DebugFile) {
+	f, err := os.Create(name)
+	if err == nil {
+		err = debug.Write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write debug file '%s': %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// outputExt returns the default output file extension for a build format.
+func outputExt(format string) string {
+	switch format {
+	case "ihex":
+		return ".hex"
+	case "srec":
+		return ".srec"
+	}
+	return ".bin"
 }
 
 func newTokenReader(inputs []*os.File) *asm.Input {
@@ -358,7 +742,7 @@ func newTokenReader(inputs []*os.File) *asm.Input {
 	return asm.NewInput(tr)
 }
 
-func runTests(inputs []*os.File, verbose bool, color bool) {
+func runTests(inputs []*os.File, verbose bool, color bool, cover bool, coverProfile string, prof profileOptions, check memcheckOptions) {
 	// Parse all files
 	parser := asm.NewParser(newTokenReader(inputs))
 	parser.Parse()
@@ -387,17 +771,17 @@ func runTests(inputs []*os.File, verbose bool, color bool) {
 		os.Exit(1)
 	}
 
-	// Prepare code for execution
-	code := linker.Code()
-	if len(code) < 65536 {
-		padded := make([]byte, 65536)
-		copy(padded, code)
-		code = padded
-	}
-
 	// Create machine and executor
-	m := machine.NewMachine(code)
+	m := newMachine(linker.Image(), os.Stdout)
 	executor := test.NewTestExecutor(m, suite, linker.Symbols(), linker.DebugInfo())
+	executor.SetDebugFile(linker.DebugFile())
+	finishProfile := startProfile(m, linker.DebugFile(), inputs[0].Name(), prof)
+	finishMemcheck := startMemcheck(m, linker.Image(), linker.DebugFile(), check)
+	var coverage *test.Coverage
+	if cover {
+		coverage = test.NewCoverage(linker.DebugInfo(), m.Memory())
+		m.AddTracer(coverage.Record)
+	}
 
 	// Run tests
 	err = executor.Run()
@@ -409,6 +793,14 @@ func runTests(inputs []*os.File, verbose bool, color bool) {
 	// Format and display results
 	formatter := test.NewTerminalFormatter(verbose, color)
 	formatter.Format(executor.Results(), os.Stdout)
+	finishProfile()
+	finishMemcheck()
+	if coverage != nil {
+		coverage.WriteSummary(os.Stdout)
+		if coverProfile != "" {
+			writeCoverProfile(coverProfile, coverage)
+		}
+	}
 
 	// Exit with appropriate code
 	_, failed := executor.Summary()
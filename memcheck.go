@@ -0,0 +1,113 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/jsando/mpu/memcheck"
+)
+
+// memcheckOptions are the run and test flags that control memory checking.
+type memcheckOptions struct {
+	warn    bool   // warn about uninitialized reads and writes to executed code
+	heatmap string // file for a map of memory accesses, or "" to not write one
+}
+
+// startMemcheck tracks the memory m accesses, writing warnings to stderr as
+// they happen.  The returned function writes the heatmap.
+func startMemcheck(m *machine.Machine, img *machine.Image, debug *asm.DebugFile, opts memcheckOptions) func() {
+	if !opts.warn && opts.heatmap == "" {
+		return func() {}
+	}
+	var report func(memcheck.Warning)
+	if opts.warn {
+		report = func(w memcheck.Warning) {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", formatWarning(w, debug))
+		}
+	}
+	checker := memcheck.New(m.Memory(), img, report)
+	m.AddTracer(checker.Record)
+	done := false
+	return func() {
+		if done || opts.heatmap == "" {
+			return
+		}
+		done = true
+		write := checker.WriteText
+		if strings.EqualFold(filepath.Ext(opts.heatmap), ".png") {
+			write = checker.WritePNG
+		}
+		if opts.heatmap == "-" {
+			write(os.Stdout)
+			return
+		}
+		f, err := os.Create(opts.heatmap)
+		if err == nil {
+			err = write(f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write heatmap '%s': %s\n", opts.heatmap, err)
+		}
+	}
+}
+
+// formatWarning formats a warning with symbols and the source line, ie
+// "read of uninitialized memory 0x2000 (buffer) at pc=0x0105 (main+5) test.s:7".
+// Addresses in the function's frame are named by its params and locals.
+func formatWarning(w memcheck.Warning, debug *asm.DebugFile) string {
+	text := fmt.Sprintf("%s 0x%04x", w.Kind, w.Addr)
+	if debug == nil {
+		return fmt.Sprintf("%s at pc=0x%04x", text, w.PC)
+	}
+	var slot *asm.FrameSlot
+	if fn := debug.FunctionAt(w.PC); fn != nil {
+		slot = slotContaining(fn, int(int16(w.Addr-w.FP)))
+	}
+	if slot != nil {
+		text += " (" + slot.Name + ")"
+	} else if sym := debug.Symbolize(w.Addr); sym != "" {
+		text += " (" + sym + ")"
+	}
+	text += fmt.Sprintf(" at pc=0x%04x", w.PC)
+	if sym := debug.Symbolize(w.PC); sym != "" {
+		text += " (" + sym + ")"
+	}
+	if file, line := debug.SourceLine(w.PC, 0); file != "" {
+		text += fmt.Sprintf(" %s:%d", file, line)
+	}
+	return text
+}
+
+// slotContaining returns the param or local that includes the byte at the
+// given offset from fp, or nil.
+func slotContaining(fn *asm.FunctionInfo, offset int) *asm.FrameSlot {
+	for _, slots := range [][]asm.FrameSlot{fn.Args, fn.Locals} {
+		for i := range slots {
+			if offset >= slots[i].Offset && offset < slots[i].Offset+slots[i].Size {
+				return &slots[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcheck
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+// blockSize is the number of bytes each character of the text map covers.
+const blockSize = 16
+
+// blockChar returns the character for a block of the text map, by the most
+// significant access to any of its bytes.
+func (c *Checker) blockChar(start int) byte {
+	ch := byte('.')
+	for addr := start; addr < start+blockSize; addr++ {
+		switch {
+		case c.Executed[addr] > 0:
+			return 'X'
+		case c.Writes[addr] > 0:
+			ch = 'W'
+		case c.Reads[addr] > 0 && ch != 'W':
+			ch = 'R'
+		case c.written[addr] && ch == '.':
+			ch = 'i'
+		}
+	}
+	return ch
+}
+
+// WriteText writes a map of the 64k address space, 64 rows of 1k each with
+// a character for every 16 bytes: X for executed, W written, R read, i
+// initialized by the image but not accessed, and . for untouched.
+func (c *Checker) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "X executed  W written  R read  i image only  . untouched  (16 bytes per column)")
+	fmt.Fprintf(bw, "      ")
+	for col := 0; col < 64; col += 16 {
+		fmt.Fprintf(bw, "%-16s", fmt.Sprintf("+%03x", col*blockSize))
+	}
+	fmt.Fprintln(bw)
+	for row := 0; row < 64; row++ {
+		line := make([]byte, 64)
+		for col := range line {
+			line[col] = c.blockChar(row*1024 + col*blockSize)
+		}
+		fmt.Fprintf(bw, "%04x  %s\n", row*1024, line)
+	}
+	return bw.Flush()
+}
+
+// Image returns a 256x256 image of the address space, one pixel per byte,
+// with each row 256 bytes.  Writes are red, executions green and reads blue,
+// brighter the more often they happened, and bytes only initialized by the
+// image are dark gray.
+func (c *Checker) Image() image.Image {
+	var maxCount uint32
+	for addr := 0; addr < 65536; addr++ {
+		for _, n := range []uint32{c.Reads[addr], c.Writes[addr], c.Executed[addr]} {
+			if n > maxCount {
+				maxCount = n
+			}
+		}
+	}
+	scale := func(n uint32) uint8 {
+		if n == 0 {
+			return 0
+		}
+		return uint8(64 + 191*math.Log1p(float64(n))/math.Log1p(float64(maxCount)))
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for addr := 0; addr < 65536; addr++ {
+		px := color.RGBA{R: scale(c.Writes[addr]), G: scale(c.Executed[addr]), B: scale(c.Reads[addr]), A: 255}
+		if px.R == 0 && px.G == 0 && px.B == 0 && c.written[addr] {
+			px = color.RGBA{R: 48, G: 48, B: 48, A: 255}
+		}
+		img.SetRGBA(addr&0xff, addr>>8, px)
+	}
+	return img
+}
+
+// WritePNG writes Image as a PNG.
+func (c *Checker) WritePNG(w io.Writer) error {
+	return png.Encode(w, c.Image())
+}
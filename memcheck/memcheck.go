@@ -0,0 +1,191 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memcheck tracks how a program accesses each byte of memory, to
+// warn about reads of memory that was never initialized and about code that
+// modifies instructions that already ran, and to draw a map of the accesses.
+package memcheck
+
+import (
+	"fmt"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// registerBytes is the size of the memory mapped registers at the start of
+// memory, from machine.PCAddr to the last register.  They're always
+// initialized and aren't code.
+const registerBytes = 16
+
+// Kind is the kind of problem a Warning is about.
+type Kind int
+
+const (
+	UninitializedRead Kind = iota // read memory that was never written
+	SelfModifyingCode             // wrote memory that was executed
+)
+
+func (k Kind) String() string {
+	switch k {
+	case UninitializedRead:
+		return "read of uninitialized memory"
+	case SelfModifyingCode:
+		return "write to executed code"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Warning is a suspicious access by the instruction at PC to Addr.
+type Warning struct {
+	Kind Kind
+	PC   uint16
+	Addr uint16
+	FP   uint16 // frame pointer after the instruction, to name locals
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s 0x%04x at pc=0x%04x", w.Kind, w.Addr, w.PC)
+}
+
+// Checker counts the reads, writes and executions of each byte of main
+// memory.  Bytes are initialized if the image loaded them or an instruction
+// wrote them.  Devices write memory directly, ie reading a file into a
+// buffer, so a byte that changed since the checker started is also
+// initialized.
+type Checker struct {
+	memory   machine.Memory
+	initial  [65536]byte // memory when the checker started
+	written  [65536]bool // initialized by the image or a write
+	Reads    [65536]uint32
+	Writes   [65536]uint32
+	Executed [65536]uint32
+	warned   map[Warning]bool // warnings already reported, by pc and kind with no address
+	report   func(Warning)
+}
+
+// New returns a checker for the machine's memory with img loaded, which
+// calls report the first time each instruction makes each kind of
+// suspicious access.
+func New(memory machine.Memory, img *machine.Image, report func(Warning)) *Checker {
+	c := &Checker{memory: memory, warned: make(map[Warning]bool), report: report}
+	for addr := 0; addr < len(c.initial); addr++ {
+		c.initial[addr] = memory.GetByte(uint16(addr))
+	}
+	for addr := 0; addr < registerBytes; addr++ {
+		c.written[addr] = true
+	}
+	for _, seg := range img.Segments {
+		if seg.Bank != 0 {
+			continue
+		}
+		for i := range seg.Data {
+			if addr := int(seg.Addr) + i; addr < len(c.written) {
+				c.written[addr] = true
+			}
+		}
+	}
+	return c
+}
+
+// Initialized reports if addr was loaded by the image or written since.
+func (c *Checker) Initialized(addr uint16) bool {
+	return c.written[addr]
+}
+
+// Record checks the memory accessed by an executed instruction, it's a
+// machine.Tracer.
+func (c *Checker) Record(r *machine.TraceRecord) {
+	for i := range r.Code {
+		c.Executed[r.PC+uint16(i)]++
+	}
+	size := 2
+	if r.Bytes {
+		size = 1
+	}
+	// pointers are read before the operand they point to
+	offset := 1
+	for _, op := range []struct {
+		mode machine.AddressMode
+		addr uint16
+		read bool
+	}{{r.Mode1, r.Addr1, r.Read1}, {r.Mode2, r.Addr2, r.Read2}} {
+		if pointer, ok := pointerAddr(r, op.mode, offset); ok {
+			c.read(r, pointer, 2)
+		}
+		if op.read {
+			c.read(r, op.addr, size)
+		}
+		offset += op.mode.Size()
+	}
+	if r.Written {
+		for i := 0; i < r.WriteSize; i++ {
+			addr := r.WriteAddr + uint16(i)
+			if c.Executed[addr] > 0 && addr >= registerBytes {
+				c.warn(Warning{Kind: SelfModifyingCode, PC: r.PC, Addr: addr, FP: r.Flags.FP})
+			}
+			c.Writes[addr]++
+			c.written[addr] = true
+		}
+	}
+}
+
+// pointerAddr returns the address of the pointer an indirect operand reads,
+// from the operand's bytes at offset in the instruction.
+func pointerAddr(r *machine.TraceRecord, mode machine.AddressMode, offset int) (uint16, bool) {
+	switch mode {
+	case machine.Indirect:
+		if offset+1 < len(r.Code) {
+			return uint16(r.Code[offset]) | uint16(r.Code[offset+1])<<8, true
+		}
+	case machine.RelativeIndirect:
+		if offset < len(r.Code) {
+			return uint16(int(r.Flags.FP) + int(int8(r.Code[offset]))), true
+		}
+	}
+	return 0, false
+}
+
+func (c *Checker) read(r *machine.TraceRecord, addr uint16, size int) {
+	for i := 0; i < size; i++ {
+		a := addr + uint16(i)
+		c.Reads[a]++
+		if c.written[a] {
+			continue
+		}
+		if c.memory.GetByte(a) != c.initial[a] {
+			c.written[a] = true // written by a device
+			continue
+		}
+		// warn only reports the first uninitialized byte of a word
+		c.warn(Warning{Kind: UninitializedRead, PC: r.PC, Addr: a, FP: r.Flags.FP})
+	}
+}
+
+// warn reports w unless the same instruction already had the same kind of
+// warning.
+func (c *Checker) warn(w Warning) {
+	key := Warning{Kind: w.Kind, PC: w.PC}
+	if c.warned[key] {
+		return
+	}
+	c.warned[key] = true
+	if c.report != nil {
+		c.report(w)
+	}
+}
+
+// Warnings returns the number of warnings reported.
+func (c *Checker) Warnings() int {
+	return len(c.warned)
+}
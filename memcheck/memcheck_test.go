@@ -0,0 +1,96 @@
+package memcheck
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSource = `
+buffer	= 0x2000
+ptr		= 0x2010
+input	= 0x2020
+		dw main
+		org 0x100
+main:	cpy total, buffer
+		cpy buffer+2, #5
+		add total, buffer+2
+		cpy total, *ptr
+		add total, input
+		cpy count, #2
+.loop:	cpy main, #0
+		dec count
+		jne loop
+		hlt
+total:	dw 0
+count:	dw 0
+`
+
+func checkProgram(t *testing.T) (*Checker, []Warning) {
+	linker, err := asm.BuildSource("test.s", testSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.NoError(t, err)
+	var warnings []Warning
+	c := New(m.Memory(), linker.Image(), func(w Warning) {
+		warnings = append(warnings, w)
+	})
+	// as if a device read input into memory
+	m.Memory().PutWord(0x2020, 0x1234)
+	m.SetTracer(c.Record)
+	m.Run()
+	return c, warnings
+}
+
+func TestWarnings(t *testing.T) {
+	c, warnings := checkProgram(t)
+	assert.Equal(t, []Warning{
+		{Kind: UninitializedRead, PC: 0x100, Addr: 0x2000},
+		{Kind: UninitializedRead, PC: 0x10f, Addr: 0x2010}, // the pointer
+		{Kind: SelfModifyingCode, PC: 0x11e, Addr: 0x100},
+	}, warnings)
+	assert.Equal(t, 3, c.Warnings())
+	assert.Equal(t, "read of uninitialized memory 0x2000 at pc=0x0100", warnings[0].String())
+	assert.True(t, c.Initialized(0x2020))
+	assert.False(t, c.Initialized(0x2030))
+}
+
+func TestCounts(t *testing.T) {
+	c, _ := checkProgram(t)
+	assert.Equal(t, uint32(1), c.Reads[0x2002])
+	assert.Equal(t, uint32(1), c.Writes[0x2002])
+	assert.Equal(t, uint32(1), c.Executed[0x100])
+	assert.Equal(t, uint32(2), c.Writes[0x100])
+	assert.Equal(t, uint32(0), c.Executed[0x2000])
+}
+
+func TestWriteText(t *testing.T) {
+	c, _ := checkProgram(t)
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteText(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	assert.Len(t, lines, 67)
+	// *ptr read address 0, as ptr was never written
+	assert.Equal(t, "0000  R...............XXX.............................................", lines[2])
+	assert.Equal(t, "2000  WRR.............................................................", lines[10])
+}
+
+func TestImage(t *testing.T) {
+	c, _ := checkProgram(t)
+	img := c.Image()
+	r, g, b, _ := img.At(0x00, 0x01).RGBA()
+	assert.True(t, r > 0 && g > 0 && b == 0) // main, executed and overwritten
+	r, g, b, _ = img.At(0x00, 0x20).RGBA()
+	assert.True(t, r == 0 && g == 0 && b > 0) // buffer, only read
+	r, g, b, _ = img.At(0x00, 0x30).RGBA()
+	assert.True(t, r == 0 && g == 0 && b == 0)
+	var buf bytes.Buffer
+	assert.NoError(t, c.WritePNG(&buf))
+	assert.True(t, bytes.HasPrefix(buf.Bytes(), []byte("\x89PNG")))
+}
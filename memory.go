@@ -0,0 +1,212 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// parseRange parses the inclusive range "start end" from args.
+func (m *Monitor) parseRange(args []string) (start, end int, err error) {
+	if start, err = m.address(args[0]); err != nil {
+		return 0, 0, fmt.Errorf("invalid start (%s)", err)
+	}
+	if end, err = m.address(args[1]); err != nil {
+		return 0, 0, fmt.Errorf("invalid end (%s)", err)
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("end 0x%04x is before start 0x%04x", end, start)
+	}
+	return start, end, nil
+}
+
+// read returns the n bytes at addr, wrapping at the end of memory.
+func (m *Monitor) read(addr, n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = m.memory.GetByte(uint16(addr + i))
+	}
+	return data
+}
+
+func (m *Monitor) write(addr int, data []byte) {
+	for i, b := range data {
+		m.memory.PutByte(uint16(addr+i), b)
+	}
+}
+
+// find handles "find start end value [value]*", showing each address in the
+// range where the values occur, with values of size bytes as for set.
+func (m *Monitor) find(cmd []string, size int) {
+	if len(cmd) < 4 {
+		m.errorf("expected: %s start end value [value]*\n", cmd[0])
+		return
+	}
+	start, end, err := m.parseRange(cmd[1:3])
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	pattern, err := m.parseData(cmd[0], cmd[3:], size)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	data := m.read(start, end-start+1)
+	found := 0
+	for i := 0; i+len(pattern) <= len(data); i++ {
+		if bytes.Equal(data[i:i+len(pattern)], pattern) {
+			fmt.Fprintf(m.out, "%s\n", m.formatAddr(start+i))
+			found++
+		}
+	}
+	fmt.Fprintf(m.out, "%d found\n", found)
+}
+
+// fill handles "fill start end value [value]*", repeating the values over the
+// range.
+func (m *Monitor) fill(cmd []string, size int) {
+	if len(cmd) < 4 {
+		m.errorf("expected: %s start end value [value]*\n", cmd[0])
+		return
+	}
+	start, end, err := m.parseRange(cmd[1:3])
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	pattern, err := m.parseData(cmd[0], cmd[3:], size)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	if len(pattern) == 0 {
+		m.errorf("empty fill value\n")
+		return
+	}
+	data := make([]byte, end-start+1)
+	for i := range data {
+		data[i] = pattern[i%len(pattern)]
+	}
+	m.write(start, data)
+	fmt.Fprintf(m.out, "filled %d bytes at 0x%04x\n", len(data), start)
+}
+
+// compare handles "compare start end dest", showing the bytes that differ
+// between the range and the same number of bytes at dest.
+func (m *Monitor) compare(cmd []string) {
+	if len(cmd) != 4 {
+		m.errorf("expected: compare start end dest\n")
+		return
+	}
+	start, end, err := m.parseRange(cmd[1:3])
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	dest, err := m.address(cmd[3])
+	if err != nil {
+		m.errorf("invalid dest (%s)\n", err)
+		return
+	}
+	a, b := m.read(start, end-start+1), m.read(dest, end-start+1)
+	differ := 0
+	for i := range a {
+		if a[i] != b[i] {
+			fmt.Fprintf(m.out, "0x%04x: %02x  0x%04x: %02x\n", start+i, a[i], (dest+i)&0xffff, b[i])
+			differ++
+		}
+	}
+	fmt.Fprintf(m.out, "%d bytes differ\n", differ)
+}
+
+// copyRange handles "copy start end dest".  The range is read before it's
+// written, so it can overlap dest.
+func (m *Monitor) copyRange(cmd []string) {
+	if len(cmd) != 4 {
+		m.errorf("expected: copy start end dest\n")
+		return
+	}
+	start, end, err := m.parseRange(cmd[1:3])
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	dest, err := m.address(cmd[3])
+	if err != nil {
+		m.errorf("invalid dest (%s)\n", err)
+		return
+	}
+	m.write(dest, m.read(start, end-start+1))
+	fmt.Fprintf(m.out, "copied %d bytes to 0x%04x\n", end-start+1, dest)
+}
+
+// basePath returns name relative to MPU_BASE_DIR, as the program's own files
+// are.
+func basePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(os.Getenv(machine.BaseDirEnv), name)
+}
+
+// load handles "load file address", writing the raw bytes of the file to
+// memory.
+func (m *Monitor) load(cmd []string) {
+	if len(cmd) != 3 {
+		m.errorf("expected: load file address\n")
+		return
+	}
+	addr, err := m.address(cmd[2])
+	if err != nil {
+		m.errorf("invalid addr (%s)\n", err)
+		return
+	}
+	data, err := ioutil.ReadFile(basePath(cmd[1]))
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	if addr+len(data) > 0x10000 {
+		m.errorf("%d bytes at 0x%04x would go past the end of memory\n", len(data), addr)
+		return
+	}
+	m.write(addr, data)
+	fmt.Fprintf(m.out, "loaded %d bytes at 0x%04x\n", len(data), addr)
+}
+
+// save handles "save file start end", writing the range as raw bytes.
+func (m *Monitor) save(cmd []string) {
+	if len(cmd) != 4 {
+		m.errorf("expected: save file start end\n")
+		return
+	}
+	start, end, err := m.parseRange(cmd[2:4])
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(basePath(cmd[1]), m.read(start, end-start+1), 0644); err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	fmt.Fprintf(m.out, "saved %d bytes to %s\n", end-start+1, cmd[1])
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+// runScript runs script on a test monitor, failing the test if it fails.
+func runScript(t *testing.T, m *Monitor, script string) {
+	assert.True(t, m.Run(strings.NewReader(script), false), script)
+}
+
+func TestFind(t *testing.T) {
+	m, out := testMonitor()
+	m.write(0x200, []byte("abcab"))
+	runScript(t, m, "find 0x200 0x204 \"ab\"\n")
+	assert.Equal(t, "0x0200\n0x0203\n2 found\n", out.String())
+
+	// a match ending on the last byte of the range, but not one past it
+	out.Reset()
+	runScript(t, m, "find 0x200 0x203 'a' 'b'\n")
+	assert.Equal(t, "0x0200\n1 found\n", out.String())
+}
+
+func TestFindWords(t *testing.T) {
+	m, out := testMonitor()
+	m.memory.PutWord(0x300, 0x1234)
+	m.memory.PutWord(0x305, 0x1234)
+	runScript(t, m, "findw 0x300 0x306 0x1234\nfindw 0x300 0x305 0x1234\n")
+	assert.Equal(t, "0x0300\n0x0305\n2 found\n0x0300\n1 found\n", out.String())
+}
+
+func TestFill(t *testing.T) {
+	m, out := testMonitor()
+	runScript(t, m, "fill 0x200 0x206 1 2 3\nfillw 0x300 0x304 0x1234\n")
+	assert.Equal(t, "filled 7 bytes at 0x0200\nfilled 5 bytes at 0x0300\n", out.String())
+	assert.Equal(t, []byte{1, 2, 3, 1, 2, 3, 1, 0}, m.read(0x200, 8))
+	assert.Equal(t, []byte{0x34, 0x12, 0x34, 0x12, 0x34, 0}, m.read(0x300, 6))
+}
+
+func TestCopyOverlapping(t *testing.T) {
+	m, out := testMonitor()
+	m.write(0x200, []byte{1, 2, 3, 4})
+	runScript(t, m, "copy 0x200 0x203 0x202\n")
+	assert.Equal(t, "copied 4 bytes to 0x0202\n", out.String())
+	assert.Equal(t, []byte{1, 2, 1, 2, 3, 4}, m.read(0x200, 6))
+
+	m.write(0x300, []byte{1, 2, 3, 4})
+	runScript(t, m, "copy 0x302 0x303 0x301\n")
+	assert.Equal(t, []byte{1, 3, 4, 4}, m.read(0x300, 4))
+}
+
+func TestCompare(t *testing.T) {
+	m, out := testMonitor()
+	m.write(0x200, []byte{1, 2, 3, 4})
+	m.write(0x300, []byte{1, 9, 3, 8})
+	runScript(t, m, "compare 0x200 0x203 0x300\ncmp 0x200 0x201 0x200\n")
+	assert.Equal(t, "0x0201: 02  0x0301: 09\n0x0203: 04  0x0303: 08\n2 bytes differ\n0 bytes differ\n", out.String())
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(machine.BaseDirEnv, dir)
+
+	m, out := testMonitor()
+	m.write(0x200, []byte("hello"))
+	runScript(t, m, "save data.bin 0x200 0x204\nload data.bin 0x300\n")
+	assert.Equal(t, "saved 5 bytes to data.bin\nloaded 5 bytes at 0x0300\n", out.String())
+	assert.Equal(t, []byte("hello"), m.read(0x300, 5))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "data.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	// the last byte of the file at 0xffff is fine, one more isn't
+	out.Reset()
+	runScript(t, m, "load data.bin 0xfffb\n")
+	assert.Equal(t, "loaded 5 bytes at 0xfffb\n", out.String())
+	out.Reset()
+	assert.False(t, m.Run(strings.NewReader("load data.bin 0xfffc\n"), false))
+	assert.Equal(t, "error at line 1: 5 bytes at 0xfffc would go past the end of memory\n", out.String())
+	assert.Equal(t, []byte("hello"), m.read(0xfffb, 5))
+}
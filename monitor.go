@@ -22,13 +22,35 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/jsando/mpu/asm"
 	"github.com/jsando/mpu/machine"
 )
 
 type Monitor struct {
+	out     io.Writer // where commands write their output
 	machine *machine.Machine
 	memory  machine.Memory
-	next    int // implied address if no address is provided
+	debug   *asm.DebugFile      // symbols and source lines, nil if not available
+	next    int                 // implied address if no address is provided
+	sources map[string][]string // lines of source files, by name
+
+	historyLimit int // instructions recorded for stepping back, 0 if off
+
+	vars   map[string]int // variables set by let
+	line   int            // line number of the script command, 0 if interactive
+	failed bool           // an assert or a script command failed
+	quit   bool           // quit was entered
+
+	stackLimit int // lowest address sp should reach, 0 for none
+
+	assembling bool // lines are instructions for assembleLine, not commands
+	asmAddr    int  // where assembleLine writes the next instruction
+}
+
+// newMonitor creates a monitor for the machine that writes to stdout.  debug
+// may be nil if there are no symbols.
+func newMonitor(m *machine.Machine, debug *asm.DebugFile) *Monitor {
+	return &Monitor{out: os.Stdout, machine: m, memory: m.Memory(), debug: debug}
 }
 
 const welcome = `
@@ -37,56 +59,212 @@ const welcome = `
  ------------------------------------------
 `
 
-/*
-d/dump [start [end]]
-l/list [start]
-run address
-s/step [address]
-set [address value [value]*]
-*/
-func (m *Monitor) Run() {
-	fmt.Printf(welcome)
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Printf("> ")
+const help = `Commands:
+  d/dump [[bank:]start [end]]     hex dump memory, optionally from a given bank
+  l/list [start [count]]          disassemble instructions
+  a/asm [address [instruction]]   assemble lines into memory until an empty line, or just one instruction
+  r/run address                   run from address until hlt, a fault or a breakpoint
+  c/cont                          continue running from pc
+  s/step [address]                execute one instruction
+  n/next                          run to the next source line, stepping over calls
+  o/over                          execute one instruction, or a whole call if it's a jsr
+  fin/finish                      run until the current function returns
+  rs/back [count]                 step back one or more instructions
+  rc                              run backwards to the previous breakpoint or watched write
+  who address                     show the instruction that last wrote address
+  history [count]                 show or set how many instructions can be stepped back, 0 for off
+  set address value [value]*      write bytes, values can be numbers or "strings"
+  setw address value [value]*     write words
+  find start end value [value]*   show where bytes or "strings" occur in a range
+  findw start end value [value]*  show where words occur in a range
+  fill start end value [value]*   repeat bytes or "strings" over a range
+  fillw start end value [value]*  repeat words over a range
+  cmp/compare start end dest      show the bytes that differ between a range and dest
+  copy start end dest             copy a range to dest
+  load file address               write a file's bytes to memory, relative to MPU_BASE_DIR
+  save file start end             write a range to a file, relative to MPU_BASE_DIR
+  reg [pc|sp|fp value]            show registers and flags, or set a register
+  flag z|n|c|b 0|1                set a flag
+  prot                            show the memory protection map
+  bt                              show the call stack with params and locals
+  stack [count]                   show words from sp up, with saved fp, return addresses, params and locals
+  stack limit [address|off]       show or set the lowest address sp should reach
+  b/break [address [if cond]]     stop before executing address, or list breakpoints
+  watch [address [r|w|rw]]        stop after address is read/written
+  delete [id]                     delete one or all breakpoints and watchpoints
+  let name = expr                 set a variable, used as $name in any command
+  echo [text]*                    print text
+  if cond then command            run command if cond is true
+  assert cond                     print "assert failed" if cond is false, ending a script
+  # comment                       ignored
+  q/quit                          exit the monitor
+  ?/print expr                    show the value of an expression in hex, decimal, binary and as a char
+  help                            show this list
+`
+
+// Run reads and executes commands from in until EOF or quit, see help for
+// the list of commands.  When interactive is false, ie for a script or when
+// stdin isn't a terminal, there's no banner or prompt so the output is only
+// what the commands print, and the first failed assert or command error
+// stops the run.  It returns false if one did.
+func (m *Monitor) Run(in io.Reader, interactive bool) bool {
+	if interactive {
+		fmt.Fprintf(m.out, welcome)
+	}
+	m.enableHistory()
+	if m.debug != nil && interactive {
+		fmt.Fprintf(m.out, "%d symbols loaded\n", len(m.debug.Symbols))
+	}
+	scanner := bufio.NewScanner(in)
+	for line := 1; !m.quit; line++ {
+		if interactive {
+			fmt.Fprint(m.out, m.prompt())
+		} else {
+			m.line = line
+		}
 		if !scanner.Scan() {
 			break
 		}
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 {
-			continue
-		}
-		cmd := strings.Split(line, " ")
-
-		switch cmd[0] {
-		case "dump", "d":
-			m.dump(cmd)
-		case "list", "l":
-			m.list(cmd)
-		case "run", "r":
-			m.run(cmd)
-		case "step", "s":
-			m.step(cmd)
+		m.Execute(scanner.Text())
+		if m.failed && !interactive {
+			break
 		}
 	}
+	return !m.failed
+}
+
+// Execute runs one command line, see help for the list of commands.
+func (m *Monitor) Execute(line string) {
+	line = strings.TrimSpace(line)
+	if m.assembling {
+		m.assembleLine(line)
+		return
+	}
+	if strings.HasPrefix(line, "#") {
+		return
+	}
+	line, err := m.expandVars(line)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	cmd, err := splitArgs(line)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	if len(cmd) == 0 {
+		return
+	}
+	switch cmd[0] {
+	case "dump", "d":
+		m.dump(cmd)
+	case "a", "asm":
+		m.assemble(cmd, line)
+	case "list", "l":
+		m.list(cmd)
+	case "run", "r":
+		m.run(cmd)
+	case "cont", "c":
+		m.RunAt(int(m.machine.Flags().PC))
+	case "break", "b":
+		m.breakpoint(cmd)
+	case "watch":
+		m.watch(cmd)
+	case "delete":
+		m.deleteBreakpoint(cmd)
+	case "step", "s":
+		m.step(cmd)
+	case "next", "n":
+		m.nextLine()
+	case "over", "o":
+		m.over()
+	case "finish", "fin":
+		m.finish()
+	case "back", "rs", "reverse-step":
+		m.back(cmd)
+	case "rc", "reverse-continue":
+		m.reverseContinue()
+	case "who":
+		m.who(cmd)
+	case "history":
+		m.history(cmd)
+	case "prot":
+		m.Protection(m.out)
+	case "bt":
+		m.Backtrace(m.out)
+	case "stack":
+		m.stack(cmd)
+	case "set":
+		m.set(cmd, 1)
+	case "setw":
+		m.set(cmd, 2)
+	case "find":
+		m.find(cmd, 1)
+	case "findw":
+		m.find(cmd, 2)
+	case "fill":
+		m.fill(cmd, 1)
+	case "fillw":
+		m.fill(cmd, 2)
+	case "compare", "cmp":
+		m.compare(cmd)
+	case "copy":
+		m.copyRange(cmd)
+	case "load":
+		m.load(cmd)
+	case "save":
+		m.save(cmd)
+	case "reg":
+		m.reg(cmd)
+	case "flag":
+		m.flag(cmd)
+	case "let":
+		m.let(cmd)
+	case "echo":
+		m.echo(cmd)
+	case "if":
+		m.ifThen(cmd)
+	case "assert":
+		m.assert(cmd)
+	case "quit", "exit", "q":
+		m.quit = true
+	case "print", "?":
+		m.print(cmd)
+	case "help", "h":
+		fmt.Fprint(m.out, help)
+	default:
+		m.errorf("unknown command '%s', type help for a list of commands\n", cmd[0])
+	}
 }
 
 func (m *Monitor) dump(cmd []string) {
 	start := m.next
 	end := start + 160 - 1
+	bank := -1
 	if len(cmd) > 1 {
-		i, err := parseInt(cmd[1])
+		arg := cmd[1]
+		if i := strings.Index(arg, ":"); i >= 0 {
+			b, err := m.address(arg[:i])
+			if err != nil || b < 0 || b >= machine.MaxBanks {
+				m.errorf("invalid bank (%s)\n", arg[:i])
+				return
+			}
+			bank = b
+			arg = arg[i+1:]
+		}
+		i, err := m.address(arg)
 		if err != nil {
-			fmt.Printf("invalid addr (%cmd)\n", err)
+			m.errorf("invalid addr (%s)\n", err)
 			return
 		}
 		start = i
 		end = start + 160 - 1
 	}
 	if len(cmd) > 2 {
-		i, err := parseInt(cmd[2])
+		i, err := m.address(cmd[2])
 		if err != nil {
-			fmt.Printf("invalid addr (%cmd)\n", err)
+			m.errorf("invalid addr (%s)\n", err)
 			return
 		}
 		end = i
@@ -94,28 +272,38 @@ func (m *Monitor) dump(cmd []string) {
 	if end < start {
 		end = start + 160 - 1
 	}
-	m.Dump(os.Stdout, start, end)
+	m.DumpBank(m.out, bank, start, end)
 	m.next = end + 1
 }
 
 func (m *Monitor) list(cmd []string) {
 	start := m.next
+	count := 20
 	if len(cmd) > 1 {
-		i, err := parseInt(cmd[1])
+		i, err := m.address(cmd[1])
 		if err != nil {
-			fmt.Printf("invalid addr (%s)\n", err)
+			m.errorf("invalid addr (%s)\n", err)
+			return
 		}
 		start = i
 	}
-	m.next = m.List(os.Stdout, start, 20)
+	if len(cmd) > 2 {
+		i, err := m.address(cmd[2])
+		if err != nil || i == 0 {
+			m.errorf("invalid count (%s)\n", cmd[2])
+			return
+		}
+		count = i
+	}
+	m.next = m.List(m.out, start, count)
 }
 
 func (m *Monitor) run(cmd []string) {
 	addr := m.next
 	if len(cmd) > 1 {
-		i, err := parseInt(cmd[1])
+		i, err := m.address(cmd[1])
 		if err != nil {
-			fmt.Printf("invalid addr (%s)\n", err)
+			m.errorf("invalid addr (%s)\n", err)
 			return
 		}
 		addr = i
@@ -126,9 +314,9 @@ func (m *Monitor) run(cmd []string) {
 func (m *Monitor) step(cmd []string) {
 	addr := m.next
 	if len(cmd) > 1 {
-		i, err := parseInt(cmd[1])
+		i, err := m.address(cmd[1])
 		if err != nil {
-			fmt.Printf("invalid addr (%s)\n", err)
+			m.errorf("invalid addr (%s)\n", err)
 			return
 		}
 		addr = i
@@ -136,16 +324,168 @@ func (m *Monitor) step(cmd []string) {
 	m.next = m.Step(addr)
 }
 
-func parseInt(s string) (int, error) {
-	if strings.HasPrefix(s, "0x") {
-		i, err := strconv.ParseInt(s[2:], 16, 16)
-		return int(i), err
+// set handles "set address value [value]*", writing each value as size
+// bytes.  Quoted strings are written as one byte per character, without a
+// terminator.
+func (m *Monitor) set(cmd []string, size int) {
+	if len(cmd) < 3 {
+		m.errorf("expected: %s address value [value]*\n", cmd[0])
+		return
+	}
+	addr, err := m.address(cmd[1])
+	if err != nil {
+		m.errorf("invalid addr (%s)\n", err)
+		return
 	}
-	i, err := strconv.ParseInt(s, 10, 16)
-	return int(i), err
+	data, err := m.parseData(cmd[0], cmd[2:], size)
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	for i, b := range data {
+		m.memory.PutByte(uint16(addr+i), b)
+	}
+	fmt.Fprintf(m.out, "wrote %d bytes at 0x%04x\n", len(data), addr)
+}
+
+// parseData parses the values for cmd as size bytes each, with quoted strings
+// as one byte per character without a terminator.
+func (m *Monitor) parseData(cmd string, args []string, size int) ([]byte, error) {
+	var data []byte
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "\"") {
+			text, err := strconv.Unquote(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string (%s)", arg)
+			}
+			data = append(data, text...)
+			continue
+		}
+		value, err := m.address(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value (%s)", err)
+		}
+		if size == 1 {
+			if value > 0xff {
+				return nil, fmt.Errorf("value 0x%x doesn't fit in a byte, use %sw for words", value, cmd)
+			}
+			data = append(data, byte(value))
+		} else {
+			data = append(data, byte(value), byte(value>>8))
+		}
+	}
+	return data, nil
 }
 
+// reg handles "reg [pc|sp|fp value]", showing the registers if there are no
+// arguments.
+func (m *Monitor) reg(cmd []string) {
+	if len(cmd) == 1 {
+		m.printStatus()
+		return
+	}
+	if len(cmd) != 3 {
+		m.errorf("expected: reg pc|sp|fp value\n")
+		return
+	}
+	value, err := m.address(cmd[2])
+	if err != nil {
+		m.errorf("invalid value (%s)\n", err)
+		return
+	}
+	flags := m.machine.Flags()
+	switch cmd[1] {
+	case "pc":
+		flags.PC = uint16(value)
+		m.next = value
+	case "sp":
+		flags.SP = uint16(value)
+	case "fp":
+		flags.FP = uint16(value)
+	default:
+		m.errorf("unknown register '%s', expected pc, sp or fp\n", cmd[1])
+		return
+	}
+	m.machine.SetFlags(flags)
+	m.printStatus()
+}
+
+// flag handles "flag z|n|c|b 0|1".
+func (m *Monitor) flag(cmd []string) {
+	if len(cmd) != 3 || (cmd[2] != "0" && cmd[2] != "1") {
+		m.errorf("expected: flag z|n|c|b 0|1\n")
+		return
+	}
+	on := cmd[2] == "1"
+	flags := m.machine.Flags()
+	switch cmd[1] {
+	case "z":
+		flags.Zero = on
+	case "n":
+		flags.Negative = on
+	case "c":
+		flags.Carry = on
+	case "b":
+		flags.Bytes = on
+	default:
+		m.errorf("unknown flag '%s', expected z, n, c or b\n", cmd[1])
+		return
+	}
+	m.machine.SetFlags(flags)
+	m.printStatus()
+}
+
+// splitArgs splits a command line on spaces, keeping double quoted strings
+// (which may contain escapes and spaces) together as one argument including
+// the quotes.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inString := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inString && c == '\\' && i+1 < len(line):
+			arg.WriteByte(c)
+			i++
+			arg.WriteByte(line[i])
+			continue
+		case c == '"':
+			inString = !inString
+		case !inString && (c == ' ' || c == '\t'):
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+			continue
+		}
+		arg.WriteByte(c)
+	}
+	if inString {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Dump writes a hex dump of memory from start to end inclusive, as the
+// running program currently sees it.
 func (m *Monitor) Dump(w io.Writer, start int, end int) {
+	m.DumpBank(w, -1, start, end)
+}
+
+// DumpBank is like Dump, but addresses within the bank window are read from
+// the given bank rather than the selected one.  A bank of -1 reads the
+// selected bank.
+func (m *Monitor) DumpBank(w io.Writer, bank int, start int, end int) {
+	getByte := m.memory.GetByte
+	if bank >= 0 {
+		getByte = func(addr uint16) byte {
+			return m.machine.ReadBankByte(bank, addr)
+		}
+	}
 	ascii := make([]byte, 16)
 	charIndex := 0
 	flush := func() {
@@ -164,7 +504,7 @@ func (m *Monitor) Dump(w io.Writer, start int, end int) {
 			}
 			fmt.Fprintf(w, "%04x  ", addr)
 		}
-		ch := m.memory.GetByte(uint16(addr))
+		ch := getByte(uint16(addr))
 		fmt.Fprintf(w, "%02x ", ch)
 		if ch >= 32 && ch <= 126 {
 			ascii[charIndex] = ch
@@ -178,49 +518,170 @@ func (m *Monitor) Dump(w io.Writer, start int, end int) {
 
 // List will disassemble n instructions starting at addr, and return the
 // pc location following the last instruction.
+//
+// With debug info loaded, labels and source lines are shown before the
+// instructions they belong to, and operands are shown as symbols.
 func (m *Monitor) List(w io.Writer, addr int, n int) int {
+	lastSource := ""
 	for i := 0; i < n; i++ {
-		in := m.memory.GetByte(uint16(addr))
-		op, m1, m2 := machine.DecodeOp(in)
-		bytes := 0
-		var args string
-		if m1 != machine.Implied && m2 != machine.Implied {
-			op1, n := m.formatOperand(m1, addr+1)
-			bytes += n
-			op2, n := m.formatOperand(m2, addr+1+n)
-			bytes += n
-			args = op1 + "," + op2
-		} else if m1 != machine.Implied && m2 == machine.Implied {
-			op1, n := m.formatOperand(m1, addr+1)
-			bytes += n
-			args = op1
+		if label := m.labelAt(addr); label != "" {
+			fmt.Fprintf(w, "%s:\n", label)
 		}
-		fmt.Fprintf(w, "0x%04x  %02x ", addr, in)
-		for j := 0; j < 4; j++ {
-			if j < bytes {
-				fmt.Fprintf(w, "%02x ", m.memory.GetByte(uint16(addr+j+1)))
-			} else {
-				fmt.Fprintf(w, "   ")
-			}
+		if source := m.sourceText(addr); source != "" && source != lastSource {
+			fmt.Fprintf(w, "%s\n", source)
+			lastSource = source
 		}
-		fmt.Fprintf(w, "%s %s\n", op, args)
+		text, bytes := m.instructionLine(addr)
+		fmt.Fprintf(w, "%s\n", text)
 		addr = addr + 1 + bytes
 	}
 	return addr
 }
 
+// instructionLine formats the instruction at addr with its address and
+// bytes, as list shows it, and returns the number of operand bytes.
+func (m *Monitor) instructionLine(addr int) (string, int) {
+	var sb strings.Builder
+	text, bytes := m.disassemble(addr)
+	fmt.Fprintf(&sb, "0x%04x  %02x ", addr, m.memory.GetByte(uint16(addr)))
+	for j := 0; j < 4; j++ {
+		if j < bytes {
+			fmt.Fprintf(&sb, "%02x ", m.memory.GetByte(uint16(addr+j+1)))
+		} else {
+			fmt.Fprintf(&sb, "   ")
+		}
+	}
+	sb.WriteString(text)
+	return sb.String(), bytes
+}
+
+// disassemble formats the instruction at addr as "op args", and returns the
+// number of operand bytes.
+func (m *Monitor) disassemble(addr int) (string, int) {
+	var fn *asm.FunctionInfo
+	if m.debug != nil {
+		fn = m.debug.FunctionAt(uint16(addr))
+	}
+	op, m1, m2 := machine.DecodeOp(m.memory.GetByte(uint16(addr)))
+	bytes := 0
+	var args string
+	if m1 != machine.Implied && m2 != machine.Implied {
+		op1, n := m.formatOperand(m1, addr+1, fn)
+		bytes += n
+		op2, n := m.formatOperand(m2, addr+1+n, fn)
+		bytes += n
+		args = op1 + "," + op2
+	} else if m1 != machine.Implied && m2 == machine.Implied {
+		op1, n := m.formatOperand(m1, addr+1, fn)
+		bytes += n
+		args = op1
+	}
+	return fmt.Sprintf("%s %s", op, args), bytes
+}
+
+// label returns the global label at addr, if debug info is loaded.
+func (m *Monitor) label(addr int) string {
+	if m.debug == nil {
+		return ""
+	}
+	return m.debug.Label(uint16(addr))
+}
+
+// labelAt returns the global or local label at addr, if debug info is loaded.
+func (m *Monitor) labelAt(addr int) string {
+	name := m.symbolize(addr)
+	if strings.Contains(name, "+") {
+		return ""
+	}
+	return name
+}
+
+// symbolize returns addr as "label" or "label+offset", or "" if there's no
+// nearby label or no debug info.
+func (m *Monitor) symbolize(addr int) string {
+	if m.debug == nil {
+		return ""
+	}
+	return m.debug.Symbolize(uint16(addr))
+}
+
+// sourceLine returns "file:line" for the instruction at addr, if debug info
+// is loaded.
+func (m *Monitor) sourceLine(addr int) string {
+	if m.debug == nil {
+		return ""
+	}
+	file, line := m.debug.SourceLine(uint16(addr), m.bankAt(addr))
+	if file == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
 func (m *Monitor) RunAt(addr int) {
 	m.machine.RunAt(uint16(addr))
+	m.printFault()
+	m.printStop()
+	m.next = int(m.machine.Flags().PC)
+}
+
+// Protection prints the memory protection map, one region per line.
+func (m *Monitor) Protection(w io.Writer) {
+	regions := m.machine.ProtectionMap()
+	if len(regions) == 0 {
+		fmt.Fprintf(w, "no protected regions\n")
+		return
+	}
+	for _, r := range regions {
+		fmt.Fprintf(w, "%s\n", r)
+	}
+}
+
+func (m *Monitor) printFault() {
+	if fault := m.machine.Fault(); fault != nil {
+		fmt.Fprintf(m.out, "fault: %s\n", fault)
+		if m.debug != nil {
+			m.Backtrace(m.out)
+		}
+	}
+}
+
+// Backtrace prints the call stack, walking the frame pointer chain, with the
+// params and locals of each function.
+func (m *Monitor) Backtrace(w io.Writer) {
+	if m.debug == nil {
+		fmt.Fprintf(w, "no debug info loaded\n")
+		return
+	}
+	for i, frame := range asm.Backtrace(m.machine, m.debug) {
+		fmt.Fprintf(w, "#%d %s\n", i, frame)
+		if len(frame.Locals) > 0 {
+			fmt.Fprintf(w, "   ")
+			for _, local := range frame.Locals {
+				fmt.Fprintf(w, " %s", local)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
 }
 
 func (m *Monitor) Step(addr int) int {
-	m.List(os.Stdout, addr, 1)
+	m.List(m.out, addr, 1)
 	next := m.machine.Step(uint16(addr))
+	m.printFault()
+	if stop := m.machine.Stopped(); stop != nil {
+		fmt.Fprintf(m.out, "stopped: %s\n", stop)
+	}
+	m.printStatus()
+	return int(next)
+}
+
+func (m *Monitor) printStatus() {
 	flags := m.machine.Flags()
-	fmt.Printf("[status pc=%04x sp=%04x fp=%04x n=%d z=%d c=%d b=%d]\n",
+	fmt.Fprintf(m.out, "[status pc=%04x sp=%04x fp=%04x n=%d z=%d c=%d b=%d]\n",
 		flags.PC, flags.SP, flags.FP, boolInt(flags.Negative), boolInt(flags.Zero),
 		boolInt(flags.Carry), boolInt(flags.Bytes))
-	return int(next)
+	m.checkStack()
 }
 
 func boolInt(b bool) int {
@@ -230,36 +691,63 @@ func boolInt(b bool) int {
 	return 0
 }
 
-func (m *Monitor) formatOperand(mode machine.AddressMode, pc int) (op string, bytes int) {
+// formatOperand formats the operand at pc.  Addresses are shown as symbols
+// if there's debug info, and fp offsets as the param or local names of fn.
+func (m *Monitor) formatOperand(mode machine.AddressMode, pc int, fn *asm.FunctionInfo) (op string, bytes int) {
 	switch mode {
 	case machine.Implied:
 		// nothing to do
 	case machine.Immediate:
-		op = fmt.Sprintf("#0x%04x", m.memory.GetWord(uint16(pc)))
+		value := int(m.memory.GetWord(uint16(pc)))
+		if label := m.labelAt(value); label != "" {
+			op = "#" + label
+		} else {
+			op = fmt.Sprintf("#0x%04x", value)
+		}
 		bytes = 2
 	case machine.ImmediateByte:
 		op = fmt.Sprintf("#0x%02x", m.machine.ReadInt8(uint16(pc)))
 		bytes = 1
 	case machine.OffsetByte:
 		value := m.machine.ReadInt8(uint16(pc))
-		op = fmt.Sprintf("0x%04x (%d)", (pc-1)+value, value)
+		op = fmt.Sprintf("%s (%d)", m.formatAddrOperand((pc-1)+value), value)
 		bytes = 1
 	case machine.Absolute:
-		op = fmt.Sprintf("0x%04x", m.memory.GetWord(uint16(pc)))
+		op = m.formatAddrOperand(int(m.memory.GetWord(uint16(pc))))
 		bytes = 2
 	case machine.Indirect:
-		op = fmt.Sprintf("*0x%04x", m.memory.GetWord(uint16(pc)))
+		op = "*" + m.formatAddrOperand(int(m.memory.GetWord(uint16(pc))))
 		bytes = 2
 	case machine.Relative:
 		value := m.machine.ReadInt8(uint16(pc))
-		op = fmt.Sprintf("fp%+d", value)
+		op = formatFrameOperand(fn, value)
 		bytes = 1
 	case machine.RelativeIndirect:
 		value := m.machine.ReadInt8(uint16(pc))
-		op = fmt.Sprintf("*fp%+d", value)
+		op = "*" + formatFrameOperand(fn, value)
 		bytes = 1
 	default:
 		panic(fmt.Sprintf("illegal address mode: %d", mode))
 	}
 	return
 }
+
+// formatAddrOperand formats an address as a symbol, or in hex if there's no
+// symbol for it.
+func (m *Monitor) formatAddrOperand(addr int) string {
+	if name := m.symbolize(addr); name != "" {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
+
+// formatFrameOperand formats an fp offset as the name of the param or local
+// at that offset, or as fp+offset if there isn't one.
+func formatFrameOperand(fn *asm.FunctionInfo, offset int) string {
+	if fn != nil {
+		if slot := fn.Slot(offset); slot != nil {
+			return slot.Name
+		}
+	}
+	return fmt.Sprintf("fp%+d", offset)
+}
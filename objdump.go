@@ -0,0 +1,90 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// objdump describes a binary, using symbols from symName or the debug file
+// next to it.
+func objdump(name string, symName string, hex bool) {
+	img, format := loadObject(name)
+	debug := objectSymbols(name, symName)
+	fmt.Printf("%s: %s\n\n", name, format)
+	if err := asm.Dump(os.Stdout, img, debug, hex); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// objdiff reports how newName differs from oldName, each with symbols from
+// the debug file next to it.  Exits with status 1 if they differ.
+func objdiff(oldName, newName string) {
+	oldImg, _ := loadObject(oldName)
+	newImg, _ := loadObject(newName)
+	changed, err := asm.DiffImages(os.Stdout, oldImg, newImg, objectSymbols(oldName, ""), objectSymbols(newName, ""))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	if changed {
+		os.Exit(1)
+	}
+}
+
+// loadObject loads a binary in any format, returning it with a description
+// of the format.
+func loadObject(name string) (*machine.Image, string) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	img, err := machine.LoadImageFile(name, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot load '%s': %s\n", name, err)
+		os.Exit(1)
+	}
+	format := "raw memory image"
+	switch {
+	case machine.IsImage(data):
+		format = fmt.Sprintf("image version %d", machine.ImageVersion)
+	case machine.IsIntelHex(data):
+		format = "Intel HEX"
+	case machine.IsSRecord(data):
+		format = "Motorola S-records"
+	}
+	return img, fmt.Sprintf("%s, %d bytes", format, len(data))
+}
+
+// objectSymbols loads symName, or the debug file next to name if it's empty.
+// Returns nil if there's no debug file next to name.
+func objectSymbols(name string, symName string) *asm.DebugFile {
+	if symName == "" {
+		return loadDebugFile(asm.DebugFileName(name))
+	}
+	debug := loadDebugFile(symName)
+	if debug == nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot read symbols from '%s'\n", symName)
+		os.Exit(1)
+	}
+	return debug
+}
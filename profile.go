@@ -0,0 +1,82 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/jsando/mpu/profile"
+)
+
+// profileOptions are the run and test flags that control profiling.
+type profileOptions struct {
+	file string // pprof profile file, or "" to not write one
+	text string // text report file, or "" to not write one
+}
+
+func (o profileOptions) enabled() bool {
+	return o.file != "" || o.text != ""
+}
+
+// startProfile counts the instructions m executes.  The returned function
+// writes the profile files.
+func startProfile(m *machine.Machine, debug *asm.DebugFile, program string, opts profileOptions) func() {
+	if !opts.enabled() {
+		return func() {}
+	}
+	p := profile.New()
+	m.AddTracer(p.Record)
+	done := false
+	return func() {
+		if done {
+			return
+		}
+		done = true
+		if opts.file != "" {
+			writeProfile(opts.file, func(f *os.File) error {
+				return p.WritePprof(f, debug, filepath.Base(program))
+			})
+		}
+		if opts.text != "" {
+			writeProfile(opts.text, func(f *os.File) error {
+				return p.WriteText(f, debug)
+			})
+		}
+	}
+}
+
+// writeProfile writes a profile file, or to stdout if name is "-".
+func writeProfile(name string, write func(*os.File) error) {
+	if name == "-" {
+		if err := write(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write profile: %s\n", err)
+		}
+		return
+	}
+	f, err := os.Create(name)
+	if err == nil {
+		err = write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to write profile '%s': %s\n", name, err)
+	}
+}
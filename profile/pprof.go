@@ -0,0 +1,200 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/jsando/mpu/asm"
+)
+
+/*
+WritePprof writes the profile in the protobuf format read by "go tool pprof",
+gzip compressed.  Each sample is an address and its call stack, with one
+value, the number of instructions executed.  The message is encoded by hand
+from profile.proto, field numbers are:
+
+	Profile:   sample_type=1 sample=2 mapping=3 location=4 function=5
+	           string_table=6 period_type=11 period=12
+	ValueType: type=1 unit=2
+	Sample:    location_id=1 value=2
+	Mapping:   id=1 memory_start=2 memory_limit=3 filename=5
+	           has_functions=7 has_filenames=8 has_line_numbers=9
+	Location:  id=1 mapping_id=2 address=3 line=4
+	Line:      function_id=1 line=2
+	Function:  id=1 name=2 system_name=3 filename=4 start_line=5
+*/
+func (p *Profile) WritePprof(w io.Writer, debug *asm.DebugFile, program string) error {
+	stringIDs := map[string]uint64{"": 0}
+	var table []string
+	str := func(s string) uint64 {
+		id, ok := stringIDs[s]
+		if !ok {
+			id = uint64(len(table) + 1)
+			stringIDs[s] = id
+			table = append(table, s)
+		}
+		return id
+	}
+	var b protoBuffer
+	valueType := func(field int, typ, unit string) {
+		b.message(field, func(m *protoBuffer) {
+			m.uint64(1, str(typ))
+			m.uint64(2, str(unit))
+		})
+	}
+	valueType(1, "instructions", "count")
+
+	locations := make(map[uint16]uint64)
+	var order []uint16
+	for _, s := range p.Samples() {
+		ids := make([]uint64, len(s.Stack))
+		for i, pc := range s.Stack {
+			if _, ok := locations[pc]; !ok {
+				locations[pc] = uint64(len(locations) + 1)
+				order = append(order, pc)
+			}
+			ids[i] = locations[pc]
+		}
+		b.message(2, func(m *protoBuffer) {
+			m.packed(1, ids)
+			m.packed(2, []uint64{uint64(s.Count)})
+		})
+	}
+
+	b.message(3, func(m *protoBuffer) {
+		m.uint64(1, 1)
+		m.uint64(3, 0x10000)
+		m.uint64(5, str(program))
+		if debug != nil {
+			m.uint64(7, 1)
+			m.uint64(8, 1)
+			m.uint64(9, 1)
+		}
+	})
+
+	functions := make(map[string]uint64)
+	var funcs []functionEntry
+	for _, pc := range order {
+		name, start := function(debug, pc)
+		fn, ok := functions[name]
+		if !ok {
+			fn = uint64(len(functions) + 1)
+			functions[name] = fn
+			funcs = append(funcs, functionEntry{name: name, start: start})
+		}
+		line := 0
+		if debug != nil {
+			_, line = debug.SourceLine(pc, 0)
+		}
+		b.message(4, func(m *protoBuffer) {
+			m.uint64(1, locations[pc])
+			m.uint64(2, 1)
+			m.uint64(3, uint64(pc))
+			m.message(4, func(l *protoBuffer) {
+				l.uint64(1, fn)
+				l.uint64(2, uint64(line))
+			})
+		})
+	}
+	for i, f := range funcs {
+		file, line := "", 0
+		if debug != nil {
+			file, line = debug.SourceLine(uint16(f.start), 0)
+		}
+		b.message(5, func(m *protoBuffer) {
+			m.uint64(1, uint64(i+1))
+			m.uint64(2, str(f.name))
+			m.uint64(3, str(f.name))
+			m.uint64(4, str(file))
+			m.uint64(5, uint64(line))
+		})
+	}
+
+	// the period must be set before the string table is written
+	valueType(11, "instructions", "count")
+	b.uint64(12, 1)
+	b.string(6, "")
+	for _, s := range table {
+		b.string(6, s)
+	}
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(b.data); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+type functionEntry struct {
+	name  string
+	start int
+}
+
+// protoBuffer encodes protobuf fields.  Zero values are omitted, as proto3 does.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) key(field int, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+// string is always written, since the string table starts with "".
+func (b *protoBuffer) string(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.data = append(b.data, s...)
+}
+
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.key(field, wireBytes)
+	b.varint(uint64(len(p.data)))
+	b.data = append(b.data, p.data...)
+}
+
+func (b *protoBuffer) message(field int, encode func(*protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.key(field, wireBytes)
+	b.varint(uint64(len(m.data)))
+	b.data = append(b.data, m.data...)
+}
@@ -0,0 +1,252 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profile counts the instructions a program executes, and reports
+// them per function and source line as text or as a pprof profile.
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// Profile counts instructions executed at each address, by the call stack
+// they were executed in.  Calls are followed through jsr and ret/rst, so
+// each function's inclusive (cumulative) count includes its callees.
+type Profile struct {
+	root    *context
+	current *context
+	total   int64
+}
+
+// context is a call stack, as the jsr addresses that lead to it.
+type context struct {
+	parent *context
+	call   uint16 // address of the jsr that entered this context
+	calls  map[uint16]*context
+	counts map[uint16]int64 // instructions executed at each address
+}
+
+func newContext(parent *context, call uint16) *context {
+	return &context{parent: parent, call: call, counts: make(map[uint16]int64)}
+}
+
+// New returns an empty profile.
+func New() *Profile {
+	root := newContext(nil, 0)
+	return &Profile{root: root, current: root}
+}
+
+// Record counts one executed instruction, it's a machine.Tracer.
+func (p *Profile) Record(r *machine.TraceRecord) {
+	p.current.counts[r.PC]++
+	p.total++
+	switch r.Op {
+	case machine.Jsr:
+		child := p.current.calls[r.PC]
+		if child == nil {
+			if p.current.calls == nil {
+				p.current.calls = make(map[uint16]*context)
+			}
+			child = newContext(p.current, r.PC)
+			p.current.calls[r.PC] = child
+		}
+		p.current = child
+	case machine.Ret, machine.Rst:
+		// returning from the function the profile started in stays at the top
+		if p.current.parent != nil {
+			p.current = p.current.parent
+		}
+	}
+}
+
+// Total returns the number of instructions executed.
+func (p *Profile) Total() int64 {
+	return p.total
+}
+
+// Sample is the number of instructions executed at an address with a call
+// stack, from the address outwards to the outermost jsr.
+type Sample struct {
+	Stack []uint16
+	Count int64
+}
+
+// Samples returns the counts for each address and call stack, ordered by
+// stack so the result is stable.
+func (p *Profile) Samples() []Sample {
+	var samples []Sample
+	var walk func(c *context, calls []uint16)
+	walk = func(c *context, calls []uint16) {
+		for pc, count := range c.counts {
+			stack := append([]uint16{pc}, calls...)
+			samples = append(samples, Sample{Stack: stack, Count: count})
+		}
+		for call, child := range c.calls {
+			walk(child, append([]uint16{call}, calls...))
+		}
+	}
+	walk(p.root, nil)
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].Stack, samples[j].Stack
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[len(a)-1-k] != b[len(b)-1-k] {
+				return a[len(a)-1-k] < b[len(b)-1-k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return samples
+}
+
+// Entry is a function or source line in a report.  Flat counts instructions
+// in it, Cum also counts instructions in the functions it called.
+type Entry struct {
+	Name string
+	Flat int64
+	Cum  int64
+}
+
+// Functions returns the count for each function, largest flat count first.
+// Addresses are attributed to the global label at or before them, see
+// FunctionName.
+func (p *Profile) Functions(debug *asm.DebugFile) []Entry {
+	entries := make(map[string]*Entry)
+	entry := func(name string) *Entry {
+		e := entries[name]
+		if e == nil {
+			e = &Entry{Name: name}
+			entries[name] = e
+		}
+		return e
+	}
+	for _, s := range p.Samples() {
+		entry(FunctionName(debug, s.Stack[0])).Flat += s.Count
+		// recursive functions are only counted once per stack
+		seen := make(map[string]bool)
+		for _, pc := range s.Stack {
+			name := FunctionName(debug, pc)
+			if !seen[name] {
+				seen[name] = true
+				entry(name).Cum += s.Count
+			}
+		}
+	}
+	return sortEntries(entries)
+}
+
+// Lines returns the count for each source line, ie "hello.s:12", largest
+// flat count first.  Addresses without a line are shown by their symbol.
+func (p *Profile) Lines(debug *asm.DebugFile) []Entry {
+	entries := make(map[string]*Entry)
+	for _, s := range p.Samples() {
+		seen := make(map[string]bool)
+		for i, pc := range s.Stack {
+			name := lineName(debug, pc)
+			e := entries[name]
+			if e == nil {
+				e = &Entry{Name: name}
+				entries[name] = e
+			}
+			if i == 0 {
+				e.Flat += s.Count
+			}
+			if !seen[name] {
+				seen[name] = true
+				e.Cum += s.Count
+			}
+		}
+	}
+	return sortEntries(entries)
+}
+
+func sortEntries(entries map[string]*Entry) []Entry {
+	var list []Entry
+	for _, e := range entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Flat != list[j].Flat {
+			return list[i].Flat > list[j].Flat
+		}
+		if list[i].Cum != list[j].Cum {
+			return list[i].Cum > list[j].Cum
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// FunctionName returns the global label at or before pc, or pc in hex if
+// there's no debug info or label.
+func FunctionName(debug *asm.DebugFile, pc uint16) string {
+	name, _ := function(debug, pc)
+	return name
+}
+
+// function returns the name and address of the global label at or before pc.
+func function(debug *asm.DebugFile, pc uint16) (string, int) {
+	if debug != nil {
+		if label := debug.GlobalLabelAt(pc); label != nil {
+			return label.Name, label.Value
+		}
+	}
+	return fmt.Sprintf("0x%04x", pc), int(pc)
+}
+
+// lineName returns pc's source line as "file:line", or its function if it
+// doesn't have one.
+func lineName(debug *asm.DebugFile, pc uint16) string {
+	if debug != nil {
+		if file, line := debug.SourceLine(pc, 0); file != "" {
+			return fmt.Sprintf("%s:%d", file, line)
+		}
+	}
+	return FunctionName(debug, pc)
+}
+
+// WriteText writes a report of the instruction counts per function and per
+// source line, like "go tool pprof -top".
+func (p *Profile) WriteText(w io.Writer, debug *asm.DebugFile) error {
+	if _, err := fmt.Fprintf(w, "Total: %d instructions\n", p.total); err != nil {
+		return err
+	}
+	for _, section := range []struct {
+		title   string
+		entries []Entry
+	}{
+		{"function", p.Functions(debug)},
+		{"line", p.Lines(debug)},
+	} {
+		fmt.Fprintf(w, "\n%10s %7s %10s %7s  %s\n", "flat", "flat%", "cum", "cum%", section.title)
+		for _, e := range section.entries {
+			if _, err := fmt.Fprintf(w, "%10d %6.2f%% %10d %6.2f%%  %s\n",
+				e.Flat, p.percent(e.Flat), e.Cum, p.percent(e.Cum), e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Profile) percent(n int64) float64 {
+	if p.total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(p.total)
+}
@@ -0,0 +1,125 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSource = `
+		dw main
+		org 0x100
+main:	psh #3
+		jsr accum
+		pop #2
+		psh #4
+		jsr accum
+		pop #2
+		hlt
+accum(n word):
+		var total word
+		cpy total, n
+		jsr double
+		add count, total
+		rst
+double:	add count, count
+		ret
+count:	dw 0
+`
+
+func profileProgram(t *testing.T) (*Profile, *asm.DebugFile) {
+	linker, err := asm.BuildSource("test.s", testSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.NoError(t, err)
+	p := New()
+	m.SetTracer(p.Record)
+	m.Run()
+	return p, linker.DebugFile()
+}
+
+func entry(entries []Entry, name string) Entry {
+	for _, e := range entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return Entry{}
+}
+
+func TestFunctions(t *testing.T) {
+	p, debug := profileProgram(t)
+	// main: 6 instructions, accum: 2 * (sav, cpy, jsr, add, rst), double: 2 * 2
+	assert.Equal(t, int64(20), p.Total())
+	functions := p.Functions(debug)
+	assert.Equal(t, Entry{Name: "accum", Flat: 10, Cum: 14}, functions[0])
+	assert.Equal(t, Entry{Name: "main", Flat: 6, Cum: 20}, entry(functions, "main"))
+	assert.Equal(t, Entry{Name: "double", Flat: 4, Cum: 4}, entry(functions, "double"))
+}
+
+func TestLines(t *testing.T) {
+	p, debug := profileProgram(t)
+	lines := p.Lines(debug)
+	// each jsr in main counts its callee as cumulative
+	assert.Equal(t, Entry{Name: "test.s:5", Flat: 1, Cum: 8}, entry(lines, "test.s:5"))
+	assert.Equal(t, Entry{Name: "test.s:16", Flat: 2, Cum: 2}, entry(lines, "test.s:16"))
+}
+
+func TestSamples(t *testing.T) {
+	p, debug := profileProgram(t)
+	var stacks []string
+	for _, s := range p.Samples() {
+		if FunctionName(debug, s.Stack[0]) == "double" {
+			var names []string
+			for _, pc := range s.Stack {
+				names = append(names, FunctionName(debug, pc))
+			}
+			stacks = append(stacks, strings.Join(names, "<"))
+			assert.Equal(t, int64(1), s.Count)
+		}
+	}
+	// double runs once from each of the two calls to accum in main
+	assert.Equal(t, []string{"double<accum<main", "double<accum<main", "double<accum<main", "double<accum<main"}, stacks)
+}
+
+func TestWriteText(t *testing.T) {
+	p, debug := profileProgram(t)
+	var buf bytes.Buffer
+	assert.NoError(t, p.WriteText(&buf, debug))
+	text := buf.String()
+	assert.True(t, strings.HasPrefix(text, "Total: 20 instructions\n"), text)
+	assert.Contains(t, text, "        10  50.00%         14  70.00%  accum\n")
+	assert.Contains(t, text, "  test.s:5\n")
+}
+
+func TestWritePprof(t *testing.T) {
+	p, debug := profileProgram(t)
+	var buf bytes.Buffer
+	assert.NoError(t, p.WritePprof(&buf, debug, "test.bin"))
+	z, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(z)
+	assert.NoError(t, err)
+	// the string table has the sample type and function names
+	for _, s := range []string{"instructions", "count", "main", "accum", "double", "test.s", "test.bin"} {
+		assert.True(t, bytes.Contains(data, []byte(s)), s)
+	}
+}
+
+func TestProtoBuffer(t *testing.T) {
+	var b protoBuffer
+	b.uint64(1, 150)
+	b.uint64(2, 0)
+	b.string(3, "hi")
+	b.packed(4, []uint64{1, 300})
+	b.message(5, func(m *protoBuffer) { m.uint64(1, 1) })
+	assert.Equal(t, []byte{0x08, 0x96, 0x01, 0x1a, 2, 'h', 'i', 0x22, 3, 1, 0xac, 0x02, 0x2a, 2, 0x08, 1}, b.data)
+}
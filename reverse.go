@@ -0,0 +1,106 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultHistory is how many instructions the monitor can step back over.
+const defaultHistory = 100000
+
+// back undoes one or more instructions.
+func (m *Monitor) back(cmd []string) {
+	n := 1
+	if len(cmd) > 1 {
+		var err error
+		if n, err = strconv.Atoi(cmd[1]); err != nil || n < 1 {
+			m.errorf("invalid count '%s'\n", cmd[1])
+			return
+		}
+	}
+	for i := 0; i < n; i++ {
+		if !m.machine.StepBack() {
+			fmt.Fprintf(m.out, "reached the start of the history\n")
+			break
+		}
+	}
+	m.showPC()
+}
+
+// reverseContinue runs backwards to the previous breakpoint, or the last
+// write to a watched address.
+func (m *Monitor) reverseContinue() {
+	m.machine.ReverseContinue()
+	if m.machine.Stopped() != nil {
+		m.printStop()
+		m.printStatus()
+		m.next = int(m.machine.Flags().PC)
+		return
+	}
+	fmt.Fprintf(m.out, "reached the start of the history\n")
+	m.showPC()
+}
+
+// who shows the instruction that last wrote an address.
+func (m *Monitor) who(cmd []string) {
+	if len(cmd) < 2 {
+		m.errorf("usage: who address\n")
+		return
+	}
+	addr, err := m.address(strings.Join(cmd[1:], " "))
+	if err != nil {
+		m.errorf("%s\n", err)
+		return
+	}
+	w, ok := m.machine.LastWriteTo(uint16(addr))
+	if !ok {
+		fmt.Fprintf(m.out, "%s not written in the last %d instructions\n", m.formatAddr(addr), m.machine.HistoryLen())
+		return
+	}
+	format := "0x%02x -> 0x%02x"
+	if w.Size == 2 {
+		format = "0x%04x -> 0x%04x"
+	}
+	fmt.Fprintf(m.out, "%s written %d instructions ago: %s\n", m.formatAddr(int(w.Addr)), w.Steps,
+		fmt.Sprintf(format, w.Old, w.New))
+	m.List(m.out, int(w.PC), 1)
+}
+
+// history shows or sets how many instructions are recorded.
+func (m *Monitor) history(cmd []string) {
+	if len(cmd) > 1 {
+		n, err := strconv.Atoi(cmd[1])
+		if err != nil || n < 0 {
+			m.errorf("invalid count '%s'\n", cmd[1])
+			return
+		}
+		m.historyLimit = n
+		m.machine.EnableHistory(n)
+	}
+	if m.historyLimit == 0 {
+		fmt.Fprintf(m.out, "history is off\n")
+		return
+	}
+	fmt.Fprintf(m.out, "recording the last %d instructions, %d to step back over\n", m.historyLimit, m.machine.HistoryLen())
+}
+
+// enableHistory starts recording with the default limit.
+func (m *Monitor) enableHistory() {
+	m.historyLimit = defaultHistory
+	m.machine.EnableHistory(defaultHistory)
+}
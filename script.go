@@ -0,0 +1,156 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// expandVars replaces each $name in line with the decimal value of the
+// variable set by let.
+func (m *Monitor) expandVars(line string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] != '$' || i+1 >= len(line) || !isNameStart(line[i+1]) {
+			sb.WriteByte(line[i])
+			continue
+		}
+		j := i + 1
+		for j < len(line) && (isNameStart(line[j]) || (line[j] >= '0' && line[j] <= '9')) {
+			j++
+		}
+		name := line[i+1 : j]
+		value, ok := m.vars[name]
+		if !ok {
+			return "", fmt.Errorf("undefined variable $%s", name)
+		}
+		sb.WriteString(strconv.Itoa(value))
+		i = j - 1
+	}
+	return sb.String(), nil
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// let handles "let name = expr", where expr is evaluated now as a 16 bit
+// value.
+func (m *Monitor) let(cmd []string) {
+	if len(cmd) < 4 || cmd[2] != "=" || !isName(cmd[1]) {
+		m.errorf("expected: let name = expr\n")
+		return
+	}
+	v, err := m.parseExpr(strings.Join(cmd[3:], " "))
+	if err != nil {
+		m.errorf("invalid value (%s)\n", err)
+		return
+	}
+	if m.vars == nil {
+		m.vars = make(map[string]int)
+	}
+	m.vars[cmd[1]] = v(m.machine) & 0xffff
+}
+
+func isName(s string) bool {
+	if s == "" || !isNameStart(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && (s[i] < '0' || s[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// echo handles "echo [text]*", printing its arguments separated by spaces
+// with double quoted strings unquoted.
+func (m *Monitor) echo(cmd []string) {
+	args := make([]string, 0, len(cmd)-1)
+	for _, arg := range cmd[1:] {
+		if strings.HasPrefix(arg, "\"") {
+			if s, err := strconv.Unquote(arg); err == nil {
+				arg = s
+			}
+		}
+		args = append(args, arg)
+	}
+	fmt.Fprintln(m.out, strings.Join(args, " "))
+}
+
+// ifThen handles "if condition then command".
+func (m *Monitor) ifThen(cmd []string) {
+	then := -1
+	for i, arg := range cmd {
+		if arg == "then" {
+			then = i
+			break
+		}
+	}
+	if then < 2 || then == len(cmd)-1 {
+		m.errorf("expected: if condition then command\n")
+		return
+	}
+	cond, err := m.parseCondition(strings.Join(cmd[1:then], " "))
+	if err != nil {
+		m.errorf("invalid condition (%s)\n", err)
+		return
+	}
+	if cond(m.machine) {
+		m.Execute(strings.Join(cmd[then+1:], " "))
+	}
+}
+
+// errorf prints why a command failed.  In a script it also fails the run,
+// with the line of the command that failed.
+func (m *Monitor) errorf(format string, args ...interface{}) {
+	if m.line > 0 {
+		fmt.Fprintf(m.out, "error at line %d: ", m.line)
+		m.failed = true
+	}
+	fmt.Fprintf(m.out, format, args...)
+}
+
+// assert handles "assert condition", printing a line starting with "assert
+// failed" and marking the run as failed if the condition is false or can't
+// be parsed.
+func (m *Monitor) assert(cmd []string) {
+	text := strings.Join(cmd[1:], " ")
+	where := ""
+	if m.line > 0 {
+		where = fmt.Sprintf(" at line %d", m.line)
+	}
+	c, err := m.parseComparison(text)
+	if err != nil {
+		fmt.Fprintf(m.out, "assert failed%s: invalid condition (%s)\n", where, err)
+		m.failed = true
+		return
+	}
+	if !c.test(m.machine) {
+		fmt.Fprintf(m.out, "assert failed%s: %s (%s is %d)\n", where, text, c.text, c.left(m.machine)&0xffff)
+		m.failed = true
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe, so
+// commands piped to the monitor are run as a script.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMonitor returns a monitor for a machine with pc at 0x100 and its
+// output.
+func testMonitor() (*Monitor, *bytes.Buffer) {
+	code := make([]byte, 0x110)
+	code[0], code[1] = 0x00, 0x01
+	var out bytes.Buffer
+	m := newMonitor(machine.NewMachine(code), nil)
+	m.out = &out
+	return m, &out
+}
+
+func TestScriptPasses(t *testing.T) {
+	m, out := testMonitor()
+	ok := m.Run(strings.NewReader("# comment\nlet x = 2 + 3\necho x is $x\nassert $x == 5\n"), false)
+	assert.True(t, ok)
+	assert.Equal(t, "x is 5\n", out.String())
+}
+
+func TestScriptValuesAre16Bit(t *testing.T) {
+	m, out := testMonitor()
+	script := "setw 0x200 0xffff\nassert w[0x200] == -1\nlet x = 70000\necho x is $x\nassert $x == 70000\n"
+	ok := m.Run(strings.NewReader(script), false)
+	assert.True(t, ok, out.String())
+	assert.Equal(t, "wrote 2 bytes at 0x0200\nx is 4464\n", out.String())
+}
+
+func TestScriptAssertFails(t *testing.T) {
+	m, out := testMonitor()
+	ok := m.Run(strings.NewReader("assert pc == 0x200\necho never\n"), false)
+	assert.False(t, ok)
+	assert.Equal(t, "assert failed at line 1: pc == 0x200 (pc is 256)\n", out.String())
+}
+
+func TestScriptCommandErrorsFail(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		output string
+	}{
+		{"bogus\n", "error at line 1: unknown command 'bogus', type help for a list of commands\n"},
+		{"echo ok\nd zzz\n", "ok\nerror at line 2: invalid addr"},
+		{"let x\n", "error at line 1: expected: let name = expr\n"},
+		{"echo $x\n", "error at line 1: undefined variable $x\n"},
+		{"reg pc\n", "error at line 1: expected: reg pc|sp|fp value\n"},
+		{"if pc == 0x100 then bogus\n", "error at line 1: unknown command 'bogus'"},
+	} {
+		m, out := testMonitor()
+		ok := m.Run(strings.NewReader(test.script+"echo never\n"), false)
+		assert.False(t, ok, test.script)
+		assert.True(t, strings.HasPrefix(out.String(), test.output), out.String())
+		assert.NotContains(t, out.String(), "never", test.script)
+	}
+}
+
+func TestInteractiveErrorsDontFail(t *testing.T) {
+	m, out := testMonitor()
+	ok := m.Run(strings.NewReader("bogus\nq\n"), true)
+	assert.True(t, ok)
+	assert.Contains(t, out.String(), "> unknown command 'bogus'")
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+)
+
+// defaultStackWords is how many words stack shows without a count.
+const defaultStackWords = 16
+
+// maxStackFrames limits the frame pointer chain walked by stackRoles, in
+// case it's corrupt.
+const maxStackFrames = 64
+
+// stack handles "stack [count]" to show words from sp up with their roles,
+// and "stack limit [address|off]" to show or set the lowest address sp
+// should reach.
+func (m *Monitor) stack(cmd []string) {
+	if len(cmd) > 1 && cmd[1] == "limit" {
+		m.setStackLimit(cmd[2:])
+		return
+	}
+	count := defaultStackWords
+	if len(cmd) > 1 {
+		n, err := m.address(cmd[1])
+		if err != nil || n == 0 {
+			m.errorf("invalid count (%s)\n", cmd[1])
+			return
+		}
+		count = n
+	}
+	m.checkStack()
+	flags := m.machine.Flags()
+	if flags.SP == 0 {
+		fmt.Fprintf(m.out, "stack is empty (sp=0x0000)\n")
+		return
+	}
+	for _, line := range m.stackLines(count) {
+		fmt.Fprintln(m.out, line)
+	}
+}
+
+func (m *Monitor) setStackLimit(args []string) {
+	switch {
+	case len(args) == 0 && m.limit() == 0:
+		fmt.Fprintf(m.out, "no stack limit\n")
+	case len(args) == 0:
+		fmt.Fprintf(m.out, "stack limit is %s\n", m.formatAddr(m.limit()))
+	case args[0] == "off":
+		m.stackLimit = 0
+	default:
+		limit, err := m.address(args[0])
+		if err != nil {
+			m.errorf("invalid addr (%s)\n", err)
+			return
+		}
+		m.stackLimit = limit
+	}
+}
+
+// limit returns the stack limit, which defaults to the low end of the
+// machine's stack bounds.
+func (m *Monitor) limit() int {
+	if m.stackLimit == 0 {
+		if low, _, ok := m.machine.StackBounds(); ok {
+			return int(low)
+		}
+	}
+	return m.stackLimit
+}
+
+// checkStack prints a warning if sp is below the stack limit.
+func (m *Monitor) checkStack() {
+	sp, limit := int(m.machine.Flags().SP), m.limit()
+	if limit != 0 && sp != 0 && sp < limit {
+		fmt.Fprintf(m.out, "warning: sp 0x%04x is %d bytes below the stack limit %s\n",
+			sp, limit-sp, m.formatAddr(limit))
+	}
+}
+
+// stackLines formats up to count words from sp up, stopping at the top of
+// memory, each with its roles.
+func (m *Monitor) stackLines(count int) []string {
+	flags := m.machine.Flags()
+	roles := m.stackRoles()
+	var lines []string
+	for i := 0; i < count; i++ {
+		addr := int(flags.SP) + 2*i
+		if addr > 0xfffe {
+			break
+		}
+		var notes []string
+		for _, a := range []int{addr, addr + 1} {
+			notes = append(notes, roles[a]...)
+		}
+		if addr == int(flags.SP) {
+			notes = append(notes, "<- sp")
+		}
+		if addr == int(flags.FP) {
+			notes = append(notes, "<- fp")
+		}
+		line := fmt.Sprintf("0x%04x  0x%04x", addr, m.memory.GetWord(uint16(addr)))
+		if len(notes) > 0 {
+			line += "  " + strings.Join(notes, ", ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+/*
+stackRoles walks the frame pointer chain and returns what's stored at each
+address on the stack: the saved fp and return address of each frame, and
+with debug info, the args and locals of each function by name.  A function
+whose sav hasn't run yet, or code without a frame called from a function,
+has its return address on top of the stack.  See asm.BacktraceFrom for the
+frame layout.
+*/
+func (m *Monitor) stackRoles() map[int][]string {
+	roles := make(map[int][]string)
+	add := func(addr int, role string) {
+		roles[addr&0xffff] = append(roles[addr&0xffff], role)
+	}
+	flags := m.machine.Flags()
+	pc, fp := int(flags.PC), int(flags.FP)
+	slots := func(fp int) {
+		if m.debug == nil {
+			return
+		}
+		fn := m.debug.FunctionAt(uint16(pc))
+		if fn == nil {
+			return
+		}
+		for _, slot := range append(append([]asm.FrameSlot{}, fn.Args...), fn.Locals...) {
+			add(fp+slot.Offset, fn.Name+"."+slot.Name)
+		}
+	}
+	if m.debug != nil && flags.SP != 0 {
+		fn := m.debug.FunctionAt(uint16(pc))
+		ret := int(m.memory.GetWord(flags.SP))
+		switch {
+		case fn != nil && pc == int(fn.Addr):
+			// sav will push fp just below the return address
+			add(int(flags.SP), "return to "+m.returnLabel(ret))
+			slots(int(flags.SP) - 2)
+			pc = ret
+		case fn == nil && fp != 0 && asm.FollowsCall(m.memory, uint16(ret)):
+			add(int(flags.SP), "return to "+m.returnLabel(ret))
+			pc = ret
+		}
+	}
+	for i := 0; i < maxStackFrames && fp != 0; i++ {
+		ret := int(m.memory.GetWord(uint16(fp + 2)))
+		slots(fp)
+		add(fp, "saved fp")
+		add(fp+2, "return to "+m.returnLabel(ret))
+		caller := int(m.memory.GetWord(uint16(fp)))
+		if caller != 0 && caller <= fp {
+			break // fp must move up the stack, else it's corrupt
+		}
+		pc, fp = ret, caller
+	}
+	return roles
+}
+
+// returnLabel formats a return address with its symbol, if known.
+func (m *Monitor) returnLabel(addr int) string {
+	if sym := m.symbolize(addr); sym != "" {
+		return sym
+	}
+	return fmt.Sprintf("0x%04x", addr)
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const stackSource = `
+		dw main
+		org 0x100
+main():
+		var total word
+		psh #3
+		jsr sum
+		pop #2
+		hlt
+
+sum(n word):
+		var acc word
+		cpy acc, n
+		jsr leaf
+		rst
+
+leaf:	inc 0x200
+		ret
+`
+
+// stackAt runs stackSource to label and returns the output of script.
+func stackAt(t *testing.T, label string, script string) string {
+	m, out := sourceMonitor(t, stackSource)
+	assert.True(t, m.Run(strings.NewReader("break "+label+"\ncont\n"), false), out.String())
+	out.Reset()
+	m.Run(strings.NewReader(script), false)
+	return out.String()
+}
+
+func TestStackNestedCall(t *testing.T) {
+	// leaf has no frame, so its return address is on top of the stack
+	assert.Equal(t, `0xfff2  0x0113  return to sum+8, <- sp
+0xfff4  0x0003  sum.acc
+0xfff6  0xfffe  saved fp, <- fp
+0xfff8  0x0108  return to main+8
+0xfffa  0x0003  sum.n
+0xfffc  0x0000  main.total
+0xfffe  0x0000  saved fp
+`, stackAt(t, "leaf", "stack\n"))
+}
+
+func TestStackAtFunctionEntry(t *testing.T) {
+	// sav hasn't run, so fp is still main's
+	assert.Equal(t, `0xfff8  0x0108  return to main+8, <- sp
+0xfffa  0x0003  sum.n
+0xfffc  0x0000  main.total
+0xfffe  0x0000  saved fp, <- fp
+`, stackAt(t, "sum", "stack\n"))
+}
+
+func TestStackCount(t *testing.T) {
+	assert.Equal(t, `0xfff2  0x0113  return to sum+8, <- sp
+0xfff4  0x0003  sum.acc
+`, stackAt(t, "leaf", "stack 2\n"))
+}
+
+func TestStackCorruptFP(t *testing.T) {
+	// sum's saved fp points below its own frame, so the walk stops there
+	assert.Equal(t, `wrote 2 bytes at 0xfff6
+0xfff2  0x0113  return to sum+8, <- sp
+0xfff4  0x0003  sum.acc
+0xfff6  0xfff0  saved fp, <- fp
+0xfff8  0x0108  return to main+8
+0xfffa  0x0003  sum.n
+0xfffc  0x0000
+0xfffe  0x0000
+`, stackAt(t, "leaf", "setw 0xfff6 0xfff0\nstack\n"))
+}
+
+func TestStackLimit(t *testing.T) {
+	out := stackAt(t, "leaf", "stack limit\nstack limit 0xfff8\nstack limit\nstack 1\nstack limit off\nstack 1\n")
+	assert.Equal(t, `no stack limit
+stack limit is 0xfff8
+warning: sp 0xfff2 is 6 bytes below the stack limit 0xfff8
+0xfff2  0x0113  return to sum+8, <- sp
+0xfff2  0x0113  return to sum+8, <- sp
+`, out)
+}
+
+func TestStackEmpty(t *testing.T) {
+	m, out := testMonitor()
+	assert.True(t, m.Run(strings.NewReader("stack\n"), false))
+	assert.Equal(t, "stack is empty (sp=0x0000)\n", out.String())
+}
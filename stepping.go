@@ -0,0 +1,190 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jsando/mpu/machine"
+)
+
+// maxStepInstructions limits how long next and finish run, so a loop that
+// never reaches a new line or returns gives control back to the prompt.
+const maxStepInstructions = 10000000
+
+// sourceText returns the source line for the instruction at addr as
+// "file:line: text", "file:line" if the file can't be read, or "" if there's
+// no debug info for addr.
+func (m *Monitor) sourceText(addr int) string {
+	loc := m.sourceLine(addr)
+	if loc == "" {
+		return ""
+	}
+	file, line := m.debug.SourceLine(uint16(addr), m.bankAt(addr))
+	lines, ok := m.sources[file]
+	if !ok {
+		lines = readLines(file)
+		if m.sources == nil {
+			m.sources = make(map[string][]string)
+		}
+		m.sources[file] = lines
+	}
+	if line < 1 || line > len(lines) {
+		return loc
+	}
+	return fmt.Sprintf("%s: %s", loc, strings.TrimSpace(lines[line-1]))
+}
+
+// readLines returns the lines of a file, or nil if it can't be read.
+func readLines(name string) []string {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// bankAt returns the bank addr is read from.
+func (m *Monitor) bankAt(addr int) int {
+	if addr >= machine.BankWindowStart && addr <= machine.BankWindowEnd {
+		return m.machine.Banks().Selected()
+	}
+	return 0
+}
+
+// opAt decodes the instruction at addr.
+func (m *Monitor) opAt(addr uint16) machine.OpCode {
+	op, _, _ := machine.DecodeOp(m.memory.GetByte(addr))
+	return op
+}
+
+// stepInstruction executes one instruction, returning false if the machine
+// is halted, faulted, or a watchpoint stopped it.
+func (m *Monitor) stepInstruction() bool {
+	pc := m.machine.Flags().PC
+	if m.opAt(pc) == machine.Hlt {
+		fmt.Fprintf(m.out, "halted\n")
+		return false
+	}
+	m.machine.Step(pc)
+	if m.machine.Fault() != nil {
+		m.printFault()
+		return false
+	}
+	if stop := m.machine.Stopped(); stop != nil {
+		fmt.Fprintf(m.out, "stopped: %s\n", stop)
+		return false
+	}
+	return true
+}
+
+// atBreakpoint returns true if there's a breakpoint at pc whose condition
+// is true, since Step doesn't check breakpoints.  The hit is counted and
+// shown the same as when Run stops at it.
+func (m *Monitor) atBreakpoint() bool {
+	if !m.machine.CheckBreakpoint() {
+		return false
+	}
+	fmt.Fprintf(m.out, "stopped: %s\n", m.machine.Stopped())
+	return true
+}
+
+// stepOver executes one instruction, or a whole call if it's a jsr.
+func (m *Monitor) stepOver() bool {
+	isCall := m.opAt(m.machine.Flags().PC) == machine.Jsr
+	if !m.stepInstruction() {
+		return false
+	}
+	if isCall {
+		return m.runToReturn()
+	}
+	return !m.atBreakpoint()
+}
+
+// runToReturn runs until the current function returns, counting nested
+// calls so a ret or rst only finishes the function it started in.
+func (m *Monitor) runToReturn() bool {
+	depth := 0
+	for i := 0; i < maxStepInstructions; i++ {
+		op := m.opAt(m.machine.Flags().PC)
+		if !m.stepInstruction() {
+			return false
+		}
+		switch op {
+		case machine.Jsr:
+			depth++
+		case machine.Ret, machine.Rst:
+			depth--
+			if depth < 0 {
+				return true
+			}
+		}
+		if m.atBreakpoint() {
+			return false
+		}
+	}
+	fmt.Fprintf(m.out, "still running after %d instructions\n", maxStepInstructions)
+	return false
+}
+
+// nextLine runs to the next source line and shows it.
+func (m *Monitor) nextLine() {
+	m.runToNextLine()
+	m.showPC()
+}
+
+// runToNextLine runs to the next source line, stepping over calls.  Without
+// debug info it steps over one instruction.
+func (m *Monitor) runToNextLine() {
+	start := m.sourceLine(int(m.machine.Flags().PC))
+	for i := 0; i < maxStepInstructions; i++ {
+		if !m.stepOver() {
+			break
+		}
+		loc := m.sourceLine(int(m.machine.Flags().PC))
+		if start == "" || (loc != "" && loc != start) {
+			break
+		}
+	}
+}
+
+// over steps over one instruction, running a whole call if it's a jsr.
+func (m *Monitor) over() {
+	m.stepOver()
+	m.showPC()
+}
+
+// finish runs until the current function returns.
+func (m *Monitor) finish() {
+	m.runToReturn()
+	m.showPC()
+}
+
+// showPC lists the instruction at pc followed by the registers.
+func (m *Monitor) showPC() {
+	pc := int(m.machine.Flags().PC)
+	m.List(m.out, pc, 1)
+	m.printStatus()
+	m.next = pc
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jsando/mpu/machine"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSteppingStopsAtBreakpoints(t *testing.T) {
+	m, out := testMonitor()
+	// inc *0x200 at 0x100, 0x103 and 0x106
+	for pc := 0x100; pc < 0x109; pc += 3 {
+		m.memory.PutByte(uint16(pc), machine.EncodeOp(machine.Inc, machine.Absolute, machine.Implied))
+		m.memory.PutWord(uint16(pc+1), 0x200)
+	}
+	ok := m.Run(strings.NewReader("break 0x106\nover\nover\nbreak\n"), false)
+	assert.True(t, ok)
+	assert.Contains(t, out.String(), "stopped: breakpoint 1 at 0x0106\n")
+	assert.Contains(t, out.String(), "1  break 0x0106  (hits 1)\n")
+}
@@ -0,0 +1,386 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// Coverage counts how often each source line's instructions are executed,
+// and how often conditional jumps are taken and not taken.
+type Coverage struct {
+	lines []*LineCoverage
+	byPC  map[uint16]*LineCoverage
+}
+
+// LineCoverage is the coverage of one source line with code.
+type LineCoverage struct {
+	File     string
+	Line     int
+	Count    int64 // times an instruction on the line executed
+	Branch   bool  // the line is a conditional jump
+	Taken    int64
+	NotTaken int64
+}
+
+// Covered reports if the line executed, and for a branch if it went both ways.
+func (l *LineCoverage) Covered() bool {
+	if l.Branch {
+		return l.Taken > 0 && l.NotTaken > 0
+	}
+	return l.Count > 0
+}
+
+// FileCoverage totals the coverage of a file.
+type FileCoverage struct {
+	File            string
+	Lines           int
+	LinesCovered    int
+	Branches        int // each conditional jump is two branches, taken and not taken
+	BranchesCovered int
+}
+
+// LinePercent returns the percentage of lines executed.
+func (f FileCoverage) LinePercent() float64 {
+	return percent(f.LinesCovered, f.Lines)
+}
+
+// BranchPercent returns the percentage of branches taken.
+func (f FileCoverage) BranchPercent() float64 {
+	return percent(f.BranchesCovered, f.Branches)
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// NewCoverage returns coverage for the instructions in the line table, with
+// nothing executed yet.  The instructions are decoded from memory to find
+// conditional jumps.  Only main memory is covered, not banks.
+func NewCoverage(debugInfo []asm.DebugInfo, memory machine.Memory) *Coverage {
+	c := &Coverage{byPC: make(map[uint16]*LineCoverage)}
+	byLine := make(map[string]*LineCoverage)
+	for _, info := range debugInfo {
+		if info.Bank != 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s:%d", info.File, info.Line)
+		l := byLine[key]
+		if l == nil {
+			l = &LineCoverage{File: info.File, Line: info.Line}
+			byLine[key] = l
+			c.lines = append(c.lines, l)
+		}
+		if isConditionalJump(memory.GetByte(info.PC)) {
+			l.Branch = true
+		}
+		c.byPC[info.PC] = l
+	}
+	c.sort()
+	return c
+}
+
+// isConditionalJump reports if opcode is a jump that depends on the flags.
+func isConditionalJump(opcode byte) bool {
+	op, _, _ := machine.DecodeOp(opcode)
+	switch op {
+	case machine.Jeq, machine.Jne, machine.Jge, machine.Jlt, machine.Jcs, machine.Jcc:
+		return true
+	}
+	return false
+}
+
+func (c *Coverage) sort() {
+	sort.SliceStable(c.lines, func(i, j int) bool {
+		if c.lines[i].File != c.lines[j].File {
+			return c.lines[i].File < c.lines[j].File
+		}
+		return c.lines[i].Line < c.lines[j].Line
+	})
+}
+
+// Record counts an executed instruction, it's a machine.Tracer.
+func (c *Coverage) Record(r *machine.TraceRecord) {
+	l := c.byPC[r.PC]
+	if l == nil {
+		return
+	}
+	l.Count++
+	if l.Branch {
+		if r.Flags.PC != r.PC+uint16(len(r.Code)) {
+			l.Taken++
+		} else {
+			l.NotTaken++
+		}
+	}
+}
+
+// Lines returns the coverage of each line with code, by file and line.
+func (c *Coverage) Lines() []*LineCoverage {
+	return c.lines
+}
+
+// Files returns the totals for each file, by name.
+func (c *Coverage) Files() []FileCoverage {
+	var files []FileCoverage
+	for _, l := range c.lines {
+		if len(files) == 0 || files[len(files)-1].File != l.File {
+			files = append(files, FileCoverage{File: l.File})
+		}
+		f := &files[len(files)-1]
+		f.Lines++
+		if l.Count > 0 {
+			f.LinesCovered++
+		}
+		if l.Branch {
+			f.Branches += 2
+			for _, n := range []int64{l.Taken, l.NotTaken} {
+				if n > 0 {
+					f.BranchesCovered++
+				}
+			}
+		}
+	}
+	return files
+}
+
+// Total returns the totals for all files.
+func (c *Coverage) Total() FileCoverage {
+	total := FileCoverage{File: "total"}
+	for _, f := range c.Files() {
+		total.Lines += f.Lines
+		total.LinesCovered += f.LinesCovered
+		total.Branches += f.Branches
+		total.BranchesCovered += f.BranchesCovered
+	}
+	return total
+}
+
+// WriteSummary writes the percentage of lines and branches covered in
+// each file, then the total.
+func (c *Coverage) WriteSummary(w io.Writer) error {
+	files := c.Files()
+	if len(files) > 1 {
+		files = append(files, c.Total())
+	}
+	width := 0
+	for _, f := range files {
+		if len(f.File) > width {
+			width = len(f.File)
+		}
+	}
+	for _, f := range files {
+		if _, err := fmt.Fprintf(w, "coverage: %-*s %5.1f%% of lines (%d/%d), %5.1f%% of branches (%d/%d)\n",
+			width, f.File, f.LinePercent(), f.LinesCovered, f.Lines,
+			f.BranchPercent(), f.BranchesCovered, f.Branches); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coverProfileHeader is the first line of a coverage profile.
+const coverProfileHeader = "mode: count"
+
+/*
+WriteProfile writes the coverage as text, a header then one line per source
+line with code:
+
+	mode: count
+	file:line count
+	file:line count taken not-taken
+
+The second form is for conditional jumps.
+*/
+func (c *Coverage) WriteProfile(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, coverProfileHeader)
+	for _, l := range c.lines {
+		if l.Branch {
+			fmt.Fprintf(bw, "%s:%d %d %d %d\n", l.File, l.Line, l.Count, l.Taken, l.NotTaken)
+		} else {
+			fmt.Fprintf(bw, "%s:%d %d\n", l.File, l.Line, l.Count)
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadCoverProfile reads a coverage profile written by WriteProfile.
+func ReadCoverProfile(r io.Reader) (*Coverage, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != coverProfileHeader {
+		return nil, errors.New("not a coverage profile")
+	}
+	c := &Coverage{}
+	for n := 2; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		l, err := parseCoverLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		c.lines = append(c.lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	c.sort()
+	return c, nil
+}
+
+// parseCoverLine parses "file:line count [taken not-taken]".
+func parseCoverLine(text string) (*LineCoverage, error) {
+	colon := strings.LastIndexByte(text, ':')
+	if colon < 0 {
+		return nil, fmt.Errorf("invalid coverage '%s'", text)
+	}
+	var values []int64
+	for _, field := range strings.Fields(text[colon+1:]) {
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", field)
+		}
+		values = append(values, v)
+	}
+	if len(values) != 2 && len(values) != 4 {
+		return nil, fmt.Errorf("invalid coverage '%s'", text)
+	}
+	l := &LineCoverage{File: text[:colon], Line: int(values[0]), Count: values[1]}
+	if len(values) == 4 {
+		l.Branch, l.Taken, l.NotTaken = true, values[2], values[3]
+	}
+	return l, nil
+}
+
+// fileLines returns the coverage of each line in file, by line number.
+func (c *Coverage) fileLines(file string) map[int]*LineCoverage {
+	lines := make(map[int]*LineCoverage)
+	for _, l := range c.lines {
+		if l.File == file {
+			lines[l.Line] = l
+		}
+	}
+	return lines
+}
+
+// WriteAnnotated writes each file's source with the number of times each
+// line executed, "#####" for lines with code that never executed and "-" for
+// lines without code, like gcov.  Conditional jumps also show how often
+// they were taken.
+func (c *Coverage) WriteAnnotated(w io.Writer, sources *SourceReader) error {
+	for i, f := range c.Files() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %.1f%% of lines, %.1f%% of branches\n", f.File, f.LinePercent(), f.BranchPercent())
+		source, err := sources.getLines(f.File)
+		if err != nil {
+			return err
+		}
+		covered := c.fileLines(f.File)
+		for n, text := range source {
+			count := "-"
+			if l := covered[n+1]; l != nil {
+				count = "#####"
+				if l.Count > 0 {
+					count = strconv.FormatInt(l.Count, 10)
+				}
+				if l.Branch {
+					text = fmt.Sprintf("%s    [taken %d, not taken %d]", text, l.Taken, l.NotTaken)
+				}
+			}
+			if _, err := fmt.Fprintf(w, "%9s:%5d: %s\n", count, n+1, text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteHTML writes each file's source as a web page, with lines that
+// executed in green, those that didn't in red, and conditional jumps that
+// only went one way in yellow.
+func (c *Coverage) WriteHTML(w io.Writer, sources *SourceReader) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprint(bw, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mpu coverage</title>
+<style>
+body { background: #fff; color: #000; font-family: sans-serif; }
+pre { font-family: monospace; }
+.count { color: #888; display: inline-block; text-align: right; width: 6em; }
+.cov { color: #080; }
+.partial { color: #a60; }
+.uncov { color: #c00; }
+.none { color: #888; }
+</style>
+</head>
+<body>
+`)
+	total := c.Total()
+	fmt.Fprintf(bw, "<h1>Coverage: %.1f%% of lines, %.1f%% of branches</h1>\n<ul>\n", total.LinePercent(), total.BranchPercent())
+	for i, f := range c.Files() {
+		fmt.Fprintf(bw, "<li><a href=\"#file%d\">%s</a> %.1f%% of lines, %.1f%% of branches</li>\n",
+			i, html.EscapeString(f.File), f.LinePercent(), f.BranchPercent())
+	}
+	fmt.Fprint(bw, "</ul>\n")
+	for i, f := range c.Files() {
+		source, err := sources.getLines(f.File)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "<h2 id=\"file%d\">%s</h2>\n<pre>\n", i, html.EscapeString(f.File))
+		covered := c.fileLines(f.File)
+		for n, text := range source {
+			class, count, title := "none", "", ""
+			if l := covered[n+1]; l != nil {
+				count = strconv.FormatInt(l.Count, 10)
+				switch {
+				case l.Covered():
+					class = "cov"
+				case l.Count > 0:
+					class = "partial"
+				default:
+					class = "uncov"
+				}
+				if l.Branch {
+					title = fmt.Sprintf(" title=\"taken %d, not taken %d\"", l.Taken, l.NotTaken)
+				}
+			}
+			fmt.Fprintf(bw, "<span class=\"count\">%s</span> <span class=\"%s\"%s>%s</span>\n",
+				count, class, title, html.EscapeString(text))
+		}
+		fmt.Fprint(bw, "</pre>\n")
+	}
+	fmt.Fprint(bw, "</body>\n</html>\n")
+	return bw.Flush()
+}
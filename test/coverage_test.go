@@ -0,0 +1,122 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const coverSource = `
+		org 0x100
+abs(n word):
+		cmp n, #0
+		jge done
+		mul n, #-1
+.done:	cpy result, n
+		rst
+unused:	ret
+result:	dw 0
+
+test TestAbs():
+		psh #5
+		jsr abs
+		pop #2
+		sea
+		cmp result, #5
+		ret
+`
+
+func runCoverage(t *testing.T) *Coverage {
+	m, symbols, debugInfo := compileAndLoad(t, coverSource)
+	suite := &TestSuite{Tests: []TestInfo{{Name: "TestAbs", Function: "TestAbs"}}}
+	coverage := NewCoverage(debugInfo, m.Memory())
+	m.SetTracer(coverage.Record)
+	executor := NewTestExecutor(m, suite, symbols, debugInfo)
+	assert.NoError(t, executor.Run())
+	passed, _ := executor.Summary()
+	assert.Equal(t, 1, passed)
+	return coverage
+}
+
+func coverLine(c *Coverage, line int) *LineCoverage {
+	for _, l := range c.Lines() {
+		if l.Line == line {
+			return l
+		}
+	}
+	return nil
+}
+
+func TestCoverageLines(t *testing.T) {
+	c := runCoverage(t)
+	assert.Equal(t, int64(1), coverLine(c, 4).Count)
+	assert.Equal(t, &LineCoverage{File: "test.s", Line: 5, Count: 1, Branch: true, Taken: 1}, coverLine(c, 5))
+	assert.False(t, coverLine(c, 5).Covered())
+	assert.Equal(t, int64(0), coverLine(c, 6).Count)
+	assert.Equal(t, int64(0), coverLine(c, 9).Count)
+	assert.Nil(t, coverLine(c, 10)) // data isn't code
+}
+
+func TestCoverageFiles(t *testing.T) {
+	c := runCoverage(t)
+	// abs has 6 lines with code (its sav is on line 3), unused 1 and the test 6
+	assert.Equal(t, []FileCoverage{{File: "test.s", Lines: 13, LinesCovered: 11, Branches: 2, BranchesCovered: 1}}, c.Files())
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteSummary(&buf))
+	assert.Equal(t, "coverage: test.s  84.6% of lines (11/13),  50.0% of branches (1/2)\n", buf.String())
+}
+
+func TestCoverProfile(t *testing.T) {
+	c := runCoverage(t)
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteProfile(&buf))
+	assert.True(t, strings.HasPrefix(buf.String(), "mode: count\ntest.s:3 1\ntest.s:4 1\ntest.s:5 1 1 0\ntest.s:6 0\n"), buf.String())
+
+	read, err := ReadCoverProfile(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, c.Lines(), read.Lines())
+
+	_, err = ReadCoverProfile(strings.NewReader("mode: count\ntest.s:x 1\n"))
+	assert.EqualError(t, err, "line 2: invalid number 'x'")
+	_, err = ReadCoverProfile(strings.NewReader("hello"))
+	assert.EqualError(t, err, "not a coverage profile")
+}
+
+func TestCoverProfileFileNames(t *testing.T) {
+	l, err := parseCoverLine(`C:\my code\lib.s:12 3 2 1`)
+	assert.NoError(t, err)
+	assert.Equal(t, &LineCoverage{File: `C:\my code\lib.s`, Line: 12, Count: 3, Branch: true, Taken: 2, NotTaken: 1}, l)
+}
+
+func TestWriteAnnotated(t *testing.T) {
+	c := runCoverage(t)
+	sources := &SourceReader{cache: map[string][]string{"test.s": strings.Split(coverSource, "\n")}}
+	var buf bytes.Buffer
+	assert.NoError(t, c.WriteAnnotated(&buf, sources))
+	text := buf.String()
+	assert.Contains(t, text, "test.s: 84.6% of lines, 50.0% of branches\n")
+	assert.Contains(t, text, "        -:    2: \t\torg 0x100\n")
+	assert.Contains(t, text, "        1:    5: \t\tjge done    [taken 1, not taken 0]\n")
+	assert.Contains(t, text, "    #####:    6: \t\tmul n, #-1\n")
+
+	buf.Reset()
+	assert.NoError(t, c.WriteHTML(&buf, sources))
+	assert.Contains(t, buf.String(), `<span class="count">1</span> <span class="partial" title="taken 1, not taken 0">		jge done</span>`)
+	assert.Contains(t, buf.String(), `<span class="count">0</span> <span class="uncov">		mul n, #-1</span>`)
+}
@@ -28,6 +28,8 @@ type TestResult struct {
 	Message string
 	// For assertion failures
 	FailureDetails []AssertionDetail
+	// Call stack at the failure, if debug info was provided
+	Backtrace []asm.Frame
 }
 
 // AssertionDetail holds details about a single assertion failure.
@@ -47,6 +49,8 @@ type TestExecutor struct {
 	debugInfo []asm.DebugInfo
 	results   []TestResult
 	lastError *TestResult
+	debug     *asm.DebugFile
+	backtrace []asm.Frame // call stack at the first assertion failure of the current test
 }
 
 // NewTestExecutor creates a new test executor.
@@ -60,10 +64,21 @@ func NewTestExecutor(m *machine.Machine, suite *TestSuite, symbols *asm.SymbolTa
 	}
 }
 
+// SetDebugFile provides function frame info, so failures include a backtrace.
+func (e *TestExecutor) SetDebugFile(debug *asm.DebugFile) {
+	e.debug = debug
+}
+
 // Run executes all tests in the suite.
 func (e *TestExecutor) Run() error {
 	// Enable test mode on the machine
 	e.machine.EnableTestMode()
+	e.machine.OnAssertionFailure(func(failure *machine.AssertionFailure) {
+		if e.backtrace == nil {
+			flags := e.machine.Flags()
+			e.backtrace = e.backtraceFrom(failure.PC, flags.SP, flags.FP)
+		}
+	})
 
 	for _, test := range e.suite.Tests {
 		result := e.runTest(test)
@@ -87,6 +102,7 @@ func (e *TestExecutor) runTest(test TestInfo) TestResult {
 
 	// Reset machine state
 	e.resetMachineState()
+	e.backtrace = nil
 
 	// Call setup if exists
 	if e.suite.SetupFn != "" {
@@ -122,6 +138,7 @@ func (e *TestExecutor) runTest(test TestInfo) TestResult {
 				}
 
 				// Store the error for later retrieval
+				flags := e.machine.Flags()
 				e.lastError = &TestResult{
 					Name:    test.Name,
 					Passed:  false,
@@ -131,6 +148,7 @@ func (e *TestExecutor) runTest(test TestInfo) TestResult {
 						File: file,
 						Line: line,
 					}},
+					Backtrace: e.backtraceFrom(pc, flags.SP, flags.FP),
 				}
 			}
 		}()
@@ -145,6 +163,27 @@ func (e *TestExecutor) runTest(test TestInfo) TestResult {
 		return result
 	}
 
+	// A memory protection fault stops the machine before the test returns
+	if fault := e.machine.Fault(); fault != nil {
+		file, line := e.findSourceLocation(fault.PC)
+		flags := e.machine.Flags()
+		message := fmt.Sprintf("runtime error: %s", fault)
+		if fault.IsStack() {
+			message = fmt.Sprintf("runtime error: %s in %s (pc=0x%04x, sp=0x%04x)", fault.Kind, e.functionAt(fault.PC), fault.PC, fault.Addr)
+		}
+		return TestResult{
+			Name:    test.Name,
+			Passed:  false,
+			Message: message,
+			FailureDetails: []AssertionDetail{{
+				PC:   fault.PC,
+				File: file,
+				Line: line,
+			}},
+			Backtrace: e.backtraceFrom(fault.PC, flags.SP, flags.FP),
+		}
+	}
+
 	// Call teardown if exists
 	if e.suite.TeardownFn != "" {
 		e.callFunction(e.suite.TeardownFn)
@@ -172,6 +211,7 @@ func (e *TestExecutor) runTest(test TestInfo) TestResult {
 			Passed:         false,
 			Message:        fmt.Sprintf("%d assertion(s) failed", failures),
 			FailureDetails: failureDetails,
+			Backtrace:      e.backtrace,
 		}
 	}
 
@@ -238,6 +278,15 @@ func (e *TestExecutor) Summary() (passed, failed int) {
 	return
 }
 
+// backtraceFrom returns the call stack for the given registers, or nil if
+// there's no debug info.
+func (e *TestExecutor) backtraceFrom(pc, sp, fp uint16) []asm.Frame {
+	if e.debug == nil {
+		return nil
+	}
+	return asm.BacktraceFrom(e.machine.Memory(), pc, sp, fp, e.debug)
+}
+
 // findSourceLocation finds the source file and line for a given PC.
 func (e *TestExecutor) findSourceLocation(pc uint16) (string, int) {
 	// Search debug info for the closest PC match
@@ -248,3 +297,15 @@ func (e *TestExecutor) findSourceLocation(pc uint16) (string, int) {
 	}
 	return "", 0
 }
+
+// functionAt returns the name of the global label at or before pc, which is
+// the function or test containing it, or pc in hex if there isn't one or no
+// debug file was set.
+func (e *TestExecutor) functionAt(pc uint16) string {
+	if e.debug != nil {
+		if label := e.debug.GlobalLabelAt(pc); label != nil {
+			return label.Name
+		}
+	}
+	return fmt.Sprintf("0x%04x", pc)
+}
@@ -172,3 +172,107 @@ func TestTerminalFormatter(t *testing.T) {
 	assert.Contains(t, output, "1 failed")
 	assert.Contains(t, output, "2 total")
 }
+
+func TestExecutorMachineFault(t *testing.T) {
+	source := `
+		org 0x100
+table:	dw 5
+end:
+
+test TestWritesRom():
+		cpy table, #1
+		ret
+`
+	m, symbols, debugInfo := compileAndLoad(t, source)
+	m.Protect(0x100, 0x101, machine.ProtectWrite)
+
+	suite := &TestSuite{
+		Tests: []TestInfo{{Name: "TestWritesRom", Function: "TestWritesRom"}},
+	}
+	executor := NewTestExecutor(m, suite, symbols, debugInfo)
+	assert.NoError(t, executor.Run())
+
+	results := executor.Results()
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].Passed)
+	assert.Contains(t, results[0].Message, "write to read-only memory at 0x0100")
+	assert.Len(t, results[0].FailureDetails, 1)
+	assert.Equal(t, 7, results[0].FailureDetails[0].Line)
+}
+
+func TestExecutorStackOverflow(t *testing.T) {
+	source := `
+		org 0x100
+recurse(n word):
+		psh n
+		jsr recurse
+		pop #2
+		ret
+
+test TestRecursion():
+		psh #1
+		jsr recurse
+		pop #2
+		ret
+`
+	linker, err := asm.BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.NoError(t, err)
+	m.SetStackBounds(0xff00, 0xffff)
+
+	suite := &TestSuite{
+		Tests: []TestInfo{{Name: "TestRecursion", Function: "TestRecursion"}},
+	}
+	executor := NewTestExecutor(m, suite, linker.Symbols(), linker.DebugInfo())
+	executor.SetDebugFile(linker.DebugFile())
+	assert.NoError(t, executor.Run())
+
+	results := executor.Results()
+	assert.False(t, results[0].Passed)
+	assert.Contains(t, results[0].Message, "stack overflow in recurse (pc=0x")
+	assert.Len(t, results[0].FailureDetails, 1)
+}
+
+func TestExecutorBacktrace(t *testing.T) {
+	source := `
+		org 0x100
+check(value word):
+		sea
+		cmp value, #5
+		rst
+
+test TestHelperFails():
+		psh #4
+		jsr check
+		pop #2
+		ret
+`
+	linker, err := asm.BuildSource("test.s", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := machine.NewMachineFromImage(machine.NewDefaultDispatcher(), linker.Image())
+	assert.NoError(t, err)
+
+	suite := &TestSuite{
+		Tests: []TestInfo{{Name: "TestHelperFails", Function: "TestHelperFails"}},
+	}
+	executor := NewTestExecutor(m, suite, linker.Symbols(), linker.DebugInfo())
+	executor.SetDebugFile(linker.DebugFile())
+	assert.NoError(t, executor.Run())
+
+	results := executor.Results()
+	assert.False(t, results[0].Passed)
+	assert.Len(t, results[0].Backtrace, 2)
+	assert.Equal(t, "check(value=4) at test.s:5 (pc=0x0103)", results[0].Backtrace[0].String())
+	assert.Equal(t, "TestHelperFails+6", results[0].Backtrace[1].Function)
+	assert.Equal(t, 10, results[0].Backtrace[1].Line)
+
+	var buf bytes.Buffer
+	formatter := NewTerminalFormatter(false, false)
+	formatter.Format(results, &buf)
+	assert.Contains(t, buf.String(), "Backtrace:\n    #0 check(value=4) at test.s:5")
+}
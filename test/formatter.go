@@ -95,6 +95,14 @@ func (f *TerminalFormatter) Format(results []TestResult, w io.Writer) error {
 					}
 				}
 			}
+
+			// A single frame is just the test itself, already shown above
+			if len(result.Backtrace) > 1 {
+				fmt.Fprintf(w, "\n  Backtrace:\n")
+				for i, frame := range result.Backtrace {
+					fmt.Fprintf(w, "    #%d %s\n", i, frame)
+				}
+			}
 		}
 	}
 
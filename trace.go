@@ -0,0 +1,225 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jsando/mpu/asm"
+	"github.com/jsando/mpu/machine"
+)
+
+// traceOptions are the run flags that control tracing.
+type traceOptions struct {
+	file      string // trace file, or "" to not trace
+	addrRange string // "start-end" addresses or symbols, inclusive
+	function  string // only trace instructions in this function
+	max       int    // stop tracing after this many instructions, 0 for no limit
+}
+
+// startTrace sets a tracer that writes instructions passing the filters to
+// the trace file, and writes the debug info next to it for mpu trace.  The
+// returned function finishes the trace file.
+func startTrace(m *machine.Machine, debug *asm.DebugFile, opts traceOptions) (func(), error) {
+	filter, err := traceFilter(m, debug, opts)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(opts.file)
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(f)
+	w := machine.NewTraceWriter(buf)
+	count := 0
+	stopped := false // other tracers may still be running, ie a profile
+	var writeErr error
+	m.AddTracer(func(r *machine.TraceRecord) {
+		if stopped || !filter(r.PC) {
+			return
+		}
+		if writeErr = w.Write(r); writeErr != nil {
+			stopped = true
+			return
+		}
+		count++
+		if opts.max > 0 && count >= opts.max {
+			stopped = true
+		}
+	})
+	if debug != nil {
+		writeDebugFile(asm.DebugFileName(opts.file), debug)
+	}
+	return func() {
+		stopped = true
+		err := writeErr
+		if err == nil {
+			err = w.Flush()
+		}
+		if err == nil {
+			err = buf.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to write trace file '%s': %s\n", opts.file, err)
+		}
+	}, nil
+}
+
+// traceFilter returns a function that checks if the instruction at pc is
+// within the address range and function given.
+func traceFilter(m *machine.Machine, debug *asm.DebugFile, opts traceOptions) (func(uint16) bool, error) {
+	monitor := newMonitor(m, debug)
+	lo, hi := 0, 0xffff
+	if opts.addrRange != "" {
+		var err error
+		if lo, hi, err = monitor.addressRange(opts.addrRange); err != nil {
+			return nil, fmt.Errorf("trace %s", err)
+		}
+	}
+	fnLo, fnHi := 0, 0xffff
+	if opts.function != "" {
+		if debug == nil {
+			return nil, errors.New("tracing a function needs debug info")
+		}
+		start, err := monitor.address(opts.function)
+		if err != nil {
+			return nil, err
+		}
+		fnLo, fnHi = start, functionEnd(debug, start)
+	}
+	return func(pc uint16) bool {
+		return int(pc) >= lo && int(pc) <= hi && int(pc) >= fnLo && int(pc) <= fnHi
+	}, nil
+}
+
+// functionEnd returns the last address of the function starting at start,
+// which is just before the next global label.
+func functionEnd(debug *asm.DebugFile, start int) int {
+	end := 0xffff
+	for _, sym := range debug.Symbols {
+		if sym.Label && !sym.Local && !sym.FP && sym.Value > start && sym.Value-1 < end {
+			end = sym.Value - 1
+		}
+	}
+	return end
+}
+
+// renderTrace writes a trace file as text, with symbols if debug is given.
+func renderTrace(w io.Writer, r io.Reader, debug *asm.DebugFile) error {
+	tr, err := machine.NewTraceReader(r)
+	if err != nil {
+		return err
+	}
+	// instructions are disassembled by writing them into a scratch machine
+	scratch := machine.NewMachineWithDevices(machine.NewDispatcher(), nil)
+	monitor := newMonitor(scratch, debug)
+	for {
+		rec, err := tr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, b := range rec.Code {
+			monitor.memory.PutByte(rec.PC+uint16(i), b)
+		}
+		text, _ := monitor.disassemble(int(rec.PC))
+		fmt.Fprintf(w, "%04x  %-16s %-28s %-40s %s\n", rec.PC, monitor.symbolize(int(rec.PC)),
+			text, traceEffects(monitor, rec), traceRegisters(rec.Flags))
+	}
+}
+
+// traceEffects formats the memory read and written by an instruction, ie
+// "count=0x0005 count<-0x000a".
+func traceEffects(m *Monitor, rec *machine.TraceRecord) string {
+	var effects []string
+	format := func(v uint16, size int) string {
+		if size == 1 {
+			return fmt.Sprintf("0x%02x", v&0xff)
+		}
+		return fmt.Sprintf("0x%04x", v)
+	}
+	// fp relative operands are named by the function's params and locals
+	name := func(mode machine.AddressMode, addr uint16) string {
+		if mode == machine.Relative && m.debug != nil {
+			if fn := m.debug.FunctionAt(rec.PC); fn != nil {
+				if slot := fn.Slot(int(int16(addr - rec.Flags.FP))); slot != nil {
+					return slot.Name
+				}
+			}
+		}
+		return m.formatAddrOperand(int(addr))
+	}
+	size := 2
+	if rec.Bytes {
+		size = 1
+	}
+	if rec.Read1 {
+		effects = append(effects, name(rec.Mode1, rec.Addr1)+"="+format(rec.Value1, size))
+	}
+	if rec.Read2 {
+		effects = append(effects, name(rec.Mode2, rec.Addr2)+"="+format(rec.Value2, size))
+	}
+	if rec.Written {
+		mode := machine.Implied // pushes write to the stack, not an operand
+		if rec.WriteAddr == rec.Addr1 {
+			mode = rec.Mode1
+		}
+		effects = append(effects, name(mode, rec.WriteAddr)+"<-"+format(rec.WriteValue, rec.WriteSize))
+	}
+	return strings.Join(effects, " ")
+}
+
+// traceRegisters formats the registers and flags after an instruction, with
+// flags as NZCB, or '-' for those that are clear.
+func traceRegisters(f machine.Flags) string {
+	flags := []byte("----")
+	for i, set := range []bool{f.Negative, f.Zero, f.Carry, f.Bytes} {
+		if set {
+			flags[i] = "NZCB"[i]
+		}
+	}
+	return fmt.Sprintf("pc=%04x sp=%04x fp=%04x %s", f.PC, f.SP, f.FP, flags)
+}
+
+// showTrace renders a trace file to stdout, with symbols from dbgName or
+// the debug file next to the trace.
+func showTrace(name string, dbgName string) {
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if dbgName == "" {
+		dbgName = asm.DebugFileName(name)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if err := renderTrace(w, bufio.NewReader(f), loadDebugFile(dbgName)); err != nil {
+		w.Flush()
+		fmt.Fprintf(os.Stderr, "Error: %s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,586 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The TUI is a full screen debugger built on the monitor, drawn with ANSI
+// escape codes.  The terminal is switched to raw mode with stty, so it needs
+// a unix-like terminal.
+
+const (
+	tuiRightWidth   = 32   // width of the registers, stack and watches column
+	tuiMemoryRows   = 6    // rows in the memory pane
+	tuiConsoleLines = 1000 // lines of console output kept
+	tuiPollInterval = 10000
+	tuiRedrawPeriod = 100 * time.Millisecond
+)
+
+const tuiKeyHelp = "s step  n next  o over  f finish  c cont  r back  b break  w watch  g mem  : cmd  q quit"
+
+type tui struct {
+	mon       *Monitor
+	console   *consoleBuffer
+	watches   []string // expressions shown in the watches pane
+	memAddr   int      // first address in the memory pane
+	codeStart int      // first address in the code pane
+	cursor    int      // address selected in the code pane, for breakpoints
+	visible   []int    // addresses of the instructions in the code pane
+	prompt    string   // label of the input line, "" if not reading input
+	input     string
+	onInput   func(string)
+	keys      chan string
+	resize    chan os.Signal // the terminal was resized
+	width     int
+	height    int
+	quit      bool
+}
+
+// consoleBuffer holds the console pane: program output and monitor messages.
+// It's created before the machine so the program's stdout device can write
+// to it.
+type consoleBuffer struct {
+	lines []string // the last line may be partial
+}
+
+func (c *consoleBuffer) Write(p []byte) (int, error) {
+	text := strings.ReplaceAll(string(p), "\r", "")
+	if len(c.lines) == 0 {
+		c.lines = []string{""}
+	}
+	lines := strings.Split(text, "\n")
+	c.lines[len(c.lines)-1] += lines[0]
+	c.lines = append(c.lines, lines[1:]...)
+	if len(c.lines) > tuiConsoleLines {
+		c.lines = c.lines[len(c.lines)-tuiConsoleLines:]
+	}
+	return len(p), nil
+}
+
+// stty runs stty on the terminal, returning its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// runTUI runs the full screen debugger until the user quits.  The machine's
+// stdout device should write to console.
+func runTUI(m *Monitor, console *consoleBuffer) error {
+	saved, err := stty("-g")
+	if err != nil {
+		return errors.New("the tui needs a terminal")
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return err
+	}
+	defer stty(saved)
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	pc := int(m.machine.Flags().PC)
+	t := &tui{mon: m, console: console, memAddr: pc, codeStart: pc, cursor: pc, keys: make(chan string)}
+	t.readSize()
+	t.resize = make(chan os.Signal, 1)
+	if len(resizeSignals) > 0 {
+		signal.Notify(t.resize, resizeSignals...)
+		defer signal.Stop(t.resize)
+	}
+	out := m.out
+	m.out = console
+	defer func() { m.out = out }()
+	m.enableHistory()
+
+	go t.readKeys(bufio.NewReader(os.Stdin))
+	for !t.quit {
+		t.draw()
+		select {
+		case key := <-t.keys:
+			t.handle(key)
+		case <-t.resize:
+			t.readSize()
+		}
+	}
+	return nil
+}
+
+// readKeys sends key presses to t.keys, as the character typed or a name
+// such as "up" or "f5".
+func (t *tui) readKeys(r *bufio.Reader) {
+	names := map[string]string{
+		"[A": "up", "[B": "down", "[5~": "pgup", "[6~": "pgdn",
+		"[15~": "f5", "[20~": "f9", "[21~": "f10", "[23~": "f11",
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			close(t.keys)
+			return
+		}
+		switch {
+		case b == 0x1b && r.Buffered() == 0:
+			t.keys <- "esc"
+		case b == 0x1b:
+			// escape sequence, up to its final byte
+			var seq []byte
+			for r.Buffered() > 0 {
+				c, _ := r.ReadByte()
+				seq = append(seq, c)
+				if len(seq) > 1 && c >= 0x40 && c <= 0x7e {
+					break
+				}
+			}
+			if name, ok := names[string(seq)]; ok {
+				t.keys <- name
+			}
+		case b == 3:
+			t.keys <- "ctrl-c"
+		case b == '\r' || b == '\n':
+			t.keys <- "enter"
+		case b == 127 || b == 8:
+			t.keys <- "backspace"
+		default:
+			t.keys <- string(b)
+		}
+	}
+}
+
+func (t *tui) handle(key string) {
+	if key == "" {
+		t.quit = true // stdin closed
+		return
+	}
+	if t.prompt != "" {
+		t.edit(key)
+		return
+	}
+	m := t.mon
+	switch key {
+	case "q", "ctrl-c":
+		t.quit = true
+	case "s", "f11":
+		t.do(func() { m.stepInstruction() })
+	case "n", "f10":
+		t.do(m.runToNextLine)
+	case "o":
+		t.do(func() { m.stepOver() })
+	case "f":
+		t.do(func() { m.runToReturn() })
+	case "c", "f5":
+		t.do(t.cont)
+	case "r":
+		t.do(func() {
+			if !m.machine.StepBack() {
+				fmt.Fprintf(m.out, "reached the start of the history\n")
+			}
+		})
+	case "b", "f9":
+		t.toggleBreakpoint(t.cursor)
+	case "w":
+		t.readInput("watch (empty to clear): ", func(s string) {
+			if s == "" {
+				t.watches = nil
+				return
+			}
+			t.watches = append(t.watches, s)
+		})
+	case "g":
+		t.readInput("memory address: ", func(s string) {
+			if addr, err := m.address(s); err != nil {
+				m.errorf("%s\n", err)
+			} else {
+				t.memAddr = addr &^ 0xf
+			}
+		})
+	case ":":
+		t.readInput(m.prompt(), func(s string) {
+			fmt.Fprintf(m.out, "%s%s\n", m.prompt(), s)
+			m.Execute(s)
+			t.quit = m.quit
+			t.follow()
+		})
+	case "up":
+		t.moveCursor(-1)
+	case "down":
+		t.moveCursor(1)
+	case "pgup":
+		t.memAddr = (t.memAddr - 16*tuiMemoryRows) & 0xfff0
+	case "pgdn":
+		t.memAddr = (t.memAddr + 16*tuiMemoryRows) & 0xfff0
+	}
+}
+
+// readInput shows a prompt on the status line, and calls done with the text
+// entered when enter is pressed.
+func (t *tui) readInput(prompt string, done func(string)) {
+	t.prompt = prompt
+	t.input = ""
+	t.onInput = done
+}
+
+func (t *tui) edit(key string) {
+	switch key {
+	case "enter":
+		t.prompt = ""
+		t.onInput(strings.TrimSpace(t.input))
+	case "esc", "ctrl-c":
+		t.prompt = ""
+	case "backspace":
+		if t.input != "" {
+			t.input = t.input[:len(t.input)-1]
+		}
+	default:
+		if len(key) == 1 && key[0] >= ' ' {
+			t.input += key
+		}
+	}
+}
+
+// do runs an action that moves the pc, then shows the new pc.
+func (t *tui) do(action func()) {
+	action()
+	t.follow()
+}
+
+// follow moves the cursor to the pc, scrolling the code pane if needed.
+func (t *tui) follow() {
+	pc := int(t.mon.machine.Flags().PC)
+	t.cursor = pc
+	t.mon.next = pc
+}
+
+// cont runs until a breakpoint, hlt or fault, or until a key is pressed.
+// The screen is redrawn as it goes, so program output appears.
+func (t *tui) cont() {
+	m := t.mon
+	last := time.Now()
+	for i := 1; ; i++ {
+		if !m.stepInstruction() || m.atBreakpoint() {
+			return
+		}
+		if i%tuiPollInterval != 0 {
+			continue
+		}
+		select {
+		case key := <-t.keys:
+			if key == "" {
+				t.quit = true
+			}
+			fmt.Fprintf(m.out, "paused\n")
+			return
+		default:
+		}
+		if time.Since(last) > tuiRedrawPeriod {
+			t.follow()
+			t.draw()
+			last = time.Now()
+		}
+	}
+}
+
+func (t *tui) toggleBreakpoint(addr int) {
+	m := t.mon
+	for _, bp := range m.machine.Breakpoints() {
+		if int(bp.Addr) == addr {
+			m.machine.DeleteBreakpoint(bp.ID)
+			return
+		}
+	}
+	m.machine.SetBreakpoint(uint16(addr), nil, "")
+}
+
+// moveCursor moves the code pane selection by one instruction, scrolling at
+// the top and bottom.
+func (t *tui) moveCursor(delta int) {
+	i := 0
+	for i < len(t.visible) && t.visible[i] != t.cursor {
+		i++
+	}
+	i += delta
+	switch {
+	case i < 0:
+		t.codeStart = t.startBefore(t.codeStart, 1)
+		t.cursor = t.codeStart
+	case i >= len(t.visible):
+		if len(t.visible) > 1 {
+			t.codeStart = t.visible[1]
+		}
+		_, n := t.mon.disassemble(t.cursor)
+		t.cursor += n + 1
+	default:
+		t.cursor = t.visible[i]
+	}
+}
+
+// startBefore returns the address of the instruction n source lines before
+// addr, or addr if there's no debug info to find instruction boundaries.
+func (t *tui) startBefore(addr int, n int) int {
+	m := t.mon
+	if m.debug == nil {
+		return addr
+	}
+	bank := m.bankAt(addr)
+	var pcs []int
+	for _, info := range m.debug.Lines {
+		if info.Bank == bank && int(info.PC) < addr {
+			pcs = append(pcs, int(info.PC))
+		}
+	}
+	sort.Ints(pcs)
+	if len(pcs) == 0 {
+		return addr
+	}
+	if n > len(pcs) {
+		n = len(pcs)
+	}
+	return pcs[len(pcs)-n]
+}
+
+// readSize gets the terminal size from stty, or 80x24 if it can't.
+func (t *tui) readSize() {
+	t.width, t.height = 80, 24
+	if size, err := stty("size"); err == nil {
+		if f := strings.Fields(size); len(f) == 2 {
+			t.height, _ = strconv.Atoi(f[0])
+			t.width, _ = strconv.Atoi(f[1])
+		}
+	}
+}
+
+// draw redraws the whole screen, reading the size again if the terminal was
+// resized while running.
+func (t *tui) draw() {
+	select {
+	case <-t.resize:
+		t.readSize()
+	default:
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range t.render(t.width, t.height) {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+	}
+	fmt.Print(b.String())
+}
+
+// render lays out the panes for a screen of the given size.
+func (t *tui) render(width, height int) []string {
+	if width < 60 || height < 20 {
+		return pad([]string{"terminal too small, press q to quit"}, width, height)
+	}
+	consoleRows := height / 5
+	if consoleRows < 3 {
+		consoleRows = 3
+	}
+	topRows := height - 1 - (tuiMemoryRows + 1) - (consoleRows + 1)
+	leftWidth := width - tuiRightWidth - 1
+
+	code, cursorRow := t.codePane(topRows - 1)
+	left := pane("Code", code, leftWidth, topRows)
+	if cursorRow >= 0 {
+		left[cursorRow+1] = "\x1b[7m" + left[cursorRow+1] + "\x1b[0m"
+	}
+	regs := pane("Registers", t.registersPane(), tuiRightWidth, 5)
+	stackRows := (topRows - 5) / 2
+	stack := pane("Stack", t.stackPane(stackRows-1), tuiRightWidth, stackRows)
+	watches := pane("Watches", t.watchesPane(), tuiRightWidth, topRows-5-stackRows)
+	right := append(append(regs, stack...), watches...)
+
+	var screen []string
+	for i := 0; i < topRows; i++ {
+		screen = append(screen, left[i]+"│"+right[i])
+	}
+	screen = append(screen, pane(fmt.Sprintf("Memory 0x%04x", t.memAddr), t.memoryPane(), width, tuiMemoryRows+1)...)
+	console := t.console.lines
+	if len(console) > consoleRows {
+		console = console[len(console)-consoleRows:]
+	}
+	screen = append(screen, pane("Console", console, width, consoleRows+1)...)
+	status := tuiKeyHelp
+	if t.prompt != "" {
+		status = t.prompt + t.input + "_"
+	}
+	return append(screen, pad([]string{status}, width, 1)...)
+}
+
+// pane returns rows lines of width columns, a title bar then the content.
+func pane(title string, content []string, width, rows int) []string {
+	bar := "── " + title + " "
+	bar += strings.Repeat("─", max(0, width-utf8.RuneCountInString(bar)))
+	return append(pad([]string{bar}, width, 1), pad(content, width, rows-1)...)
+}
+
+// pad truncates or pads lines to exactly width columns and rows lines.
+func pad(lines []string, width, rows int) []string {
+	result := make([]string, rows)
+	for i := range result {
+		line := ""
+		if i < len(lines) {
+			line = strings.ReplaceAll(lines[i], "\t", "    ")
+		}
+		n := utf8.RuneCountInString(line)
+		if n > width {
+			line = string([]rune(line)[:width])
+			n = width
+		}
+		result[i] = line + strings.Repeat(" ", width-n)
+	}
+	return result
+}
+
+// codePane lists instructions with their labels and source lines, with the
+// pc marked "=>" and breakpoints "*".  It returns the row of the cursor, or
+// -1 if it isn't visible.
+func (t *tui) codePane(rows int) ([]string, int) {
+	m := t.mon
+	pc := int(m.machine.Flags().PC)
+	lines, addrs := t.listCode(rows)
+	if !contains(addrs, pc) || !contains(addrs, t.cursor) {
+		if !contains(addrs, t.cursor) {
+			t.codeStart = t.startBefore(t.cursor, 3)
+		}
+		lines, addrs = t.listCode(rows)
+	}
+	breaks := map[int]bool{}
+	for _, bp := range m.machine.Breakpoints() {
+		breaks[int(bp.Addr)] = true
+	}
+	t.visible = nil
+	cursorRow := -1
+	for i, line := range lines {
+		addr := addrs[i]
+		if addr < 0 {
+			lines[i] = "   " + line
+			continue
+		}
+		t.visible = append(t.visible, addr)
+		mark := []byte("   ")
+		if breaks[addr] {
+			mark[0] = '*'
+		}
+		if addr == pc {
+			mark[1], mark[2] = '=', '>'
+		}
+		lines[i] = string(mark) + line
+		if addr == t.cursor {
+			cursorRow = i
+		}
+	}
+	return lines, cursorRow
+}
+
+// listCode lists rows lines from t.codeStart, returning each line and the
+// address of the instruction on it, or -1 for label and source lines.
+func (t *tui) listCode(rows int) ([]string, []int) {
+	var buf bytes.Buffer
+	t.mon.List(&buf, t.codeStart, rows)
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) > rows {
+		lines = lines[:rows]
+	}
+	addrs := make([]int, len(lines))
+	for i, line := range lines {
+		addrs[i] = -1
+		if strings.HasPrefix(line, "0x") && len(line) >= 6 {
+			if addr, err := strconv.ParseUint(line[2:6], 16, 16); err == nil {
+				addrs[i] = int(addr)
+			}
+		}
+	}
+	return lines, addrs
+}
+
+func contains(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tui) registersPane() []string {
+	m := t.mon
+	f := m.machine.Flags()
+	return []string{
+		fmt.Sprintf("pc %04x  %s", f.PC, m.symbolize(int(f.PC))),
+		fmt.Sprintf("sp %04x  fp %04x", f.SP, f.FP),
+		fmt.Sprintf("n %d  z %d  c %d  b %d", boolInt(f.Negative), boolInt(f.Zero), boolInt(f.Carry), boolInt(f.Bytes)),
+		fmt.Sprintf("history %d", m.machine.HistoryLen()),
+	}
+}
+
+// stackPane shows the words from sp up, marking fp.
+func (t *tui) stackPane(rows int) []string {
+	m := t.mon
+	f := m.machine.Flags()
+	var lines []string
+	for i := 0; i < rows; i++ {
+		addr := f.SP + uint16(2*i)
+		line := fmt.Sprintf("%04x  %04x", addr, m.memory.GetWord(addr))
+		if addr == f.SP {
+			line += "  <- sp"
+		}
+		if addr == f.FP {
+			line += "  <- fp"
+		}
+		lines = append(lines, line)
+		if addr >= 0xfffe {
+			break
+		}
+	}
+	return lines
+}
+
+// watchesPane shows the value of each watch expression.
+func (t *tui) watchesPane() []string {
+	var lines []string
+	for _, w := range t.watches {
+		v, err := t.mon.address(w)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s: %s", w, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s = 0x%04x (%d)", w, v, v))
+	}
+	return lines
+}
+
+func (t *tui) memoryPane() []string {
+	var buf bytes.Buffer
+	end := t.memAddr + 16*tuiMemoryRows - 1
+	if end > 0xffff {
+		end = 0xffff
+	}
+	t.mon.Dump(&buf, t.memAddr, end)
+	return strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+}
@@ -0,0 +1,162 @@
+// Copyright 2022 Jason Sando <jason.sando.lv@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testTUI returns a tui for breakSource, without a terminal.
+func testTUI(t *testing.T) *tui {
+	m, _ := sourceMonitor(t, breakSource)
+	m.out = &consoleBuffer{}
+	pc := int(m.machine.Flags().PC)
+	return &tui{mon: m, console: m.out.(*consoleBuffer), memAddr: pc, codeStart: pc, cursor: pc}
+}
+
+func TestPad(t *testing.T) {
+	assert.Equal(t, []string{"ab  ", "    ", "    "}, pad([]string{"ab"}, 4, 3))
+	assert.Equal(t, []string{"abcd"}, pad([]string{"abcdef", "gh"}, 4, 1))
+	assert.Equal(t, []string{"    x "}, pad([]string{"\tx"}, 6, 1))
+	assert.Equal(t, []string{"│é  "}, pad([]string{"│é"}, 4, 1))
+}
+
+func TestPane(t *testing.T) {
+	lines := pane("Stack", []string{"one", "two", "three"}, 12, 3)
+	assert.Equal(t, []string{"── Stack ───", "one         ", "two         "}, lines)
+	lines = pane("A very long title", nil, 8, 2)
+	assert.Equal(t, []string{"── A ver", "        "}, lines)
+}
+
+func TestRender(t *testing.T) {
+	tu := testTUI(t)
+	screen := tu.render(80, 24)
+	assert.Len(t, screen, 24)
+	for i, line := range screen {
+		line = strings.NewReplacer("\x1b[7m", "", "\x1b[0m", "").Replace(line)
+		assert.Equal(t, 80, utf8.RuneCountInString(line), "line %d: %q", i, line)
+	}
+	assert.True(t, strings.HasPrefix(screen[0], "── Code ─"))
+	assert.Contains(t, screen[0], "│── Registers ─")
+	assert.Contains(t, screen[1], "│pc 0100  main ")
+	assert.Contains(t, screen[3], "\x1b[7m =>0x0100")
+	assert.Equal(t, tuiKeyHelp[:80], screen[23])
+
+	assert.Equal(t, "terminal too small, press q to quit", strings.TrimRight(tu.render(40, 10)[0], " "))
+}
+
+func TestRenderPrompt(t *testing.T) {
+	tu := testTUI(t)
+	tu.readInput("memory address: ", func(string) {})
+	tu.input = "count"
+	screen := tu.render(80, 24)
+	assert.Equal(t, "memory address: count_", strings.TrimRight(screen[23], " "))
+}
+
+func TestCodePane(t *testing.T) {
+	tu := testTUI(t)
+	tu.mon.machine.SetBreakpoint(0x105, nil, "")
+	tu.cursor = 0x105
+	lines, cursorRow := tu.codePane(10)
+	assert.Equal(t, []string{
+		"   main:",
+		"   test.s:4",
+		" =>0x0100  1f 0b 01 01 00 cpy count,#0x0001",
+		"   test.s:5",
+		"*  0x0105  1f 0b 01 02 00 cpy count,#0x0002",
+		"   test.s:6",
+		"   0x010a  00             hlt",
+		"   count:",
+		"   0x010b  00             hlt",
+		"   0x010c  00             hlt",
+	}, trimLines(lines))
+	assert.Equal(t, 4, cursorRow)
+	assert.Equal(t, []int{0x100, 0x105, 0x10a, 0x10b, 0x10c}, tu.visible)
+}
+
+func TestCodePaneScrollsToCursor(t *testing.T) {
+	tu := testTUI(t)
+	tu.codeStart = 0x10b
+	tu.cursor = 0x10a
+	lines, cursorRow := tu.codePane(8)
+	assert.Equal(t, 0x100, tu.codeStart)
+	assert.Equal(t, 6, cursorRow)
+	assert.Equal(t, "   0x010a  00             hlt", strings.TrimRight(lines[cursorRow], " "))
+}
+
+func TestMoveCursor(t *testing.T) {
+	tu := testTUI(t)
+	tu.codePane(10)
+	tu.moveCursor(1)
+	assert.Equal(t, 0x105, tu.cursor)
+	tu.moveCursor(2)
+	assert.Equal(t, 0x10b, tu.cursor)
+	tu.moveCursor(-3)
+	assert.Equal(t, 0x100, tu.cursor)
+
+	// past the last visible instruction, scrolling down one
+	tu.codePane(3)
+	assert.Equal(t, []int{0x100}, tu.visible)
+	tu.moveCursor(1)
+	assert.Equal(t, 0x105, tu.cursor)
+
+	// before the first, scrolling up a source line
+	tu.codeStart = 0x105
+	tu.codePane(3)
+	tu.moveCursor(-1)
+	assert.Equal(t, 0x100, tu.cursor)
+	assert.Equal(t, 0x100, tu.codeStart)
+}
+
+func TestWatchesPane(t *testing.T) {
+	tu := testTUI(t)
+	tu.mon.memory.PutWord(0x10b, 0x1234)
+	tu.watches = []string{"w[count]", "count", "sp - 2", "nope"}
+	assert.Equal(t, []string{
+		"w[count] = 0x1234 (4660)",
+		"count = 0x010b (267)",
+		"sp - 2 = 0xfffe (65534)",
+		"nope: unknown symbol 'nope'",
+	}, tu.watchesPane())
+}
+
+func TestConsoleBuffer(t *testing.T) {
+	var c consoleBuffer
+	fmt.Fprint(&c, "hello ")
+	fmt.Fprint(&c, "world\r\nsecond")
+	assert.Equal(t, []string{"hello world", "second"}, c.lines)
+	fmt.Fprint(&c, "\n")
+	assert.Equal(t, []string{"hello world", "second", ""}, c.lines)
+
+	for i := 0; i < tuiConsoleLines+5; i++ {
+		fmt.Fprintf(&c, "%d\n", i)
+	}
+	assert.Len(t, c.lines, tuiConsoleLines)
+	assert.Equal(t, "6", c.lines[0])
+	assert.Equal(t, "", c.lines[len(c.lines)-1])
+}
+
+func trimLines(lines []string) []string {
+	result := make([]string, len(lines))
+	for i, line := range lines {
+		result[i] = strings.TrimRight(line, " ")
+	}
+	return result
+}